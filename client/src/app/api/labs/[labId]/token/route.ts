@@ -0,0 +1,37 @@
+import { NextResponse } from 'next/server'
+import { auth } from '@/auth'
+
+// Mints a short lived token for the runner and PTY sockets of a lab the
+// signed in user owns
+export async function POST(
+  request: Request,
+  { params }: { params: Promise<{ labId: string }> }
+) {
+  const session = await auth()
+  if (!session?.user?.id) {
+    return NextResponse.json({ error: 'Unauthorized' }, { status: 401 })
+  }
+
+  try {
+    const { labId } = await params
+    const body = await request.json().catch(() => ({}))
+    const backend = process.env.BACKEND_API_URL || 'http://localhost:8080'
+    const res = await fetch(`${backend}/v1/labs/${encodeURIComponent(labId)}/token`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+        'X-Internal-Secret': process.env.INTERNAL_API_SECRET!,
+        'X-User-Id': session.user.id,
+      },
+      body: JSON.stringify({ scope: body?.scope }),
+    })
+
+    if (!res.ok) {
+      return NextResponse.json({ error: (await res.text()).trim() }, { status: res.status })
+    }
+    return NextResponse.json(await res.json())
+  } catch (err) {
+    console.error('Lab token error:', err)
+    return NextResponse.json({ error: 'Internal error' }, { status: 500 })
+  }
+}
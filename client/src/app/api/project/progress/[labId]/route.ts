@@ -31,8 +31,12 @@ export async function GET(
       // Parse the lab instance
       const labInstance = JSON.parse(labData)
 
-      // Get the latest progress logs
-      const progressLogs = labInstance.progressLogs || labInstance.ProgressLogs || []
+      // Get the latest progress logs, the runner keeps workspace download
+      // progress in a list of its own
+      const hydrationLogs = (await client.lRange(`lab_hydration_progress:${labId}`, 0, -1))
+        .map((entry) => JSON.parse(entry))
+      const progressLogs = [...(labInstance.progressLogs || labInstance.ProgressLogs || []), ...hydrationLogs]
+        .sort((a: any, b: any) => (a.Timestamp ?? a.timestamp ?? 0) - (b.Timestamp ?? b.timestamp ?? 0))
       
       // Get test results and active checkpoint
       const testResults = labInstance.testResults  || labInstance.TestResults || []
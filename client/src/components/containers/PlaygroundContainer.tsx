@@ -13,6 +13,7 @@ import Link from "next/link";
 import { PLAYGROUND_OPTIONS } from "@/constants/playground";
 import { MaxLabsModal } from "@/components/editor/MaxLabsModal";
 import { generateRandomLabId } from "@/utils/labIdGenerator";
+import { rememberLabToken } from "@/lib/fs";
 import Squares from "@/components/landing/Squares";
 import Navbar from "@/components/landing/Navbar";
 import Footer from "@/components/landing/Footer";
@@ -72,6 +73,7 @@ export default function PlaygroundContainer() {
 
       const data = await res.json();
       if (!labId) throw new Error("No labId returned from server");
+      rememberLabToken(labId, data);
 
       // Redirect to the project page
       setTimeout(() => {
@@ -15,6 +15,7 @@ import Squares from "@/components/landing/Squares";
 import { Language } from "@/app/projects/page";
 import { QuestMeta } from "@/app/projects/[language]/page";
 import { generateRandomLabId } from "@/utils/labIdGenerator";
+import { rememberLabToken } from "@/lib/fs";
 import { MobileSupportModal } from "@/components/common/MobileSupportModal";
 
 interface StartQuestModalProps {
@@ -278,6 +279,7 @@ export function ProjectContainer({projects, language}: {projects: QuestMeta[], l
       const data = await response.json();
       
       if (data.success) {
+        rememberLabToken(labId, data);
         // Redirect to the experimental project IDE with tabs UI
         window.location.href = `/project/${language}/${selectedQuest.slug}/${labId}`;
       } else {
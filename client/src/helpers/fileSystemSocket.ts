@@ -32,6 +32,8 @@ class FileSystemSocket {
   private openHandlers: Array<() => void> = [];
   private closeHandlers: Array<(ev: CloseEvent) => void> = [];
   private heartbeatInterval: NodeJS.Timeout | null = null;
+  // Adds the lab access token to the url before every (re)connect
+  private authorizeUrl: (url: string) => Promise<string> = async (url) => url;
 
   private rejectAllPending(err: Error) {
     this.requestCallbacks.forEach(({ reject }) => {
@@ -101,9 +103,9 @@ async  checkIfAvailable(url: string): Promise<boolean> {
 
     this.isConnecting = true;
     this.shouldReconnect = true;
-    this.connectionPromise = new Promise((resolve, reject) => {
+    this.connectionPromise = this.authorizeUrl(url).then((authorizedUrl) => new Promise<void>((resolve, reject) => {
       try {
-        this.ws = new WebSocket(url);
+        this.ws = new WebSocket(authorizedUrl);
 
         const timeout = setTimeout(() => {
           if (this.ws) this.ws.close();
@@ -172,11 +174,20 @@ async  checkIfAvailable(url: string): Promise<boolean> {
         this.connectionPromise = null;
         reject(error);
       }
+    }), (error) => {
+      // No token, e.g. the session expired, nothing was opened
+      this.isConnecting = false;
+      this.connectionPromise = null;
+      throw error;
     });
 
     return this.connectionPromise;
   }
 
+  setUrlAuthorizer(authorize: (url: string) => Promise<string>) {
+    this.authorizeUrl = authorize;
+  }
+
   private handleMessage(event: MessageEvent) {
     try {
   const response: WSResponse = JSON.parse(event.data);
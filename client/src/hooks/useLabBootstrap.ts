@@ -13,7 +13,7 @@ import {
   FileInfo,
   FileContentResponse
 } from '../constants/FS_MessageTypes';
-import { buildFsUrl } from '@/lib/fs';
+import { buildFsUrl, rememberLabToken, withLabToken } from '@/lib/fs';
 import { buildPtyUrl } from '@/lib/pty';
 import { dlog, isDebug } from '../utils/debug';
 
@@ -235,7 +235,11 @@ export function useLabBootstrap({
         setMaxLabsReached(true);
         return false;
       }
-      if (res.ok || res.status === 409) return true;
+      if (res.ok) {
+        rememberLabToken(labId, await res.json().catch(() => null));
+        return true;
+      }
+      if (res.status === 409) return true;
       return false;
     } catch {
       return false;
@@ -323,6 +327,7 @@ export function useLabBootstrap({
     }
     connectingFs.current = true;
     fsSocket.setVerboseDebug(isDebug());
+    fsSocket.setUrlAuthorizer((url) => withLabToken(url, labId));
     const doConnect = async () => {
       try {
         dlog('Connecting FS socket...');
@@ -393,10 +398,12 @@ export function useLabBootstrap({
     return fsConnectInFlight;
   }, [fsUrl, language, labId, autoConnectPty, requirePtyForReady, fsReady, fetchQuestMeta]);
 
-  const connectPty = useCallback(() => {
+  const connectPty = useCallback(async () => {
     if (ptyReady || !ptyUrl || ptySocketRef.current) return;
     try {
-      const ws = new WebSocket(ptyUrl);
+      const authorizedUrl = await withLabToken(ptyUrl, labId);
+      if (ptySocketRef.current) return;
+      const ws = new WebSocket(authorizedUrl);
       ptySocketRef.current = ws;  
       ws.onopen = () => {
         if (!isMounted.current) return;
@@ -436,7 +443,7 @@ export function useLabBootstrap({
         setPhase('error');
       }
     }
-  }, [ptyUrl, ptyReady, requirePtyForReady, fsReady]);
+  }, [ptyUrl, labId, ptyReady, requirePtyForReady, fsReady]);
 
   // File operations (minimal subset)
   const openFile = useCallback(async (path: string): Promise<string> => {
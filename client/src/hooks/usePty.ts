@@ -2,6 +2,7 @@
 
 import { useState, useRef, useCallback, useEffect } from 'react';
 import { buildPtyUrl } from '@/lib/pty';
+import { withLabToken } from '@/lib/fs';
 import { dlog } from '@/utils/debug';
 
 // --- Types ---
@@ -107,7 +108,7 @@ export function usePty({
 
   // --- Connection Logic ---
 
-  const connect = useCallback(() => {
+  const connect = useCallback(async () => {
     if (!labId) return;
     if (socketRef.current?.readyState === WebSocket.OPEN) return;
 
@@ -115,7 +116,18 @@ export function usePty({
     const url = buildPtyUrl(labId);
     dlog('usePty: Connecting to', url);
 
-    const ws = new WebSocket(url);
+    let authorizedUrl: string;
+    try {
+      authorizedUrl = await withLabToken(url, labId);
+    } catch (error) {
+      console.error('usePty: Failed to get lab access token', error);
+      setConnectionState('disconnected');
+      return;
+    }
+    // Another connect won while the token was fetched
+    if (socketRef.current) return;
+
+    const ws = new WebSocket(authorizedUrl);
     socketRef.current = ws;
 
     ws.onopen = () => {
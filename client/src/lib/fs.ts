@@ -5,3 +5,62 @@ export function buildFsUrl(labId?: string) {
   if (override) return `${override.replace(/\/$/, '')}/fs`;
   return `${wsProtocol}://${labId}.devsarena.in/fs`;
 }
+
+type LabToken = { accessToken: string; expiresAt: number };
+
+// Tokens are short lived, a new one is fetched once less than this is left
+const LAB_TOKEN_REFRESH_MS = 60_000;
+const labTokens: Record<string, LabToken> = {};
+
+function tokenStorageKey(labId: string) {
+  return `lab-token:${labId}`;
+}
+
+// Keep the token a lab start handed out, labs started without signing in
+// cannot get another one from /api/labs/:labId/token
+export function rememberLabToken(labId: string, data: any) {
+  if (!labId || !data?.accessToken || !data?.expiresAt) return;
+  const token: LabToken = { accessToken: data.accessToken, expiresAt: data.expiresAt };
+  labTokens[labId] = token;
+  try {
+    sessionStorage.setItem(tokenStorageKey(labId), JSON.stringify(token));
+  } catch {
+    // storage is optional
+  }
+}
+
+function cachedLabToken(labId: string): LabToken | null {
+  if (labTokens[labId]) return labTokens[labId];
+  try {
+    const stored = sessionStorage.getItem(tokenStorageKey(labId));
+    if (stored) return (labTokens[labId] = JSON.parse(stored));
+  } catch {
+    // storage is optional
+  }
+  return null;
+}
+
+export async function getLabToken(labId: string): Promise<string> {
+  const cached = cachedLabToken(labId);
+  if (cached && cached.expiresAt * 1000 - Date.now() > LAB_TOKEN_REFRESH_MS) {
+    return cached.accessToken;
+  }
+  const res = await fetch(`/api/labs/${encodeURIComponent(labId)}/token`, { method: 'POST' });
+  if (!res.ok) {
+    // An anonymous lab can keep using its start token until it expires
+    if (cached && cached.expiresAt * 1000 > Date.now()) return cached.accessToken;
+    throw new Error(`Failed to get lab access token (HTTP ${res.status})`);
+  }
+  const data = await res.json();
+  rememberLabToken(labId, data);
+  return data.accessToken;
+}
+
+// Runner and PTY sockets take the token as a query parameter, browsers
+// cannot set headers on a WebSocket
+export async function withLabToken(url: string, labId?: string): Promise<string> {
+  if (!url || !labId) return url;
+  const token = await getLabToken(labId);
+  const separator = url.includes('?') ? '&' : '?';
+  return `${url}${separator}token=${encodeURIComponent(token)}`;
+}
@@ -39,6 +39,8 @@ const authMiddleware = auth((req) => {
 
   // Prepare Request Headers (if logged in)
   const requestHeaders = new Headers(req.headers)
+  // Only the session may name the user, never the browser
+  requestHeaders.delete("x-user-id")
   if (isLoggedIn && req.auth?.user?.id) {
     requestHeaders.set("x-user-id", req.auth.user.id)
   }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+)
+
+const (
+	ARCHIVE_FORMAT_ZIP   = "zip"
+	ARCHIVE_FORMAT_TARGZ = "tar.gz"
+)
+
+type archiveEntry struct {
+	relPath string
+	info    fs.FileInfo
+}
+
+type archiveWriter interface {
+	add(name string, entry archiveEntry) error
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) add(name string, entry archiveEntry) error {
+	header, err := zip.FileInfoHeader(entry.info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if entry.info.IsDir() {
+		header.Name += "/"
+		_, err := a.zw.CreateHeader(header)
+		return err
+	}
+	header.Method = zip.Deflate
+
+	w, err := a.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	return copyWorkspaceFile(w, entry.relPath)
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarGzArchive) add(name string, entry archiveEntry) error {
+	header, err := tar.FileInfoHeader(entry.info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if entry.info.IsDir() {
+		header.Name += "/"
+	}
+	// Owner ids of the pod mean nothing on the student's machine
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if entry.info.IsDir() {
+		return nil
+	}
+	return copyWorkspaceFile(a.tw, entry.relPath)
+}
+
+func (a *tarGzArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+func copyWorkspaceFile(w io.Writer, relPath string) error {
+	file, err := WorkspaceFS.Open(relPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// Stream the whole workspace as a zip or tar.gz archive. Read only tokens
+// are accepted on purpose: a read only session can already open every file
+// over the socket, the archive only saves it the round trips.
+//
+// Query parameters:
+//
+//	format   zip (default) or tar.gz
+//	slim     when true paths matched by the ignore rules are left out
+//	exclude  extra glob patterns to leave out, may be repeated
+func ArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := requireAuth(w, r); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = ARCHIVE_FORMAT_ZIP
+	}
+	if format != ARCHIVE_FORMAT_ZIP && format != ARCHIVE_FORMAT_TARGZ {
+		http.Error(w, "unsupported archive format "+format, http.StatusBadRequest)
+		return
+	}
+
+	slim := query.Get("slim") == "true"
+	exclude, err := compileGlobs(query["exclude"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := PodLabID()
+	if name == "" {
+		name = "workspace"
+	}
+
+	var archive archiveWriter
+	switch format {
+	case ARCHIVE_FORMAT_ZIP:
+		w.Header().Set("Content-Type", "application/zip")
+		archive = &zipArchive{zw: zip.NewWriter(w)}
+	case ARCHIVE_FORMAT_TARGZ:
+		w.Header().Set("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(w)
+		archive = &tarGzArchive{gz: gz, tw: tar.NewWriter(gz)}
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+
+	files := 0
+	err = WorkspaceFS.WalkDir("", func(relPath string, d fs.DirEntry) error {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		if matchAny(exclude, relPath) || slim && Ignore.IgnoredEntry(relPath, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Symlinks and special files are not exported
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			files++
+		}
+		return archive.add(path.Join(name, relPath), archiveEntry{relPath: relPath, info: info})
+	})
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		// The response is already streaming, abort it so the download is not mistaken for a complete archive
+		log.Printf("Failed to stream workspace archive: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+
+	log.Printf("Streamed workspace archive (%s, %d files)", format, files)
+}
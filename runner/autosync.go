@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	SYNC_DEBOUNCE         = 5 * time.Second
+	SYNC_MAX_INTERVAL     = 60 * time.Second // longest a dirty file waits, also the idle poll interval
+	SYNC_RETRY_MIN        = 2 * time.Second
+	SYNC_RETRY_MAX        = 2 * time.Minute
+	SYNC_CONCURRENCY      = 10
+	SYNC_SHUTDOWN_TIMEOUT = 20 * time.Second
+)
+
+// Sync states reported to the client
+const (
+	SYNC_STATE_IDLE    = "idle"
+	SYNC_STATE_PENDING = "pending"
+	SYNC_STATE_SYNCING = "syncing"
+	SYNC_STATE_SYNCED  = "synced"
+	SYNC_STATE_ERROR   = "error"
+)
+
+// syncMu keeps automatic and server requested syncs from running at the same time
+var syncMu sync.Mutex
+
+// syncDirtyEntry uploads or deletes a single dirty path, unchanged files are skipped
+func syncDirtyEntry(ctx context.Context, storage ObjectStorage, s3CodeLink string, entry DirtyFileEntry) (string, error) {
+	localPath := dirtyRelPath(entry.Path)
+	key := strings.Join([]string{s3CodeLink, localPath}, "/")
+
+	if entry.Action == "edit" {
+		if Ignore.IsIgnored(localPath, false) {
+			// Dropped from the dirty list without an upload
+			return SYNC_RESULT_IGNORED, nil
+		}
+		file, err := GetFileByPath(ctx, localPath)
+		if err == nil {
+			defer file.Close()
+			result, err := syncUpload(ctx, storage, key, file)
+			if err != nil {
+				return "", err
+			}
+			if result == SYNC_RESULT_UPLOADED {
+				log.Printf("Synced (Uploaded): %s", key)
+			}
+			return result, nil
+		}
+		if isFSErrorCode(err, FS_ERR_IS_DIRECTORY) {
+			// A renamed directory is marked as a whole, its files go up one by one
+			return syncDirectory(ctx, storage, key, localPath)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		// Removed outside the editor since it was marked, mirror the delete
+	}
+
+	return syncDelete(ctx, storage, key)
+}
+
+// syncDirectory uploads every file below a directory that is not ignored
+func syncDirectory(ctx context.Context, storage ObjectStorage, key, localPath string) (string, error) {
+	result := SYNC_RESULT_SKIPPED
+	err := WorkspaceFS.WalkDir(localPath, func(relPath string, d fs.DirEntry) error {
+		if d.IsDir() {
+			if relPath != localPath && Ignore.IsIgnored(relPath, true) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || Ignore.IsIgnored(relPath, false) {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		file, err := WorkspaceFS.Open(relPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed while walking, its delete is marked on its own
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		fileKey := key + strings.TrimPrefix(relPath, localPath)
+		fileResult, err := syncUpload(ctx, storage, fileKey, file)
+		if err != nil {
+			return err
+		}
+		if fileResult == SYNC_RESULT_UPLOADED {
+			log.Printf("Synced (Uploaded): %s", fileKey)
+			result = SYNC_RESULT_UPLOADED
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// syncDelete removes a key and, for a deleted or renamed directory, every
+// object below it
+func syncDelete(ctx context.Context, storage ObjectStorage, key string) (string, error) {
+	nested, err := storage.List(ctx, key+"/")
+	if err != nil {
+		return "", fmt.Errorf("failed to list %s: %w", key, err)
+	}
+	keys := make([]string, 0, len(nested)+1)
+	for _, obj := range nested {
+		keys = append(keys, obj.Key)
+	}
+	keys = append(keys, key)
+	for _, objectKey := range keys {
+		if err := storage.Delete(ctx, objectKey); err != nil {
+			return "", fmt.Errorf("failed to delete %s: %w", objectKey, err)
+		}
+		Manifest.Remove(objectKey)
+	}
+	if len(nested) > 0 {
+		log.Printf("Synced (Deleted): %s and %d objects below it", key, len(nested))
+	} else {
+		log.Printf("Synced (Deleted): %s", key)
+	}
+	return SYNC_RESULT_DELETED, nil
+}
+
+// syncDirtyFiles flushes a snapshot of the lab's dirty paths to the bucket
+// and clears the entries that made it
+func syncDirtyFiles(ctx context.Context, storage ObjectStorage, labID string) (SyncStatus, error) {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	// Nothing can be dirty before a session named the lab
+	if labID == "" {
+		return SyncStatus{State: SYNC_STATE_SYNCED}, nil
+	}
+	entries, err := GetLabInstanceDirtyPaths(labID)
+	if err != nil {
+		return SyncStatus{}, fmt.Errorf("failed to read dirty paths: %w", err)
+	}
+	status := SyncStatus{State: SYNC_STATE_SYNCED}
+	if len(entries) == 0 {
+		return status, nil
+	}
+
+	s3CodeLink := os.Getenv("LAB_CODE_LINK")
+
+	var mu sync.Mutex
+	var synced []DirtyFileEntry
+	var firstErr error
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(SYNC_CONCURRENCY)
+	for _, entry := range entries {
+		g.Go(func() error {
+			action, err := syncDirtyEntry(gctx, storage, s3CodeLink, entry)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				// Keep going, the failed entries stay dirty for the next attempt
+				log.Printf("Failed to sync %s: %v", entry.Path, err)
+				status.Failed++
+				status.Failures = append(status.Failures, SyncFailure{Path: dirtyRelPath(entry.Path), Error: err.Error()})
+				if firstErr == nil {
+					firstErr = err
+				}
+				return nil
+			}
+			synced = append(synced, entry)
+			switch action {
+			case SYNC_RESULT_UPLOADED:
+				status.Uploaded++
+			case SYNC_RESULT_SKIPPED:
+				status.Skipped++
+			case SYNC_RESULT_IGNORED:
+				status.Ignored++
+			case SYNC_RESULT_DELETED:
+				status.Deleted++
+			}
+			return nil
+		})
+	}
+	g.Wait()
+	log.Printf("Sync finished: %d uploaded, %d skipped, %d ignored, %d deleted, %d failed",
+		status.Uploaded, status.Skipped, status.Ignored, status.Deleted, status.Failed)
+	if err := Manifest.Save(); err != nil {
+		log.Printf("Failed to save sync manifest: %v", err)
+	}
+
+	// Paths written again while they were uploading keep their newer mark
+	err = ClearLabInstanceDirtyPaths(labID, synced)
+	if err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	status.Pending = status.Failed
+	if firstErr != nil {
+		status.State = SYNC_STATE_ERROR
+		status.Error = firstErr.Error()
+	}
+	return status, firstErr
+}
+
+// AutoSyncer flushes dirty files in the background. A sync runs once writes
+// settle for SYNC_DEBOUNCE, but never later than SYNC_MAX_INTERVAL after the
+// first unsynced write. Failed syncs are retried with exponential backoff.
+type AutoSyncer struct {
+	manager *WSManager
+	storage ObjectStorage
+	notify  chan struct{}
+
+	mu     sync.Mutex
+	status SyncStatus
+}
+
+var Syncer *AutoSyncer
+
+func NewAutoSyncer(manager *WSManager, storage ObjectStorage) *AutoSyncer {
+	return &AutoSyncer{
+		manager: manager,
+		storage: storage,
+		notify:  make(chan struct{}, 1),
+		status:  SyncStatus{State: SYNC_STATE_IDLE},
+	}
+}
+
+// Notify tells the syncer there is something new to flush
+func (s *AutoSyncer) Notify() {
+	if s == nil {
+		return
+	}
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *AutoSyncer) Status() SyncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *AutoSyncer) setStatus(status SyncStatus) {
+	s.mu.Lock()
+	if status.LastSyncedAt == 0 {
+		status.LastSyncedAt = s.status.LastSyncedAt
+	}
+	s.status = status
+	s.mu.Unlock()
+	s.manager.Broadcast(RESPONSE_SYNC_STATUS, status)
+}
+
+// syncOnce runs a sync and reports the outcome, quiet syncs only tell the
+// client when they found something to do
+func (s *AutoSyncer) syncOnce(ctx context.Context, quiet bool, retryIn time.Duration) error {
+	if !quiet {
+		s.setStatus(SyncStatus{State: SYNC_STATE_SYNCING})
+	}
+	status, err := syncDirtyFiles(ctx, s.storage, PodLabID())
+	if err != nil {
+		if retryIn > 0 {
+			status.NextRetryAt = time.Now().Add(retryIn).Unix()
+		}
+		s.setStatus(status)
+		return err
+	}
+
+	status.LastSyncedAt = time.Now().Unix()
+	if quiet && status.Uploaded+status.Skipped+status.Ignored+status.Deleted == 0 {
+		s.mu.Lock()
+		s.status.LastSyncedAt = status.LastSyncedAt
+		s.mu.Unlock()
+		return nil
+	}
+	s.setStatus(status)
+	return nil
+}
+
+func (s *AutoSyncer) Run(ctx context.Context) {
+	timer := time.NewTimer(SYNC_MAX_INTERVAL)
+	defer timer.Stop()
+
+	var pending bool
+	var deadline time.Time
+	backoff := time.Duration(0)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-s.notify:
+			now := time.Now()
+			if !pending {
+				pending = true
+				deadline = now.Add(SYNC_MAX_INTERVAL)
+				s.setStatus(SyncStatus{State: SYNC_STATE_PENDING})
+			}
+			if backoff > 0 {
+				// Keep waiting out the backoff, the retry picks the new write up
+				continue
+			}
+			next := now.Add(SYNC_DEBOUNCE)
+			if next.After(deadline) {
+				next = deadline
+			}
+			timer.Reset(time.Until(next))
+
+		case <-timer.C:
+			// Also fires when idle, dirty paths can be marked by other services
+			nextBackoff := min(max(backoff*2, SYNC_RETRY_MIN), SYNC_RETRY_MAX)
+			if err := s.syncOnce(ctx, !pending && backoff == 0, nextBackoff); err != nil {
+				backoff = nextBackoff
+				log.Printf("Auto sync failed, retrying in %s: %v", backoff, err)
+				timer.Reset(backoff)
+				continue
+			}
+			backoff = 0
+			pending = false
+			timer.Reset(SYNC_MAX_INTERVAL)
+		}
+	}
+}
+
+// Flush runs a last sync, used when the pod is shutting down
+func (s *AutoSyncer) Flush(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	return s.syncOnce(ctx, false, 0)
+}
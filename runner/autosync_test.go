@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// newTestWorkspace points WorkspaceFS at a temporary directory holding files
+func newTestWorkspace(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		target := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	workspace, err := NewWorkspace(root)
+	if err != nil {
+		t.Fatalf("failed to open workspace: %v", err)
+	}
+	previous := WorkspaceFS
+	WorkspaceFS = workspace
+	t.Cleanup(func() { WorkspaceFS = previous })
+	return root
+}
+
+func listKeys(t *testing.T, storage ObjectStorage, prefix string) []string {
+	t.Helper()
+	objects, err := storage.List(context.Background(), prefix)
+	if err != nil {
+		t.Fatalf("failed to list %s: %v", prefix, err)
+	}
+	keys := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestSyncDirtyDirectory(t *testing.T) {
+	newTestWorkspace(t, map[string]string{
+		"src/app.js":              "app",
+		"src/lib/util.js":         "util",
+		"src/node_modules/x/x.js": "ignored",
+		"other.js":                "other",
+	})
+	previousIgnore := Ignore
+	Ignore = &IgnoreRules{rules: parseIgnoreLines("", []string{"node_modules/"})}
+	t.Cleanup(func() { Ignore = previousIgnore })
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	const codeLink = "code/node/lab-1"
+
+	// A renamed directory is marked as an edit of the directory itself
+	result, err := syncDirtyEntry(ctx, storage, codeLink, DirtyFileEntry{Path: "code/node/lab-1/src", Action: "edit"})
+	if err != nil {
+		t.Fatalf("expected the directory to sync; got %v", err)
+	}
+	if result != SYNC_RESULT_UPLOADED {
+		t.Errorf("expected %s; got %s", SYNC_RESULT_UPLOADED, result)
+	}
+	want := []string{codeLink + "/src/app.js", codeLink + "/src/lib/util.js"}
+	if got := listKeys(t, storage, codeLink+"/"); !equalStrings(got, want) {
+		t.Fatalf("expected %v uploaded; got %v", want, got)
+	}
+
+	// Nothing changed, a second pass has nothing to upload
+	if result, err := syncDirtyEntry(ctx, storage, codeLink, DirtyFileEntry{Path: "code/node/lab-1/src", Action: "edit"}); err != nil || result != SYNC_RESULT_SKIPPED {
+		t.Fatalf("expected %s; got %s, %v", SYNC_RESULT_SKIPPED, result, err)
+	}
+
+	// Deleting the directory takes every object below it
+	if _, err := syncDirtyEntry(ctx, storage, codeLink, DirtyFileEntry{Path: "code/node/lab-1/src", Action: "delete"}); err != nil {
+		t.Fatalf("expected the directory delete to sync; got %v", err)
+	}
+	if got := listKeys(t, storage, codeLink+"/"); len(got) != 0 {
+		t.Fatalf("expected no objects left; got %v", got)
+	}
+}
+
+func TestSyncDeleteKeepsSiblings(t *testing.T) {
+	newTestWorkspace(t, nil)
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, name := range []string{"lab/src/a.js", "lab/src2/b.js"} {
+		newTestWorkspace(t, map[string]string{"f": name})
+		file, err := WorkspaceFS.Open("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := syncUpload(ctx, storage, name, file); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+
+	if _, err := syncDelete(ctx, storage, "lab/src"); err != nil {
+		t.Fatalf("expected delete to succeed; got %v", err)
+	}
+	if got := listKeys(t, storage, "lab/"); !equalStrings(got, []string{"lab/src2/b.js"}) {
+		t.Fatalf("expected only the sibling to remain; got %v", got)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
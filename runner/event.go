@@ -12,6 +12,35 @@ var (
 	FS_FETCH_QUEST_META    = "fs_fetch_quest_meta"
 	FS_INITIALIZE_CLIENT   = "fs_initialize_client"
 	SYNC_FILES_TO_S3       = "fs_sync_files_to_s3"
+	FS_DOWNLOAD_CHUNK      = "fs_download_chunk"
+	FS_UPLOAD_START        = "fs_upload_start"
+	FS_UPLOAD_CHUNK        = "fs_upload_chunk"
+	FS_UPLOAD_COMPLETE     = "fs_upload_complete"
+	FS_UPLOAD_ABORT        = "fs_upload_abort"
+	FS_FILE_PATCH          = "fs_file_patch"
+	FS_SEARCH              = "fs_search"
+	FS_SEARCH_CANCEL       = "fs_search_cancel"
+	FS_IMPORT_ARCHIVE      = "fs_import_archive"
+	GIT_STATUS             = "git_status"
+	GIT_DIFF               = "git_diff"
+	GIT_LOG                = "git_log"
+	GIT_STAGE              = "git_stage"
+	GIT_COMMIT             = "git_commit"
+	GIT_CHECKOUT           = "git_checkout"
+	FS_HISTORY_LIST        = "fs_history_list"
+	FS_HISTORY_DIFF        = "fs_history_diff"
+	FS_HISTORY_RESTORE     = "fs_history_restore"
+	FS_SYNC_STATUS         = "fs_sync_status"
+	FS_TREE_SYNC           = "fs_tree_sync"
+	FS_QUOTA_STATUS        = "fs_quota_status"
+	FS_FORMAT_FILE         = "fs_format_file"
+	FS_LINT_FILE           = "fs_lint_file"
+)
+
+// Content encodings used for file payloads
+const (
+	ENCODING_UTF8   = "utf-8"
+	ENCODING_BASE64 = "base64"
 )
 
 type InitializeClient struct {
@@ -22,12 +51,50 @@ type InitializeClient struct {
 type Event struct {
 	Type    string          `json:"type"`
 	Payload json.RawMessage `json:"payload"`
+	// RequestID is echoed in every response to this event
+	RequestID string `json:"requestId,omitempty"`
+	// LegacyRequestID is the snake_case id sent by older clients
+	LegacyRequestID string `json:"request_id,omitempty"`
 }
 
 // Payload structures for file system events
 type FileContentUpdatePayload struct {
-	Path    string `json:"path"`
-	Content string `json:"content"`
+	Path     string `json:"path"`
+	Content  string `json:"content"`
+	Encoding string `json:"encoding,omitempty"`
+	// BaseVersion is the version the edit was made against, stale writes are rejected
+	BaseVersion string `json:"baseVersion,omitempty"`
+}
+
+// TextEdit replaces the range From-To (UTF-16 code units in the base text) with Text
+type TextEdit struct {
+	From int    `json:"from"`
+	To   int    `json:"to"`
+	Text string `json:"text"`
+}
+
+// FilePatchPayload carries either range edits or a unified diff against BaseVersion
+type FilePatchPayload struct {
+	Path        string     `json:"path"`
+	BaseVersion string     `json:"baseVersion"`
+	Edits       []TextEdit `json:"edits,omitempty"`
+	Diff        string     `json:"diff,omitempty"`
+}
+
+type SearchPayload struct {
+	Query          string   `json:"query"`
+	Path           string   `json:"path,omitempty"` // directory to search, defaults to the workspace root
+	IsRegex        bool     `json:"isRegex,omitempty"`
+	CaseSensitive  bool     `json:"caseSensitive,omitempty"`
+	WholeWord      bool     `json:"wholeWord,omitempty"`
+	Include        []string `json:"include,omitempty"`
+	Exclude        []string `json:"exclude,omitempty"`
+	MaxResults     int      `json:"maxResults,omitempty"`
+	IncludeIgnored bool     `json:"includeIgnored,omitempty"` // also search paths matched by the ignore rules
+}
+
+type SearchCancelPayload struct {
+	SearchID string `json:"searchId"`
 }
 
 type LoadDirPayload struct {
@@ -39,9 +106,10 @@ type FetchFileContentPayload struct {
 }
 
 type NewFilePayload struct {
-	Path    string `json:"path"`
-	IsDir   bool   `json:"isDir"`
-	Content string `json:"content,omitempty"`
+	Path     string `json:"path"`
+	IsDir    bool   `json:"isDir"`
+	Content  string `json:"content,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
 }
 
 type DeleteFilePayload struct {
@@ -54,7 +122,101 @@ type EditFileMetaPayload struct {
 }
 
 type FetchQuestMetaPayload struct {
+	Path     string `json:"path"`
+	MaxDepth int    `json:"maxDepth,omitempty"` // levels below path to list, 0 for the whole tree
+	Cursor   string `json:"cursor,omitempty"`   // nextCursor of the previous page
+	PageSize int    `json:"pageSize,omitempty"`
+}
+
+type TreeSyncPayload struct {
+	RootHash string `json:"rootHash"` // rootHash of the last tree the client saw
+}
+
+type DownloadChunkPayload struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length,omitempty"`
+}
+
+type UploadStartPayload struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type UploadChunkPayload struct {
+	UploadID string `json:"uploadId"`
+	Offset   int64  `json:"offset"`
+	Data     string `json:"data"` // base64
+}
+
+type UploadCompletePayload struct {
+	UploadID    string `json:"uploadId"`
+	Checksum    string `json:"checksum"` // hex encoded sha256 of the whole file
+	BaseVersion string `json:"baseVersion,omitempty"`
+}
+
+type UploadAbortPayload struct {
+	UploadID string `json:"uploadId"`
+}
+
+// ImportArchivePayload extracts a zip or tar.gz into Path. The archive is either
+// a fully received chunked upload (UploadID and Checksum) or an object in the
+// bucket (Key).
+type ImportArchivePayload struct {
+	Path     string `json:"path"`
+	UploadID string `json:"uploadId,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Format   string `json:"format,omitempty"` // zip or tar.gz, detected when empty
+}
+
+type GitDiffPayload struct {
+	Path   string `json:"path,omitempty"`
+	Staged bool   `json:"staged,omitempty"`
+	Commit string `json:"commit,omitempty"` // diff against this commit instead of the index
+}
+
+type GitLogPayload struct {
+	Ref   string `json:"ref,omitempty"`
+	Path  string `json:"path,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+	Skip  int    `json:"skip,omitempty"`
+}
+
+type GitStagePayload struct {
+	Paths   []string `json:"paths,omitempty"` // everything when empty
+	Unstage bool     `json:"unstage,omitempty"`
+}
+
+type GitCommitPayload struct {
+	Message     string `json:"message"`
+	Amend       bool   `json:"amend,omitempty"`
+	AuthorName  string `json:"authorName,omitempty"`
+	AuthorEmail string `json:"authorEmail,omitempty"`
+}
+
+// GitCheckoutPayload switches to Ref, or restores Paths from Ref (the index when empty)
+type GitCheckoutPayload struct {
+	Ref    string   `json:"ref,omitempty"`
+	Create bool     `json:"create,omitempty"`
+	Paths  []string `json:"paths,omitempty"`
+}
+
+type HistoryListPayload struct {
+	Path string `json:"path"`
+}
+
+// HistoryDiffPayload compares two revisions, 0 stands for the file on disk
+type HistoryDiffPayload struct {
 	Path string `json:"path"`
+	From int    `json:"from"`
+	To   int    `json:"to"`
+}
+
+type HistoryRestorePayload struct {
+	Path        string `json:"path"`
+	Revision    int    `json:"revision"`
+	BaseVersion string `json:"baseVersion,omitempty"`
 }
 
 // Response structures
@@ -64,6 +226,11 @@ type FileInfo struct {
 	IsDir   bool   `json:"isDir"`
 	Size    int64  `json:"size"`
 	ModTime string `json:"modTime"`
+	Ignored bool   `json:"ignored,omitempty"` // matched by the ignore rules, shown but not synced
+	Lazy    bool   `json:"lazy,omitempty"`    // directory whose contents were not listed, load them on expand
+	Hash    string `json:"hash,omitempty"`    // content hash, only set by fs_tree_sync
+	// Protection is read_only or undeletable for paths the quest protects
+	Protection string `json:"protection,omitempty"`
 }
 
 type DirContentResponse struct {
@@ -72,15 +239,236 @@ type DirContentResponse struct {
 }
 
 type FileContentResponse struct {
-	Path    string `json:"path"`
-	Content string `json:"content"`
+	Path     string `json:"path"`
+	Content  string `json:"content"`
+	Encoding string `json:"encoding"`
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
+	Version  string `json:"version"`
+}
+
+type FileChunkResponse struct {
+	Path     string `json:"path"`
+	Offset   int64  `json:"offset"`
+	Data     string `json:"data"` // base64
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	EOF      bool   `json:"eof"`
+	// Checksum is the hex encoded sha256 of the whole file, only set on the last chunk.
+	// It doubles as the file's version token.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+type UploadStatusResponse struct {
+	UploadID string `json:"uploadId"`
+	Path     string `json:"path"`
+	Received int64  `json:"received"`
+	Size     int64  `json:"size"`
 }
 
 type QuestMetaResponse struct {
+	Path       string     `json:"path"`
+	Files      []FileInfo `json:"files"`
+	Total      int        `json:"total"`                // entries across all pages
+	TreeHash   string     `json:"treeHash"`             // same for as long as the listed tree does not change
+	NextCursor string     `json:"nextCursor,omitempty"` // empty on the last page
+	MaxDepth   int        `json:"maxDepth,omitempty"`
+	RootHash   string     `json:"rootHash,omitempty"` // send it with fs_tree_sync to catch up later, first page only
+}
+
+type TreeDirListing struct {
 	Path  string     `json:"path"`
+	Hash  string     `json:"hash"`
 	Files []FileInfo `json:"files"`
 }
 
+// TreeSyncResponse holds the directories that changed since the client's
+// root hash. Resync means the hash is unknown or too much changed, the
+// client lists the tree again with fs_fetch_quest_meta.
+type TreeSyncResponse struct {
+	RootHash string           `json:"rootHash"`
+	Resync   bool             `json:"resync,omitempty"`
+	Changed  []TreeDirListing `json:"changed,omitempty"`
+	Removed  []string         `json:"removed,omitempty"`
+}
+
+type SearchMatch struct {
+	Path    string `json:"path"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Length  int    `json:"length"`
+	Preview string `json:"preview"`
+}
+
+type SearchResultsResponse struct {
+	SearchID      string        `json:"searchId"`
+	Matches       []SearchMatch `json:"matches"`
+	TotalMatches  int           `json:"totalMatches"`
+	FilesSearched int           `json:"filesSearched"`
+	Done          bool          `json:"done"`
+	Truncated     bool          `json:"truncated"`
+}
+
+// GitFileStatus uses git's status letters (M, A, D, R, C, U, ? and . for unchanged)
+type GitFileStatus struct {
+	Path       string `json:"path"`
+	OrigPath   string `json:"origPath,omitempty"`
+	Index      string `json:"index"`
+	Worktree   string `json:"worktree"`
+	Staged     bool   `json:"staged"`
+	Untracked  bool   `json:"untracked,omitempty"`
+	Conflicted bool   `json:"conflicted,omitempty"`
+}
+
+type GitStatusResponse struct {
+	Initialized bool            `json:"initialized"`
+	Branch      string          `json:"branch,omitempty"`
+	Head        string          `json:"head,omitempty"`
+	Detached    bool            `json:"detached,omitempty"`
+	Upstream    string          `json:"upstream,omitempty"`
+	Ahead       int             `json:"ahead"`
+	Behind      int             `json:"behind"`
+	Files       []GitFileStatus `json:"files"`
+}
+
+type GitDiffLine struct {
+	Type      string `json:"type"` // context, add or delete
+	Content   string `json:"content"`
+	OldLine   int    `json:"oldLine,omitempty"`
+	NewLine   int    `json:"newLine,omitempty"`
+	NoNewline bool   `json:"noNewline,omitempty"`
+}
+
+type GitDiffHunk struct {
+	Header   string        `json:"header"`
+	OldStart int           `json:"oldStart"`
+	OldLines int           `json:"oldLines"`
+	NewStart int           `json:"newStart"`
+	NewLines int           `json:"newLines"`
+	Lines    []GitDiffLine `json:"lines"`
+}
+
+type GitFileDiff struct {
+	Path      string        `json:"path"`
+	OldPath   string        `json:"oldPath,omitempty"`
+	Status    string        `json:"status"` // added, deleted, modified or renamed
+	Binary    bool          `json:"binary,omitempty"`
+	Additions int           `json:"additions"`
+	Deletions int           `json:"deletions"`
+	Hunks     []GitDiffHunk `json:"hunks"`
+}
+
+type GitDiffResponse struct {
+	Staged    bool          `json:"staged"`
+	Commit    string        `json:"commit,omitempty"`
+	Files     []GitFileDiff `json:"files"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+type GitCommit struct {
+	Hash        string   `json:"hash"`
+	ShortHash   string   `json:"shortHash"`
+	Parents     []string `json:"parents"`
+	AuthorName  string   `json:"authorName"`
+	AuthorEmail string   `json:"authorEmail"`
+	Date        string   `json:"date"`
+	Subject     string   `json:"subject"`
+}
+
+type GitLogResponse struct {
+	Commits []GitCommit `json:"commits"`
+	HasMore bool        `json:"hasMore"`
+}
+
+type HistoryRevision struct {
+	ID        int    `json:"id"`
+	Action    string `json:"action"`
+	Timestamp int64  `json:"timestamp"`
+	Version   string `json:"version,omitempty"`
+	Size      int64  `json:"size"`
+	Deleted   bool   `json:"deleted,omitempty"`
+}
+
+type HistoryDiffResponse struct {
+	Path string       `json:"path"`
+	From int          `json:"from"`
+	To   int          `json:"to"`
+	Diff *GitFileDiff `json:"diff"` // nil when both revisions are identical
+}
+
+// SyncStatus reports the state of the background sync to the bucket
+type SyncStatus struct {
+	State        string        `json:"state"`
+	Pending      int           `json:"pending"`
+	Uploaded     int           `json:"uploaded"`
+	Skipped      int           `json:"skipped"` // unchanged since the last upload
+	Ignored      int           `json:"ignored"` // matched by the ignore rules, never uploaded
+	Deleted      int           `json:"deleted"`
+	Failed       int           `json:"failed"`
+	Failures     []SyncFailure `json:"failures,omitempty"`
+	LastSyncedAt int64         `json:"lastSyncedAt,omitempty"`
+	NextRetryAt  int64         `json:"nextRetryAt,omitempty"`
+	Error        string        `json:"error,omitempty"`
+}
+
+type SyncFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// ToolFilePayload asks for a file to be formatted or linted. Without Content
+// the file on disk is used.
+type ToolFilePayload struct {
+	Path     string  `json:"path"`
+	Content  *string `json:"content,omitempty"`
+	Encoding string  `json:"encoding,omitempty"`
+}
+
+type FormatFileResponse struct {
+	Path      string `json:"path"`
+	Content   string `json:"content"`
+	Encoding  string `json:"encoding"`
+	Changed   bool   `json:"changed"`
+	Formatter string `json:"formatter"`
+	// BaseVersion is the version of the file that was formatted, only set when it was read from disk
+	BaseVersion string `json:"baseVersion,omitempty"`
+}
+
+// Diagnostic is one finding of a linter, lines and columns start at 1
+type Diagnostic struct {
+	Line      int    `json:"line"`
+	Column    int    `json:"column,omitempty"`
+	EndLine   int    `json:"endLine,omitempty"`
+	EndColumn int    `json:"endColumn,omitempty"`
+	Severity  string `json:"severity"`
+	Message   string `json:"message"`
+	Rule      string `json:"rule,omitempty"`
+	Source    string `json:"source"`
+}
+
+type LintFileResponse struct {
+	Path        string       `json:"path"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+	Linters     []string     `json:"linters"`
+}
+
+// ProtectedPathsResponse lists the globs the quest protects
+type ProtectedPathsResponse struct {
+	ReadOnly    []string `json:"readOnly"`
+	Undeletable []string `json:"undeletable"`
+}
+
+// QuotaUsage reports how much of the workspace quota is in use
+type QuotaUsage struct {
+	Bytes       int64 `json:"bytes"`
+	Files       int64 `json:"files"`
+	MaxBytes    int64 `json:"maxBytes"`
+	MaxFiles    int64 `json:"maxFiles"`
+	MaxFileSize int64 `json:"maxFileSize"`
+	// Exceeded is set once either total is over its limit, writes that grow the workspace fail until it is not
+	Exceeded bool `json:"exceeded"`
+}
+
 // Standardized response structure
 type WSResponse struct {
 	Type      string      `json:"type"`
@@ -100,15 +488,42 @@ const (
 
 // Standard response types
 const (
-	RESPONSE_DIR_CONTENT  = "dir_content"
-	RESPONSE_FILE_CONTENT = "file_content"
-	RESPONSE_FILE_UPDATED = "file_updated"
-	RESPONSE_FILE_CREATED = "file_created"
-	RESPONSE_FILE_DELETED = "file_deleted"
-	RESPONSE_FILE_RENAMED = "file_renamed"
-	RESPONSE_QUEST_META   = "quest_meta"
-	RESPONSE_ERROR        = "error"
-	RESPONSE_CONNECTION   = "connection"
-	RESPONSE_HEARTBEAT    = "heartbeat"
-	RESPONSE_INFO         = "info"
+	RESPONSE_DIR_CONTENT      = "dir_content"
+	RESPONSE_FILE_CONTENT     = "file_content"
+	RESPONSE_FILE_UPDATED     = "file_updated"
+	RESPONSE_FILE_CREATED     = "file_created"
+	RESPONSE_FILE_DELETED     = "file_deleted"
+	RESPONSE_FILE_RENAMED     = "file_renamed"
+	RESPONSE_QUEST_META       = "quest_meta"
+	RESPONSE_FS_CHANGED       = "fs_changed"
+	RESPONSE_FILE_CHUNK       = "file_chunk"
+	RESPONSE_UPLOAD           = "upload_status"
+	RESPONSE_UPLOAD_DONE      = "upload_complete"
+	RESPONSE_FILE_PATCHED     = "file_patched"
+	RESPONSE_CONFLICT         = "file_conflict"
+	RESPONSE_ACK              = "ack"
+	RESPONSE_NACK             = "nack"
+	RESPONSE_SEARCH_STARTED   = "search_started"
+	RESPONSE_SEARCH_RESULTS   = "search_results"
+	RESPONSE_SEARCH_CANCELLED = "search_cancelled"
+	RESPONSE_ARCHIVE_IMPORTED = "archive_imported"
+	RESPONSE_GIT_STATUS       = "git_status"
+	RESPONSE_GIT_DIFF         = "git_diff"
+	RESPONSE_GIT_LOG          = "git_log"
+	RESPONSE_GIT_STAGED       = "git_staged"
+	RESPONSE_GIT_COMMITTED    = "git_committed"
+	RESPONSE_GIT_CHECKED_OUT  = "git_checked_out"
+	RESPONSE_HISTORY          = "history_list"
+	RESPONSE_HISTORY_DIFF     = "history_diff"
+	RESPONSE_HISTORY_RESTORED = "history_restored"
+	RESPONSE_SYNC_STATUS      = "sync_status"
+	RESPONSE_TREE_SYNC        = "tree_sync"
+	RESPONSE_QUOTA_USAGE      = "quota_usage"
+	RESPONSE_PROTECTED_PATHS  = "protected_paths"
+	RESPONSE_FILE_FORMATTED   = "file_formatted"
+	RESPONSE_FILE_LINTED      = "file_linted"
+	RESPONSE_ERROR            = "error"
+	RESPONSE_CONNECTION       = "connection"
+	RESPONSE_HEARTBEAT        = "heartbeat"
+	RESPONSE_INFO             = "info"
 )
@@ -4,41 +4,62 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/fs"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"golang.org/x/sync/errgroup"
-)
-
-var (
-	LAB_ID   = ""
-	LANGUAGE = ""
 )
 
 type fsHandler func(ctx context.Context, payload json.RawMessage, client *Client) error
 
+// Start the session of a connection, the pod's own identity wins over what
+// the client sends
 func InitializeClientHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
 	var req InitializeClient
 	if err := json.Unmarshal(payload, &req); err != nil {
 		return fmt.Errorf("failed to unmarshal initialize client payload: %w", err)
 	}
 
-	LANGUAGE = req.Language
-	LAB_ID = req.LabID
+	session := client.Session()
+	if session == nil {
+		var err error
+		if session, err = newClientSession(req, client.claims); err != nil {
+			return err
+		}
+		client.SetSession(session)
+	} else if req.LabID != "" && req.LabID != session.LabID {
+		return newFSError(FS_ERR_PERMISSION, "", fmt.Sprintf("this connection belongs to lab %s", session.LabID))
+	}
+
+	log.Printf("Client initialized with Language: %s, LabID: %s (from %s)", session.Language, session.LabID, session.Source)
 
-	log.Printf("Client initialized with Language: %s, LabID: %s", LANGUAGE, LAB_ID)
+	// Without LAB_LANGUAGE the per language ignore defaults are only known now
+	if err := Ignore.SetClientLanguage(session.Language); err != nil {
+		log.Printf("Failed to reload ignore rules: %v", err)
+	}
 
-	return client.SendResponse(RESPONSE_INFO, map[string]string{
+	if err := client.Reply(ctx, RESPONSE_INFO, map[string]string{
 		"message":  "Client initialized",
-		"language": LANGUAGE,
-		"labId":    LAB_ID,
-	})
+		"language": session.Language,
+		"labId":    session.LabID,
+	}); err != nil {
+		return err
+	}
+
+	// The IDE locks what the quest protects
+	if err := client.SendResponse(RESPONSE_PROTECTED_PATHS, Protected.Response()); err != nil {
+		return err
+	}
+
+	// Clients are told the usage up front, changes after that are broadcast
+	if Quota != nil {
+		if usage, err := Quota.Usage(); err == nil {
+			return client.SendResponse(RESPONSE_QUOTA_USAGE, usage)
+		}
+	}
+	return nil
 }
 
 // Get workspace directory from environment or default
@@ -55,17 +76,23 @@ func InitWorkspaceDir() error {
 	if err := os.MkdirAll(workspaceDir, 0755); err != nil {
 		return fmt.Errorf("failed to create workspace directory %s: %w", workspaceDir, err)
 	}
-	log.Printf("Workspace directory initialized: %s", workspaceDir)
+	workspace, err := NewWorkspace(workspaceDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve workspace directory %s: %w", workspaceDir, err)
+	}
+	WorkspaceFS = workspace
+	log.Printf("Workspace directory initialized: %s", WorkspaceFS.Root())
 	return nil
 }
 
-// Safely join path components to prevent directory traversal
-func safeJoinPath(basePath, userPath string) string {
-
-	// Join with base path
-	fullPath := filepath.Join(basePath, userPath)
-
-	return fullPath
+// dirtyRelPath maps a dirty path, code/<language>/<lab>/<path>, back to the
+// workspace relative path
+func dirtyRelPath(dirtyPath string) string {
+	parts := strings.SplitN(dirtyPath, "/", 4)
+	if len(parts) == 4 && parts[0] == "code" {
+		return parts[3]
+	}
+	return dirtyPath
 }
 
 // Load directory contents
@@ -75,12 +102,9 @@ func LoadDirHandler(ctx context.Context, payload json.RawMessage, client *Client
 		return fmt.Errorf("failed to unmarshal load dir payload: %w", err)
 	}
 
-	workspaceDir := getWorkspaceDir()
-	targetPath := safeJoinPath(workspaceDir, req.Path)
-
-	files, err := os.ReadDir(targetPath)
+	files, err := WorkspaceFS.ReadDir(req.Path)
 	if err != nil {
-		return fmt.Errorf("failed to read directory %s: %w", targetPath, err)
+		return err
 	}
 
 	var fileInfos []FileInfo
@@ -93,11 +117,13 @@ func LoadDirHandler(ctx context.Context, payload json.RawMessage, client *Client
 
 		relativePath := filepath.Join(req.Path, file.Name())
 		fileInfos = append(fileInfos, FileInfo{
-			Name:    file.Name(),
-			Path:    relativePath,
-			IsDir:   file.IsDir(),
-			Size:    info.Size(),
-			ModTime: info.ModTime().Format(time.RFC3339),
+			Name:       file.Name(),
+			Path:       relativePath,
+			IsDir:      file.IsDir(),
+			Size:       info.Size(),
+			ModTime:    info.ModTime().Format(time.RFC3339),
+			Ignored:    Ignore.IsIgnored(relativePath, file.IsDir()),
+			Protection: Protected.Level(relativePath),
 		})
 	}
 
@@ -106,7 +132,7 @@ func LoadDirHandler(ctx context.Context, payload json.RawMessage, client *Client
 		Files: fileInfos,
 	}
 
-	return client.SendResponse(RESPONSE_DIR_CONTENT, response)
+	return client.Reply(ctx, RESPONSE_DIR_CONTENT, response)
 }
 
 // Fetch file content
@@ -116,20 +142,36 @@ func FetchFileContentHandler(ctx context.Context, payload json.RawMessage, clien
 		return fmt.Errorf("failed to unmarshal fetch file content payload: %w", err)
 	}
 
-	workspaceDir := getWorkspaceDir()
-	targetPath := safeJoinPath(workspaceDir, req.Path)
+	file, err := WorkspaceFS.Open(req.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-	content, err := os.ReadFile(targetPath)
+	info, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to read file %s: %w", targetPath, err)
+		return wrapFSError(req.Path, "failed to stat file", err)
 	}
+	if info.Size() > INLINE_CONTENT_LIMIT {
+		return newFSError(FS_ERR_TOO_LARGE, req.Path, "file is too large to load inline, use a chunked download")
+	}
+
+	raw, err := io.ReadAll(file)
+	if err != nil {
+		return wrapFSError(req.Path, "failed to read file", err)
+	}
+	content, encoding := encodeContent(raw)
 
 	response := FileContentResponse{
-		Path:    req.Path,
-		Content: string(content),
+		Path:     req.Path,
+		Content:  content,
+		Encoding: encoding,
+		MimeType: detectMimeType(req.Path, raw),
+		Size:     info.Size(),
+		Version:  contentVersion(raw),
 	}
 
-	return client.SendResponse(RESPONSE_FILE_CONTENT, response)
+	return client.Reply(ctx, RESPONSE_FILE_CONTENT, response)
 }
 
 // Update file content
@@ -139,24 +181,37 @@ func FileContentUpdateHandler(ctx context.Context, payload json.RawMessage, clie
 	if err := json.Unmarshal(payload, &req); err != nil {
 		return fmt.Errorf("failed to unmarshal file content update payload: %w", err)
 	}
-	workspaceDir := getWorkspaceDir()
-	targetPath := safeJoinPath(workspaceDir, req.Path)
-	log.Printf("Updating file at path: %s", targetPath)
-	// Ensure parent directory exists
-	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-		return fmt.Errorf("failed to create parent directories for %s: %w", targetPath, err)
+	relPath, err := WorkspaceFS.Clean(req.Path)
+	if err != nil {
+		return err
 	}
+	if err := Protected.CheckWrite(relPath); err != nil {
+		return err
+	}
+	log.Printf("Updating file at path: %s", relPath)
 
-	if err := os.WriteFile(targetPath, []byte(req.Content), 0644); err != nil {
-		return fmt.Errorf("failed to write file %s: %w", targetPath, err)
+	content, err := decodeContent(req.Path, req.Content, req.Encoding)
+	if err != nil {
+		return err
+	}
+	var previous []byte
+	var previousExists bool
+	version, err := WorkspaceFS.UpdateFile(relPath, req.BaseVersion, func(current []byte, exists bool) ([]byte, error) {
+		previous, previousExists = current, exists
+		if err := Quota.Check(relPath, int64(len(content))); err != nil {
+			return nil, err
+		}
+		return content, nil
+	})
+	if err != nil {
+		return err
 	}
+	History.Record(relPath, HISTORY_ACTION_EDIT, previous, previousExists, content, false)
 
-	fileUpdatePath := fmt.Sprintf("code/%s/%s/%s", LANGUAGE, LAB_ID, req.Path)
-	log.Printf("FILE PATH: %s", fileUpdatePath)
-	UpdateLabInstanceDirtyWrites(LAB_ID, fileUpdatePath, "edit")
-	log.Printf("UPDATED THE PATH TO REDIS %s", fileUpdatePath)
-	return client.SendResponse(RESPONSE_FILE_UPDATED, map[string]interface{}{
+	client.Session().MarkDirty(relPath, "edit")
+	return client.Reply(ctx, RESPONSE_FILE_UPDATED, map[string]interface{}{
 		"path":    req.Path,
+		"version": version,
 		"success": true,
 	})
 }
@@ -168,35 +223,44 @@ func NewFileHandler(ctx context.Context, payload json.RawMessage, client *Client
 		return fmt.Errorf("failed to unmarshal new file payload: %w", err)
 	}
 
-	workspaceDir := getWorkspaceDir()
-	targetPath := safeJoinPath(workspaceDir, req.Path)
-
-	// Ensure parent directory exists
-	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-		return fmt.Errorf("failed to create parent directories for %s: %w", targetPath, err)
+	relPath, err := WorkspaceFS.Clean(req.Path)
+	if err != nil {
+		return err
+	}
+	if err := Protected.CheckWrite(relPath); err != nil {
+		return err
 	}
 
 	if req.IsDir {
-		if err := os.MkdirAll(targetPath, 0755); err != nil {
-			return fmt.Errorf("failed to create directory %s: %w", targetPath, err)
+		if err := WorkspaceFS.MkdirAll(relPath); err != nil {
+			return err
 		}
 
 	} else {
-		content := req.Content
-		if content == "" {
-			content = "" // Empty file
+		content, err := decodeContent(req.Path, req.Content, req.Encoding)
+		if err != nil {
+			return err
 		}
-		if err := os.WriteFile(targetPath, []byte(content), 0644); err != nil {
-			return fmt.Errorf("failed to create file %s: %w", targetPath, err)
+		// Creating never replaces a file another editor may have open
+		_, err = WorkspaceFS.UpdateFile(relPath, "", func(current []byte, exists bool) ([]byte, error) {
+			if exists {
+				return nil, newFSError(FS_ERR_ALREADY_EXISTS, req.Path, "file already exists")
+			}
+			if err := Quota.Check(relPath, int64(len(content))); err != nil {
+				return nil, err
+			}
+			return content, nil
+		})
+		if err != nil {
+			return err
 		}
-
+		History.Record(relPath, HISTORY_ACTION_EDIT, nil, false, content, false)
 	}
 	if !req.IsDir { // Only sync files
-		fileUpdatePath := fmt.Sprintf("code/%s/%s/%s", LANGUAGE, LAB_ID, req.Path)
-		UpdateLabInstanceDirtyWrites(LAB_ID, fileUpdatePath, "edit")
+		client.Session().MarkDirty(relPath, "edit")
 	}
 
-	return client.SendResponse(RESPONSE_FILE_CREATED, map[string]interface{}{
+	return client.Reply(ctx, RESPONSE_FILE_CREATED, map[string]interface{}{
 		"path":    req.Path,
 		"isDir":   req.IsDir,
 		"success": true,
@@ -210,22 +274,23 @@ func DeleteFileHandler(ctx context.Context, payload json.RawMessage, client *Cli
 		return fmt.Errorf("failed to unmarshal delete file payload: %w", err)
 	}
 
-	workspaceDir := getWorkspaceDir()
-	targetPath := safeJoinPath(workspaceDir, req.Path)
-
-	// Check if file/directory exists
-	_, err := os.Stat(targetPath)
+	relPath, err := WorkspaceFS.Clean(req.Path)
 	if err != nil {
-		return fmt.Errorf("failed to stat %s: %w", targetPath, err)
+		return err
+	}
+	if err := Protected.CheckDelete(relPath); err != nil {
+		return err
 	}
 
-	if err := os.RemoveAll(targetPath); err != nil {
-		return fmt.Errorf("failed to delete %s: %w", targetPath, err)
+	// Read what is about to go first, it only becomes history once the delete succeeded
+	deleted := History.SnapshotDelete(relPath)
+	if err := WorkspaceFS.RemoveAll(relPath); err != nil {
+		return err
 	}
+	History.RecordDelete(deleted)
 
-	fileUpdatePath := fmt.Sprintf("code/%s/%s/%s", LANGUAGE, LAB_ID, req.Path)
-	UpdateLabInstanceDirtyWrites(LAB_ID, fileUpdatePath, "delete")
-	return client.SendResponse(RESPONSE_FILE_DELETED, map[string]interface{}{
+	client.Session().MarkDirty(relPath, "delete")
+	return client.Reply(ctx, RESPONSE_FILE_DELETED, map[string]interface{}{
 		"path":    req.Path,
 		"success": true,
 	})
@@ -238,81 +303,128 @@ func EditFileMetaHandler(ctx context.Context, payload json.RawMessage, client *C
 		return fmt.Errorf("failed to unmarshal edit file meta payload: %w", err)
 	}
 
-	workspaceDir := getWorkspaceDir()
-	oldPath := safeJoinPath(workspaceDir, req.OldPath)
-	newPath := safeJoinPath(workspaceDir, req.NewPath)
-
-	// Ensure parent directory exists for new path
-	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
-		return fmt.Errorf("failed to create parent directories for %s: %w", newPath, err)
+	oldRelPath, err := WorkspaceFS.Clean(req.OldPath)
+	if err != nil {
+		return err
+	}
+	newRelPath, err := WorkspaceFS.Clean(req.NewPath)
+	if err != nil {
+		return err
+	}
+	if err := Protected.CheckRename(oldRelPath, newRelPath); err != nil {
+		return err
 	}
 
-	if err := os.Rename(oldPath, newPath); err != nil {
-		return fmt.Errorf("failed to rename %s to %s: %w", oldPath, newPath, err)
+	if err := WorkspaceFS.Rename(oldRelPath, newRelPath); err != nil {
+		return err
 	}
-	oldS3Path := fmt.Sprintf("code/%s/%s/%s", LANGUAGE, LAB_ID, req.OldPath)
-	newS3Path := fmt.Sprintf("code/%s/%s/%s", LANGUAGE, LAB_ID, req.NewPath)
-	UpdateLabInstanceDirtyRename(LAB_ID, oldS3Path, newS3Path)
+	client.Session().MarkRenamed(oldRelPath, newRelPath)
 
-	return client.SendResponse(RESPONSE_FILE_RENAMED, map[string]interface{}{
+	return client.Reply(ctx, RESPONSE_FILE_RENAMED, map[string]interface{}{
 		"oldPath": req.OldPath,
 		"newPath": req.NewPath,
 		"success": true,
 	})
 }
 
-// Fetch quest metadata (root directory structure)
+// Fetch the workspace tree below a path, a page at a time and optionally depth limited
 func FetchQuestMetaHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
 	var req FetchQuestMetaPayload
 	if err := json.Unmarshal(payload, &req); err != nil {
 		return fmt.Errorf("failed to unmarshal fetch quest meta payload: %w", err)
 	}
 
-	workspaceDir := getWorkspaceDir()
-	targetPath := safeJoinPath(workspaceDir, req.Path)
-
-	var fileInfos []FileInfo
-	err := filepath.WalkDir(targetPath, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
+	root, err := WorkspaceFS.Clean(req.Path)
+	if err != nil {
+		return err
+	}
+	snapshot, err := Trees.Current()
+	if err != nil {
+		return fmt.Errorf("failed to hash the workspace tree: %w", err)
+	}
+	// Pages come out of the cached snapshot, only paths it does not descend
+	// into (ignored directories, single files) are walked on every request
+	listing, ok := snapshot.listing(filepath.ToSlash(root), req.MaxDepth)
+	if !ok {
+		if listing, err = walkTree(req.Path, req.MaxDepth); err != nil {
 			return err
 		}
+	}
 
-		// Get relative path from workspace
-		relPath, err := filepath.Rel(workspaceDir, path)
+	offset := 0
+	if req.Cursor != "" {
+		hash, cursorOffset, err := decodeTreeCursor(req.Cursor)
 		if err != nil {
-			return err
+			return newFSError(FS_ERR_STALE_CURSOR, req.Path, "invalid tree cursor")
+		}
+		if hash != listing.hash || cursorOffset > len(listing.entries) {
+			return newFSError(FS_ERR_STALE_CURSOR, req.Path, "the tree changed since the first page, start over")
 		}
+		offset = cursorOffset
+	}
 
-		// Convert to forward slashes for consistency
-		relPath = filepath.ToSlash(relPath)
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = TREE_DEFAULT_PAGE_SIZE
+	}
+	if pageSize > TREE_MAX_PAGE_SIZE {
+		pageSize = TREE_MAX_PAGE_SIZE
+	}
+	end := min(offset+pageSize, len(listing.entries))
 
-		info, err := d.Info()
-		if err != nil {
-			log.Printf("Error getting file info for %s: %v", path, err)
-			return nil
-		}
+	response := QuestMetaResponse{
+		Path:     req.Path,
+		Files:    listing.entries[offset:end],
+		Total:    len(listing.entries),
+		TreeHash: listing.hash,
+		MaxDepth: req.MaxDepth,
+	}
+	if end < len(listing.entries) {
+		response.NextCursor = encodeTreeCursor(listing.hash, end)
+	}
+	if req.Cursor == "" {
+		response.RootHash = snapshot.root
+	}
 
-		fileInfos = append(fileInfos, FileInfo{
-			Name:    d.Name(),
-			Path:    relPath,
-			IsDir:   d.IsDir(),
-			Size:    info.Size(),
-			ModTime: info.ModTime().Format(time.RFC3339),
-		})
+	return client.Reply(ctx, RESPONSE_QUEST_META, response)
+}
 
-		return nil
-	})
+// Catch a reconnecting client up with the directories that changed since the
+// root hash it last saw, instead of listing the whole tree again
+func TreeSyncHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req TreeSyncPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal tree sync payload: %w", err)
+	}
 
+	current, err := Trees.Current()
 	if err != nil {
-		return fmt.Errorf("failed to walk directory %s: %w", targetPath, err)
+		return fmt.Errorf("failed to hash the workspace tree: %w", err)
+	}
+	response := TreeSyncResponse{RootHash: current.root}
+	if req.RootHash == current.root {
+		return client.Reply(ctx, RESPONSE_TREE_SYNC, response)
 	}
 
-	response := QuestMetaResponse{
-		Path:  req.Path,
-		Files: fileInfos,
+	previous := Trees.Lookup(req.RootHash)
+	if previous == nil {
+		response.Resync = true
+		return client.Reply(ctx, RESPONSE_TREE_SYNC, response)
 	}
 
-	return client.SendResponse(RESPONSE_QUEST_META, response)
+	changed, removed := diffTrees(previous, current)
+	entries := 0
+	for _, dir := range changed {
+		entries += len(dir.Files)
+	}
+	// Past a page worth of entries the diff is no cheaper than a fresh listing
+	if entries > TREE_MAX_PAGE_SIZE {
+		response.Resync = true
+		return client.Reply(ctx, RESPONSE_TREE_SYNC, response)
+	}
+	response.Changed = changed
+	response.Removed = removed
+	return client.Reply(ctx, RESPONSE_TREE_SYNC, response)
 }
 
 // Helper function to send response to client (deprecated - use client methods instead)
@@ -320,85 +432,27 @@ func sendResponse(client *Client, responseType string, data interface{}) error {
 	return client.SendResponse(responseType, data)
 }
 
+// Flush the dirty files to the bucket now, called by the server when a lab ends
 func SyncFilesToS3Handler(ctx context.Context, payload json.RawMessage, client *Client) error {
-	labInstance, err := GetLabInstance(os.Getenv("LAB_ID"))
+	if Storage == nil {
+		return fmt.Errorf("storage is not available")
+	}
+	status, err := syncDirtyFiles(ctx, Storage, client.Session().LabID)
 	if err != nil {
 		return err
 	}
-	bucketName := os.Getenv("AWS_S3_BUCKET_NAME")
-	s3CodeLink := os.Getenv("LAB_CODE_LINK")
-	dirtyFiles := labInstance.DirtyReadPaths // Now a slice of structs
-
-	g, ctx := errgroup.WithContext(ctx)
-	g.SetLimit(10)
-
-	// Calculate prefix to strip: code/<lang>/<labid>/
-	prefix := fmt.Sprintf("code/%s/%s/", LANGUAGE, os.Getenv("LAB_ID"))
-
-	for _, entry := range dirtyFiles {
-
-		currentEntry := entry // Capture for closure
-		currentPath := strings.TrimPrefix(currentEntry.Path, prefix)
-		log.Printf("DEBUG: TRIMMED PREFIX AND THE PATH %s", currentPath)
-		currentPath = strings.Join([]string{s3CodeLink, currentPath}, "/")
-		log.Printf("DEBUG: FINAL PATH AFTER JOINING BUCKET NAME AND S3 LINK %s", currentPath)
-		g.Go(func() error {
-			// Case 1: DELETE
-			if currentEntry.Action == "delete" {
-				_, err := client.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
-					Bucket: aws.String(bucketName),
-					Key:    aws.String(currentPath),
-				})
-				if err != nil {
-					log.Printf("Failed to delete %s: %v", currentPath, err)
-					// Don't return error to keep other syncs going
-				} else {
-					log.Printf("Synced (Deleted): %s", currentPath)
-				}
-				return nil
-			}
+	return client.Reply(ctx, RESPONSE_SYNC_STATUS, status)
+}
 
-			// Case 2: EDIT (Upload)
-			if currentEntry.Action == "edit" {
-				// 1. Determine Local Path by stripping prefix
-				localPath := strings.TrimPrefix(currentEntry.Path, prefix)
-				log.Printf("DEBUG: LOCAL PATH %s", localPath)
-				// 2. Open File
-				file, err := GetFileByPath(ctx, localPath)
-				if err != nil {
-					log.Printf("Skipping %s: Local file not found", localPath)
-					return nil // Skip if local file	 is missing (might have been deleted quickly after)
-				}
-				defer file.Close()
-
-				// 3. Upload (PutObject)
-				// Note: Simplified for brevity (removed MD5 check for clarity, add back if needed)
-				_, err = client.s3Client.PutObject(ctx, &s3.PutObjectInput{
-					Bucket: aws.String(bucketName),
-					Key:    aws.String(currentPath),
-					Body:   file,
-				})
-				if err != nil {
-					return err
-				}
-				log.Printf("Synced (Uploaded): %s", currentPath)
-			}
-			return nil
-		})
+// Report the state of the background sync
+func SyncStatusHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	if Syncer == nil {
+		return fmt.Errorf("background sync is not running")
 	}
-
-	return g.Wait()
+	return client.Reply(ctx, RESPONSE_SYNC_STATUS, Syncer.Status())
 }
 
 func GetFileByPath(ctx context.Context, path string) (*os.File, error) {
-	// Sanitize path to prevent directory traversal attacks if path comes from user input
-	baseDir := getWorkspaceDir()
-	fullPath := filepath.Join(baseDir, path)
-	log.Printf("DEBUG: Path with workspace joined %s \n", fullPath)
-	f, err := os.Open(fullPath)
-	if err != nil {
-		return nil, err
-	}
-
-	return f, nil
+	// Paths come from Redis, so they go through the workspace jail like any user input
+	return WorkspaceFS.Open(path)
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestNewFileDoesNotOverwrite(t *testing.T) {
+	newTestWorkspace(t, map[string]string{"app.js": "someone else's work"})
+	newTestHistory(t)
+	client := NewClient(nil, NewFSManager(context.Background()), nil)
+	client.SetSession(&Session{LabID: "lab-1", Language: "node"})
+
+	newFile := func(path, content string) error {
+		payload, _ := json.Marshal(NewFilePayload{Path: path, Content: content})
+		return NewFileHandler(context.Background(), payload, client)
+	}
+
+	if err := newFile("app.js", ""); !isFSErrorCode(err, FS_ERR_ALREADY_EXISTS) {
+		t.Fatalf("expected %s; got %v", FS_ERR_ALREADY_EXISTS, err)
+	}
+	if content, _ := WorkspaceFS.ReadFile("app.js"); string(content) != "someone else's work" {
+		t.Fatalf("expected the existing file to be kept; got %q", content)
+	}
+
+	if err := newFile("src/new.js", "new"); err != nil {
+		t.Fatalf("expected the file to be created; got %v", err)
+	}
+	if content, _ := WorkspaceFS.ReadFile("src/new.js"); string(content) != "new" {
+		t.Errorf("expected the new content; got %q", content)
+	}
+	if revisions, _ := History.List("src/new.js"); len(revisions) != 1 {
+		t.Errorf("expected the creation in the history; got %+v", revisions)
+	}
+}
@@ -0,0 +1,649 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	GIT_TIMEOUT       = 30 * time.Second
+	GIT_DIFF_LIMIT    = 1024 * 1024 // 1 MB of diff text per response
+	GIT_LOG_DEFAULT   = 50
+	GIT_LOG_MAX       = 500
+	GIT_DEFAULT_NAME  = "DevsArena Learner"
+	GIT_DEFAULT_EMAIL = "learner@devsarena.in"
+)
+
+// Error codes for failed git commands
+const (
+	GIT_ERR_NOT_A_REPOSITORY  = "not_a_repository"
+	GIT_ERR_NOTHING_TO_COMMIT = "nothing_to_commit"
+	GIT_ERR_INVALID_ARGUMENT  = "invalid_argument"
+	GIT_ERR_FAILED            = "git_failed"
+)
+
+// GitError is a failed git command, Stderr is what git printed
+type GitError struct {
+	Code     string
+	Message  string
+	Command  string
+	ExitCode int
+	Stderr   string
+}
+
+func (e *GitError) Error() string {
+	if e.Stderr != "" {
+		return fmt.Sprintf("%s: %s", e.Message, e.Stderr)
+	}
+	return e.Message
+}
+
+func newGitArgError(message string) *GitError {
+	return &GitError{Code: GIT_ERR_INVALID_ARGUMENT, Message: message}
+}
+
+// runGit runs git inside the workspace and returns stdout
+func runGit(ctx context.Context, env []string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, GIT_TIMEOUT)
+	defer cancel()
+
+	// The workspace volume is owned by another uid than the runner, without
+	// safe.directory git refuses to touch it
+	fullArgs := append([]string{"-c", "safe.directory=*", "-c", "core.quotepath=off"}, args...)
+	cmd := exec.CommandContext(ctx, "git", fullArgs...)
+	cmd.Dir = WorkspaceFS.Root()
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_OPTIONAL_LOCKS=0", "LC_ALL=C")
+	cmd.Env = append(cmd.Env, env...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err == nil {
+		return stdout.Bytes(), nil
+	}
+
+	gitErr := &GitError{
+		Code:     GIT_ERR_FAILED,
+		Message:  "git " + args[0] + " failed",
+		Command:  "git " + strings.Join(args, " "),
+		ExitCode: -1,
+		Stderr:   strings.TrimSpace(stderr.String()),
+	}
+	if gitErr.Stderr == "" {
+		// Some commands, like commit with nothing staged, explain themselves on stdout
+		gitErr.Stderr = strings.TrimSpace(stdout.String())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		gitErr.ExitCode = exitErr.ExitCode()
+	} else if ctx.Err() != nil {
+		gitErr.Message = "git " + args[0] + " timed out"
+	} else {
+		gitErr.Stderr = err.Error()
+	}
+	if strings.Contains(gitErr.Stderr, "not a git repository") {
+		gitErr.Code = GIT_ERR_NOT_A_REPOSITORY
+		gitErr.Message = "the workspace is not a git repository"
+	}
+	return stdout.Bytes(), gitErr
+}
+
+func isGitErrorCode(err error, code string) bool {
+	var gitErr *GitError
+	return errors.As(err, &gitErr) && gitErr.Code == code
+}
+
+// cleanGitPaths runs user supplied paths through the workspace jail
+func cleanGitPaths(paths []string) ([]string, error) {
+	cleaned := make([]string, 0, len(paths))
+	for _, p := range paths {
+		relPath, err := WorkspaceFS.Clean(p)
+		if err != nil {
+			return nil, err
+		}
+		if relPath == "" {
+			relPath = "."
+		}
+		cleaned = append(cleaned, relPath)
+	}
+	return cleaned, nil
+}
+
+// validateGitRef keeps refs from being read as options
+func validateGitRef(ref string) error {
+	if ref == "" || strings.HasPrefix(ref, "-") || strings.ContainsAny(ref, " \t\n\x00") {
+		return newGitArgError(fmt.Sprintf("invalid ref %q", ref))
+	}
+	return nil
+}
+
+func gitHeadExists(ctx context.Context) bool {
+	_, err := runGit(ctx, nil, "rev-parse", "--verify", "--quiet", "HEAD")
+	return err == nil
+}
+
+// parseGitStatus reads `git status --porcelain=v2 --branch -z`
+func parseGitStatus(out []byte) GitStatusResponse {
+	status := GitStatusResponse{Initialized: true, Files: []GitFileStatus{}}
+
+	entries := strings.Split(string(out), "\x00")
+	for i := 0; i < len(entries); i++ {
+		entry := entries[i]
+		if entry == "" {
+			continue
+		}
+
+		switch entry[0] {
+		case '#':
+			fields := strings.Fields(entry)
+			if len(fields) < 3 {
+				continue
+			}
+			switch fields[1] {
+			case "branch.oid":
+				if fields[2] != "(initial)" {
+					status.Head = fields[2]
+				}
+			case "branch.head":
+				if fields[2] == "(detached)" {
+					status.Detached = true
+				} else {
+					status.Branch = fields[2]
+				}
+			case "branch.upstream":
+				status.Upstream = fields[2]
+			case "branch.ab":
+				if len(fields) == 4 {
+					status.Ahead, _ = strconv.Atoi(strings.TrimPrefix(fields[2], "+"))
+					status.Behind, _ = strconv.Atoi(strings.TrimPrefix(fields[3], "-"))
+				}
+			}
+
+		case '1', '2', 'u':
+			// 1 XY sub mH mI mW hH hI path
+			// 2 XY sub mH mI mW hH hI Xscore path, followed by the original path
+			// u XY sub m1 m2 m3 mW h1 h2 h3 path
+			fieldCount := map[byte]int{'1': 9, '2': 10, 'u': 11}[entry[0]]
+			fields := strings.SplitN(entry, " ", fieldCount)
+			if len(fields) < fieldCount {
+				continue
+			}
+			file := GitFileStatus{
+				Path:       fields[fieldCount-1],
+				Index:      string(fields[1][0]),
+				Worktree:   string(fields[1][1]),
+				Conflicted: entry[0] == 'u',
+			}
+			if entry[0] == '2' && i+1 < len(entries) {
+				i++
+				file.OrigPath = entries[i]
+			}
+			file.Staged = !file.Conflicted && file.Index != "."
+			status.Files = append(status.Files, file)
+
+		case '?':
+			status.Files = append(status.Files, GitFileStatus{
+				Path:      entry[2:],
+				Index:     "?",
+				Worktree:  "?",
+				Untracked: true,
+			})
+		}
+	}
+	return status
+}
+
+// parseHunkRanges reads both ranges of "@@ -a,b +c,d @@ section"
+func parseHunkRanges(header string) (GitDiffHunk, error) {
+	hunk := GitDiffHunk{Header: header, Lines: []GitDiffLine{}}
+	fields := strings.Fields(header)
+	if len(fields) < 3 || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return hunk, fmt.Errorf("malformed hunk header %q", header)
+	}
+
+	parseRange := func(r string) (int, int, error) {
+		start, count, hasCount := strings.Cut(r[1:], ",")
+		s, err := strconv.Atoi(start)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !hasCount {
+			return s, 1, nil
+		}
+		c, err := strconv.Atoi(count)
+		return s, c, err
+	}
+
+	var err error
+	if hunk.OldStart, hunk.OldLines, err = parseRange(fields[1]); err != nil {
+		return hunk, fmt.Errorf("malformed hunk header %q", header)
+	}
+	if hunk.NewStart, hunk.NewLines, err = parseRange(fields[2]); err != nil {
+		return hunk, fmt.Errorf("malformed hunk header %q", header)
+	}
+	return hunk, nil
+}
+
+// parseGitDiff turns `git diff` output into files, hunks and numbered lines
+func parseGitDiff(out string) ([]GitFileDiff, error) {
+	files := []GitFileDiff{}
+	var file *GitFileDiff
+	var hunk *GitDiffHunk
+	oldLine, newLine := 0, 0
+
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			files = append(files, GitFileDiff{Status: "modified", Hunks: []GitDiffHunk{}})
+			file = &files[len(files)-1]
+			hunk = nil
+			// "diff --git a/x b/x", exact paths follow in the ---/+++ or rename lines
+			if a, b, ok := strings.Cut(strings.TrimPrefix(line, "diff --git "), " b/"); ok {
+				file.OldPath = strings.TrimPrefix(a, "a/")
+				file.Path = b
+			}
+		case file == nil:
+			continue
+		case hunk == nil && strings.HasPrefix(line, "new file mode"):
+			file.Status = "added"
+		case hunk == nil && strings.HasPrefix(line, "deleted file mode"):
+			file.Status = "deleted"
+		case hunk == nil && strings.HasPrefix(line, "rename from "):
+			file.Status = "renamed"
+			file.OldPath = strings.TrimPrefix(line, "rename from ")
+		case hunk == nil && strings.HasPrefix(line, "rename to "):
+			file.Path = strings.TrimPrefix(line, "rename to ")
+		case hunk == nil && strings.HasPrefix(line, "Binary files "):
+			file.Binary = true
+		case hunk == nil && strings.HasPrefix(line, "--- "):
+			if p := strings.TrimPrefix(line, "--- "); p != "/dev/null" {
+				file.OldPath = strings.TrimPrefix(p, "a/")
+			}
+		case hunk == nil && strings.HasPrefix(line, "+++ "):
+			if p := strings.TrimPrefix(line, "+++ "); p != "/dev/null" {
+				file.Path = strings.TrimPrefix(p, "b/")
+			}
+		case strings.HasPrefix(line, "@@"):
+			parsed, err := parseHunkRanges(line)
+			if err != nil {
+				return nil, err
+			}
+			file.Hunks = append(file.Hunks, parsed)
+			hunk = &file.Hunks[len(file.Hunks)-1]
+			oldLine, newLine = hunk.OldStart, hunk.NewStart
+		case hunk == nil:
+			// index, mode and similarity lines
+		case strings.HasPrefix(line, "+"):
+			hunk.Lines = append(hunk.Lines, GitDiffLine{Type: "add", Content: line[1:], NewLine: newLine})
+			file.Additions++
+			newLine++
+		case strings.HasPrefix(line, "-"):
+			hunk.Lines = append(hunk.Lines, GitDiffLine{Type: "delete", Content: line[1:], OldLine: oldLine})
+			file.Deletions++
+			oldLine++
+		case strings.HasPrefix(line, "\\"):
+			// "\ No newline at end of file"
+			if n := len(hunk.Lines); n > 0 {
+				hunk.Lines[n-1].NoNewline = true
+			}
+		default:
+			content := strings.TrimPrefix(line, " ")
+			hunk.Lines = append(hunk.Lines, GitDiffLine{Type: "context", Content: content, OldLine: oldLine, NewLine: newLine})
+			oldLine++
+			newLine++
+		}
+	}
+	return files, nil
+}
+
+// gitChangedFiles lists the files that differ between two trees as dirty path actions
+func gitChangedFiles(ctx context.Context, args ...string) map[string]string {
+	out, err := runGit(ctx, nil, append([]string{"diff", "--name-status", "--no-renames", "-z"}, args...)...)
+	if err != nil {
+		log.Printf("Failed to list files changed by git: %v", err)
+		return nil
+	}
+
+	changed := make(map[string]string)
+	fields := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		action := "edit"
+		if fields[i] == "D" {
+			action = "delete"
+		}
+		changed[fields[i+1]] = action
+	}
+	return changed
+}
+
+func gitStatus(ctx context.Context) (GitStatusResponse, error) {
+	out, err := runGit(ctx, nil, "status", "--porcelain=v2", "--branch", "-z")
+	if isGitErrorCode(err, GIT_ERR_NOT_A_REPOSITORY) {
+		return GitStatusResponse{Initialized: false, Files: []GitFileStatus{}}, nil
+	}
+	if err != nil {
+		return GitStatusResponse{}, err
+	}
+	return parseGitStatus(out), nil
+}
+
+// Report the branch and the state of every changed file
+func GitStatusHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	status, err := gitStatus(ctx)
+	if err != nil {
+		return err
+	}
+	return client.Reply(ctx, RESPONSE_GIT_STATUS, status)
+}
+
+// Diff the working tree against the index, or the index against HEAD when staged is set
+func GitDiffHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req GitDiffPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal git diff payload: %w", err)
+	}
+
+	args := []string{"diff", "--no-color", "--no-ext-diff", "-M"}
+	if req.Staged {
+		args = append(args, "--cached")
+	}
+	if req.Commit != "" {
+		if err := validateGitRef(req.Commit); err != nil {
+			return err
+		}
+		args = append(args, req.Commit)
+	}
+	if req.Path != "" {
+		paths, err := cleanGitPaths([]string{req.Path})
+		if err != nil {
+			return err
+		}
+		args = append(args, "--")
+		args = append(args, paths...)
+	}
+
+	out, err := runGit(ctx, nil, args...)
+	if err != nil {
+		return err
+	}
+
+	response := GitDiffResponse{Staged: req.Staged, Commit: req.Commit}
+	text := string(out)
+	if len(text) > GIT_DIFF_LIMIT {
+		// Cut at a line boundary so the last hunk still parses
+		text = text[:strings.LastIndex(text[:GIT_DIFF_LIMIT], "\n")+1]
+		response.Truncated = true
+	}
+	if response.Files, err = parseGitDiff(text); err != nil {
+		return fmt.Errorf("failed to parse git diff: %w", err)
+	}
+	return client.Reply(ctx, RESPONSE_GIT_DIFF, response)
+}
+
+// List commits, newest first
+func GitLogHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req GitLogPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal git log payload: %w", err)
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = GIT_LOG_DEFAULT
+	}
+	if limit > GIT_LOG_MAX {
+		limit = GIT_LOG_MAX
+	}
+
+	response := GitLogResponse{Commits: []GitCommit{}}
+	if !gitHeadExists(ctx) {
+		// Fresh repository, nothing committed yet
+		return client.Reply(ctx, RESPONSE_GIT_LOG, response)
+	}
+
+	args := []string{"log", "--format=%H%x00%h%x00%P%x00%an%x00%ae%x00%aI%x00%s%x1e",
+		"-n", strconv.Itoa(limit + 1), "--skip", strconv.Itoa(max(req.Skip, 0))}
+	if req.Ref != "" {
+		if err := validateGitRef(req.Ref); err != nil {
+			return err
+		}
+		args = append(args, req.Ref)
+	}
+	if req.Path != "" {
+		paths, err := cleanGitPaths([]string{req.Path})
+		if err != nil {
+			return err
+		}
+		args = append(args, "--")
+		args = append(args, paths...)
+	}
+
+	out, err := runGit(ctx, nil, args...)
+	if err != nil {
+		return err
+	}
+	for _, record := range strings.Split(string(out), "\x1e") {
+		fields := strings.Split(strings.TrimPrefix(record, "\n"), "\x00")
+		if len(fields) != 7 {
+			continue
+		}
+		response.Commits = append(response.Commits, GitCommit{
+			Hash:        fields[0],
+			ShortHash:   fields[1],
+			Parents:     strings.Fields(fields[2]),
+			AuthorName:  fields[3],
+			AuthorEmail: fields[4],
+			Date:        fields[5],
+			Subject:     fields[6],
+		})
+	}
+	if len(response.Commits) > limit {
+		response.Commits = response.Commits[:limit]
+		response.HasMore = true
+	}
+	return client.Reply(ctx, RESPONSE_GIT_LOG, response)
+}
+
+// Stage or unstage paths, everything when no paths are given
+func GitStageHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req GitStagePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal git stage payload: %w", err)
+	}
+
+	paths, err := cleanGitPaths(req.Paths)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	var args []string
+	switch {
+	case !req.Unstage:
+		args = []string{"add", "-A"}
+	case gitHeadExists(ctx):
+		args = []string{"reset", "-q", "HEAD"}
+	default:
+		// Nothing is committed yet, unstaging means dropping paths from the index
+		args = []string{"rm", "--cached", "-r", "-q", "--ignore-unmatch"}
+	}
+	args = append(args, "--")
+	args = append(args, paths...)
+	if _, err := runGit(ctx, nil, args...); err != nil {
+		return err
+	}
+
+	status, err := gitStatus(ctx)
+	if err != nil {
+		return err
+	}
+	return client.Reply(ctx, RESPONSE_GIT_STAGED, status)
+}
+
+// gitIdentityEnv falls back to a default author when the repository has none configured
+func gitIdentityEnv(ctx context.Context, name, email string) []string {
+	if name == "" {
+		if out, err := runGit(ctx, nil, "config", "user.name"); err == nil {
+			name = strings.TrimSpace(string(out))
+		}
+	}
+	if email == "" {
+		if out, err := runGit(ctx, nil, "config", "user.email"); err == nil {
+			email = strings.TrimSpace(string(out))
+		}
+	}
+	if name == "" {
+		name = GIT_DEFAULT_NAME
+	}
+	if email == "" {
+		email = GIT_DEFAULT_EMAIL
+	}
+	return []string{
+		"GIT_AUTHOR_NAME=" + name, "GIT_AUTHOR_EMAIL=" + email,
+		"GIT_COMMITTER_NAME=" + name, "GIT_COMMITTER_EMAIL=" + email,
+	}
+}
+
+// Commit what is staged
+func GitCommitHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req GitCommitPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal git commit payload: %w", err)
+	}
+	if strings.TrimSpace(req.Message) == "" {
+		return newGitArgError("commit message is empty")
+	}
+
+	args := []string{"commit", "-q", "-m", req.Message}
+	if req.Amend {
+		args = append(args, "--amend")
+	}
+
+	if _, err := runGit(ctx, gitIdentityEnv(ctx, req.AuthorName, req.AuthorEmail), args...); err != nil {
+		var gitErr *GitError
+		if errors.As(err, &gitErr) && strings.Contains(gitErr.Stderr, "nothing") && strings.Contains(gitErr.Stderr, "to commit") {
+			gitErr.Code = GIT_ERR_NOTHING_TO_COMMIT
+			gitErr.Message = "nothing is staged to commit"
+		}
+		return err
+	}
+
+	out, err := runGit(ctx, nil, "log", "-1", "--format=%H%x00%h%x00%s")
+	if err != nil {
+		return err
+	}
+	fields := strings.SplitN(strings.TrimSpace(string(out)), "\x00", 3)
+	if len(fields) != 3 {
+		return fmt.Errorf("unexpected git log output %q", out)
+	}
+	log.Printf("Committed %s: %s", fields[1], fields[2])
+
+	return client.Reply(ctx, RESPONSE_GIT_COMMITTED, map[string]interface{}{
+		"hash":      fields[0],
+		"shortHash": fields[1],
+		"subject":   fields[2],
+		"success":   true,
+	})
+}
+
+// Switch branches (optionally creating one) or restore paths from a ref
+func GitCheckoutHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req GitCheckoutPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal git checkout payload: %w", err)
+	}
+
+	paths, err := cleanGitPaths(req.Paths)
+	if err != nil {
+		return err
+	}
+	if req.Ref != "" {
+		if err := validateGitRef(req.Ref); err != nil {
+			return err
+		}
+	}
+
+	var changed map[string]string
+	if len(paths) > 0 {
+		// Restoring files, everything that differs from the source is overwritten
+		if req.Create {
+			return newGitArgError("create cannot be combined with paths")
+		}
+		diffArgs := []string{}
+		if req.Ref != "" {
+			diffArgs = append(diffArgs, req.Ref)
+		}
+		changed = gitChangedFiles(ctx, append(append(diffArgs, "--"), paths...)...)
+		for p := range changed {
+			if err := Protected.CheckWrite(p); err != nil {
+				return err
+			}
+		}
+
+		args := []string{"checkout", "-q"}
+		if req.Ref != "" {
+			args = append(args, req.Ref)
+		}
+		args = append(args, "--")
+		args = append(args, paths...)
+		if _, err := runGit(ctx, nil, args...); err != nil {
+			return err
+		}
+		for p, action := range changed {
+			if action == "delete" {
+				// Deleted in the working tree, restored by the checkout
+				changed[p] = "edit"
+			}
+		}
+	} else {
+		if req.Ref == "" {
+			return newGitArgError("a ref is required to switch branches")
+		}
+		before, _ := runGit(ctx, nil, "rev-parse", "--verify", "--quiet", "HEAD")
+		// Switching branches must not touch what the quest protects
+		if !req.Create && Protected.active() {
+			for p, action := range gitChangedFiles(ctx, "HEAD", req.Ref) {
+				if err := Protected.Check(p, action); err != nil {
+					return err
+				}
+			}
+		}
+
+		args := []string{"checkout", "-q"}
+		if req.Create {
+			args = append(args, "-b")
+		}
+		args = append(args, req.Ref)
+		if _, err := runGit(ctx, nil, args...); err != nil {
+			return err
+		}
+
+		if head := strings.TrimSpace(string(before)); head != "" {
+			changed = gitChangedFiles(ctx, head, "HEAD")
+		}
+	}
+
+	// Files git rewrote have to reach the bucket like any other write
+	for p, action := range changed {
+		client.Session().MarkDirty(p, action)
+	}
+
+	status, err := gitStatus(ctx)
+	if err != nil {
+		return err
+	}
+	return client.Reply(ctx, RESPONSE_GIT_CHECKED_OUT, status)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Glob is a compiled path pattern. It supports *, ?, [...] and ** for any
+// number of directories. Patterns without a slash match the base name at
+// any depth, like .gitignore patterns do.
+type Glob struct {
+	pattern  string
+	re       *regexp.Regexp
+	baseOnly bool
+}
+
+func CompileGlob(pattern string) (*Glob, error) {
+	pattern = strings.TrimPrefix(pattern, "./")
+	baseOnly := !strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					// "**/" matches zero or more directories
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := globClassEnd(pattern[i:])
+			if end == -1 {
+				b.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			b.WriteString(globClass(pattern[i+1 : i+end]))
+			i += end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %w", pattern, err)
+	}
+	return &Glob{pattern: pattern, re: re, baseOnly: baseOnly}, nil
+}
+
+// globClassEnd finds the ] closing the class at the start of pattern,
+// skipping escaped ones
+func globClassEnd(pattern string) int {
+	for i := 1; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case ']':
+			return i
+		}
+	}
+	return -1
+}
+
+// globClass turns the body of a [...] class into a regexp class. The body
+// is taken literally apart from ranges and backslash escapes, and like * and
+// ? a class never matches a slash.
+func globClass(class string) string {
+	negated := strings.HasPrefix(class, "!") || strings.HasPrefix(class, "^")
+	if negated {
+		class = class[1:]
+	}
+
+	runes := []rune(class)
+	// next reads one character of the body, a backslash escapes the next one
+	next := func(i int) (rune, int) {
+		if runes[i] == '\\' && i+1 < len(runes) {
+			return runes[i+1], i + 2
+		}
+		return runes[i], i + 1
+	}
+
+	var b strings.Builder
+	if negated {
+		b.WriteString("[^/")
+	} else {
+		b.WriteString("[")
+	}
+	items := 0
+	for i := 0; i < len(runes); {
+		lo, j := next(i)
+		hi := lo
+		if j+1 < len(runes) && runes[j] == '-' {
+			hi, j = next(j + 1)
+		}
+		i = j
+
+		if !negated && lo <= '/' && '/' <= hi && lo <= hi {
+			// Cut the slash out of the range, the halves around it stay
+			if lo < '/' {
+				writeClassRange(&b, lo, '/'-1)
+				items++
+			}
+			if hi > '/' {
+				writeClassRange(&b, '/'+1, hi)
+				items++
+			}
+			continue
+		}
+		writeClassRange(&b, lo, hi)
+		items++
+	}
+	if !negated && items == 0 {
+		// Nothing but a slash, so nothing matches
+		return `[^\x00-\x{10FFFF}]`
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+func writeClassRange(b *strings.Builder, lo, hi rune) {
+	b.WriteString(quoteClassChar(lo))
+	if hi != lo {
+		b.WriteString("-")
+		b.WriteString(quoteClassChar(hi))
+	}
+}
+
+func quoteClassChar(r rune) string {
+	if r == '-' {
+		return `\-`
+	}
+	return regexp.QuoteMeta(string(r))
+}
+
+// Match reports whether a slash separated workspace relative path matches
+func (g *Glob) Match(relPath string) bool {
+	if g.baseOnly {
+		return g.re.MatchString(path.Base(relPath))
+	}
+	return g.re.MatchString(relPath)
+}
+
+func compileGlobs(patterns []string) ([]*Glob, error) {
+	globs := make([]*Glob, 0, len(patterns))
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) == "" {
+			continue
+		}
+		glob, err := CompileGlob(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, err
+		}
+		globs = append(globs, glob)
+	}
+	return globs, nil
+}
+
+func matchAny(globs []*Glob, relPath string) bool {
+	for _, glob := range globs {
+		if glob.Match(relPath) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		// Patterns without a slash match the base name at any depth
+		{"*.js", "app.js", true},
+		{"*.js", "src/lib/app.js", true},
+		{"*.js", "app.jsx", false},
+		{"*.js", "src.js/app.ts", false},
+		{"node_modules", "a/node_modules", true},
+		{"node_modules/", "a/node_modules", true},
+		// A slash anchors the pattern at the workspace root
+		{"src/*.js", "src/app.js", true},
+		{"src/*.js", "lib/src/app.js", false},
+		{"src/*.js", "src/lib/app.js", false},
+		{"/build", "build", true},
+		{"/build/*", "build/out.js", true},
+		{"./src/*.js", "src/app.js", true},
+		// ** spans directories, including none
+		{"src/**/*.js", "src/app.js", true},
+		{"src/**/*.js", "src/a/b/app.js", true},
+		{"src/**/*.js", "lib/app.js", false},
+		{"**/test/*.go", "test/a.go", true},
+		{"**/test/*.go", "pkg/test/a.go", true},
+		{"src/**", "src/a/b", true},
+		{"src/**", "srcs/a", false},
+		// Single character wildcards and classes stay within one segment
+		{"?.txt", "a.txt", true},
+		{"?.txt", "ab.txt", false},
+		{"a?b", "a/b", false},
+		{"file[0-9].txt", "file7.txt", true},
+		{"file[0-9].txt", "filex.txt", false},
+		{"file[!0-9].txt", "filex.txt", true},
+		{"file[!0-9].txt", "file7.txt", false},
+		{"[abc", "[abc", true},
+		{"[!a]", "b", true},
+		{"[!a]", "a", false},
+		{"x[!a]y", "x/y", false},
+		{"a[/]b", "a/b", false},
+		{"a[!-/]b", "a/b", false},
+		{"a[*-0]b", "a/b", false},
+		{"a[*-0]b", "a.b", true},
+		// Class bodies are literal apart from ranges and escapes
+		{"[\\\\]x", "\\x", true},
+		{"[\\\\]x", "ax", false},
+		{"[[:]x", ":x", true},
+		{"[[:]x", "ax", false},
+		{"[a\\]]x", "]x", true},
+		{"[^.]x", ".x", false},
+		{"[a-]x", "-x", true},
+		// Regexp characters are literal
+		{"a+b.(c)", "a+b.(c)", true},
+		{"a.b", "axb", false},
+		{"\\*.js", "*.js", true},
+		{"\\*.js", "app.js", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			glob, err := CompileGlob(tt.pattern)
+			if err != nil {
+				t.Fatalf("failed to compile: %v", err)
+			}
+			if got := glob.Match(tt.path); got != tt.want {
+				t.Errorf("expected Match(%q)=%v; got %v", tt.path, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCompileGlobs(t *testing.T) {
+	globs, err := compileGlobs([]string{"", " *.md ", "docs/**"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(globs) != 2 {
+		t.Fatalf("expected blank patterns to be dropped; got %d globs", len(globs))
+	}
+	for path, want := range map[string]bool{"README.md": true, "docs/a/b.txt": true, "src/app.js": false} {
+		if got := matchAny(globs, path); got != want {
+			t.Errorf("expected matchAny(%q)=%v; got %v", path, want, got)
+		}
+	}
+
+	if _, err := compileGlobs([]string{"[z-a]"}); err == nil {
+		t.Error("expected an invalid class to fail")
+	}
+}
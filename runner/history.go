@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	HISTORY_MAX_REVISIONS = 50
+	HISTORY_MAX_FILE_SIZE = int64(1024 * 1024) // 1 MB, larger files are not kept
+	// Deletes are read into memory before anything is removed, files past this are not kept
+	HISTORY_MAX_DELETE_SIZE = int64(1024 * 1024 * 32)
+)
+
+// Actions recorded in a file's history
+const (
+	HISTORY_ACTION_EDIT     = "edit"
+	HISTORY_ACTION_DELETE   = "delete"
+	HISTORY_ACTION_RESTORE  = "restore"
+	HISTORY_ACTION_EXTERNAL = "external" // state never seen by the runner, e.g. changed from the terminal
+)
+
+// LocalHistory keeps a bounded list of snapshots per file outside the
+// workspace. Every path gets its own directory holding an index and the
+// snapshot contents, named after their version.
+type LocalHistory struct {
+	dir string
+	mu  sync.Mutex
+}
+
+var History *LocalHistory
+
+type historyIndex struct {
+	Path      string            `json:"path"`
+	NextID    int               `json:"nextId"`
+	Revisions []HistoryRevision `json:"revisions"`
+}
+
+// Get the history directory from environment, defaults to a directory next to the workspace
+func getHistoryDir(workspaceRoot string) string {
+	if dir := os.Getenv("HISTORY_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(filepath.Dir(workspaceRoot), "."+filepath.Base(workspaceRoot)+"-history")
+}
+
+func InitLocalHistory() error {
+	dir := getHistoryDir(WorkspaceFS.Root())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		// The parent of the workspace mount is not always writable
+		fallback := filepath.Join(os.TempDir(), "workspace-history")
+		log.Printf("Cannot create history directory %s (%v), using %s", dir, err, fallback)
+		dir = fallback
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create history directory %s: %w", dir, err)
+		}
+	}
+	History = &LocalHistory{dir: dir}
+	log.Printf("Local history directory initialized: %s", dir)
+	return nil
+}
+
+func (h *LocalHistory) pathDir(relPath string) string {
+	sum := sha256.Sum256([]byte(filepath.ToSlash(relPath)))
+	return filepath.Join(h.dir, hex.EncodeToString(sum[:16]))
+}
+
+func (h *LocalHistory) blobPath(relPath, version string) string {
+	return filepath.Join(h.pathDir(relPath), version)
+}
+
+func (h *LocalHistory) load(relPath string) (*historyIndex, error) {
+	data, err := os.ReadFile(filepath.Join(h.pathDir(relPath), "index.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return &historyIndex{Path: filepath.ToSlash(relPath), NextID: 1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var index historyIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("corrupt history index for %s: %w", relPath, err)
+	}
+	return &index, nil
+}
+
+func (h *LocalHistory) save(relPath string, index *historyIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	dir := h.pathDir(relPath)
+	tmp := filepath.Join(dir, "index.json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "index.json"))
+}
+
+// record appends a revision, callers must hold h.mu
+func (h *LocalHistory) record(relPath, action string, content []byte, deleted bool) error {
+	if !deleted && int64(len(content)) > HISTORY_MAX_FILE_SIZE {
+		return nil
+	}
+
+	index, err := h.load(relPath)
+	if err != nil {
+		return err
+	}
+
+	revision := HistoryRevision{
+		ID:        index.NextID,
+		Action:    action,
+		Timestamp: time.Now().Unix(),
+		Deleted:   deleted,
+	}
+	if n := len(index.Revisions); n > 0 {
+		last := index.Revisions[n-1]
+		if deleted && last.Deleted {
+			return nil
+		}
+		if !deleted && !last.Deleted && last.Version == contentVersion(content) {
+			// Nothing changed since the last snapshot
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(h.pathDir(relPath), 0700); err != nil {
+		return err
+	}
+	if !deleted {
+		revision.Version = contentVersion(content)
+		revision.Size = int64(len(content))
+		blob := h.blobPath(relPath, revision.Version)
+		if _, err := os.Stat(blob); errors.Is(err, fs.ErrNotExist) {
+			if err := os.WriteFile(blob, content, 0600); err != nil {
+				return err
+			}
+		}
+	}
+
+	index.NextID++
+	index.Revisions = append(index.Revisions, revision)
+	if len(index.Revisions) > HISTORY_MAX_REVISIONS {
+		dropped := index.Revisions[:len(index.Revisions)-HISTORY_MAX_REVISIONS]
+		index.Revisions = index.Revisions[len(index.Revisions)-HISTORY_MAX_REVISIONS:]
+		h.pruneBlobs(relPath, dropped, index.Revisions)
+	}
+	return h.save(relPath, index)
+}
+
+// pruneBlobs removes snapshot contents no remaining revision refers to
+func (h *LocalHistory) pruneBlobs(relPath string, dropped, kept []HistoryRevision) {
+	inUse := make(map[string]bool, len(kept))
+	for _, revision := range kept {
+		inUse[revision.Version] = true
+	}
+	for _, revision := range dropped {
+		if revision.Version != "" && !inUse[revision.Version] {
+			os.Remove(h.blobPath(relPath, revision.Version))
+		}
+	}
+}
+
+// Record snapshots the state of a file after a change. When the file was
+// changed outside the runner since the last snapshot, previous is recorded
+// first so that state can be restored too. History problems never fail the
+// write itself, they are only logged.
+func (h *LocalHistory) Record(relPath, action string, previous []byte, previousExists bool, content []byte, deleted bool) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if previousExists {
+		if err := h.record(relPath, HISTORY_ACTION_EXTERNAL, previous, false); err != nil {
+			log.Printf("Failed to record history for %s: %v", relPath, err)
+			return
+		}
+	}
+	if err := h.record(relPath, action, content, deleted); err != nil {
+		log.Printf("Failed to record history for %s: %v", relPath, err)
+	}
+}
+
+// deletedFile is the content of a file read before a delete
+type deletedFile struct {
+	path    string
+	content []byte
+}
+
+// SnapshotDelete reads every file below relPath before it is removed, the
+// caller hands the result to RecordDelete once the delete went through
+func (h *LocalHistory) SnapshotDelete(relPath string) []deletedFile {
+	if h == nil {
+		return nil
+	}
+	// Deleting a symlink leaves its target alone, so there is nothing to keep
+	fullPath, err := WorkspaceFS.ResolveNoFollow(relPath)
+	if err != nil {
+		return nil
+	}
+	if info, err := os.Lstat(fullPath); err != nil || info.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+
+	var files []deletedFile
+	var total int64
+	err = WorkspaceFS.WalkDir(relPath, func(filePath string, d fs.DirEntry) error {
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() > HISTORY_MAX_FILE_SIZE {
+			return nil
+		}
+		if total+info.Size() > HISTORY_MAX_DELETE_SIZE {
+			return fmt.Errorf("more than %d bytes would be kept", HISTORY_MAX_DELETE_SIZE)
+		}
+		current, err := WorkspaceFS.ReadFile(filePath)
+		if err != nil {
+			return nil
+		}
+		total += int64(len(current))
+		files = append(files, deletedFile{path: filePath, content: current})
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to snapshot %s before deleting it: %v", relPath, err)
+	}
+	return files
+}
+
+// RecordDelete records the files read by SnapshotDelete as deleted
+func (h *LocalHistory) RecordDelete(files []deletedFile) {
+	for _, file := range files {
+		h.Record(file.path, HISTORY_ACTION_DELETE, file.content, true, nil, true)
+	}
+}
+
+func (h *LocalHistory) List(relPath string) ([]HistoryRevision, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	index, err := h.load(relPath)
+	if err != nil {
+		return nil, err
+	}
+	// Newest first
+	revisions := make([]HistoryRevision, 0, len(index.Revisions))
+	for i := len(index.Revisions) - 1; i >= 0; i-- {
+		revisions = append(revisions, index.Revisions[i])
+	}
+	return revisions, nil
+}
+
+func (h *LocalHistory) Revision(relPath string, id int) (HistoryRevision, error) {
+	revisions, err := h.List(relPath)
+	if err != nil {
+		return HistoryRevision{}, err
+	}
+	for _, revision := range revisions {
+		if revision.ID == id {
+			return revision, nil
+		}
+	}
+	return HistoryRevision{}, newFSError(FS_ERR_NOT_FOUND, relPath, fmt.Sprintf("revision %d not found", id))
+}
+
+func getLocalHistory() (*LocalHistory, error) {
+	if History == nil {
+		return nil, fmt.Errorf("local history is not available")
+	}
+	return History, nil
+}
+
+// List the recorded revisions of a file, newest first
+func HistoryListHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req HistoryListPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal history list payload: %w", err)
+	}
+	history, err := getLocalHistory()
+	if err != nil {
+		return err
+	}
+	relPath, err := WorkspaceFS.Clean(req.Path)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := history.List(relPath)
+	if err != nil {
+		return fmt.Errorf("failed to read history of %s: %w", relPath, err)
+	}
+	return client.Reply(ctx, RESPONSE_HISTORY, map[string]interface{}{
+		"path":      req.Path,
+		"revisions": revisions,
+	})
+}
+
+// Diff two revisions of a file, revision 0 is the file as it is on disk now
+func HistoryDiffHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req HistoryDiffPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal history diff payload: %w", err)
+	}
+	history, err := getLocalHistory()
+	if err != nil {
+		return err
+	}
+	relPath, err := WorkspaceFS.Clean(req.Path)
+	if err != nil {
+		return err
+	}
+
+	side := func(id int) (string, error) {
+		if id == 0 {
+			fullPath, err := WorkspaceFS.Resolve(relPath)
+			if err != nil {
+				return "", err
+			}
+			if _, err := os.Stat(fullPath); errors.Is(err, fs.ErrNotExist) {
+				return os.DevNull, nil
+			}
+			return fullPath, nil
+		}
+		revision, err := history.Revision(relPath, id)
+		if err != nil {
+			return "", err
+		}
+		if revision.Deleted {
+			return os.DevNull, nil
+		}
+		return history.blobPath(relPath, revision.Version), nil
+	}
+	from, err := side(req.From)
+	if err != nil {
+		return err
+	}
+	to, err := side(req.To)
+	if err != nil {
+		return err
+	}
+
+	// git diff exits with 1 when the files differ
+	out, err := runGit(ctx, nil, "diff", "--no-index", "--no-color", "--no-ext-diff", from, to)
+	var gitErr *GitError
+	if err != nil && !(errors.As(err, &gitErr) && gitErr.ExitCode == 1) {
+		return err
+	}
+	files, err := parseGitDiff(string(out))
+	if err != nil {
+		return fmt.Errorf("failed to parse history diff: %w", err)
+	}
+
+	response := HistoryDiffResponse{Path: req.Path, From: req.From, To: req.To}
+	if len(files) > 0 {
+		diff := files[0]
+		diff.Path, diff.OldPath = req.Path, ""
+		response.Diff = &diff
+	}
+	return client.Reply(ctx, RESPONSE_HISTORY_DIFF, response)
+}
+
+// Restore a file to a recorded revision, the restore is a normal write
+func HistoryRestoreHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req HistoryRestorePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal history restore payload: %w", err)
+	}
+	history, err := getLocalHistory()
+	if err != nil {
+		return err
+	}
+	relPath, err := WorkspaceFS.Clean(req.Path)
+	if err != nil {
+		return err
+	}
+	if err := Protected.CheckWrite(relPath); err != nil {
+		return err
+	}
+
+	revision, err := history.Revision(relPath, req.Revision)
+	if err != nil {
+		return err
+	}
+	if revision.Deleted {
+		return newFSError(FS_ERR_NOT_FOUND, req.Path, fmt.Sprintf("revision %d is a deletion, pick an earlier one", revision.ID))
+	}
+	content, err := os.ReadFile(history.blobPath(relPath, revision.Version))
+	if err != nil {
+		return fmt.Errorf("failed to read revision %d of %s: %w", revision.ID, relPath, err)
+	}
+
+	var previous []byte
+	var previousExists bool
+	version, err := WorkspaceFS.UpdateFile(relPath, req.BaseVersion, func(current []byte, exists bool) ([]byte, error) {
+		previous, previousExists = current, exists
+		if err := Quota.Check(relPath, int64(len(content))); err != nil {
+			return nil, err
+		}
+		return content, nil
+	})
+	if err != nil {
+		return err
+	}
+	history.Record(relPath, HISTORY_ACTION_RESTORE, previous, previousExists, content, false)
+
+	client.Session().MarkDirty(relPath, "edit")
+	log.Printf("Restored %s to revision %d", relPath, revision.ID)
+
+	return client.Reply(ctx, RESPONSE_HISTORY_RESTORED, map[string]interface{}{
+		"path":     req.Path,
+		"revision": revision.ID,
+		"version":  version,
+		"success":  true,
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func newTestHistory(t *testing.T) {
+	t.Helper()
+	t.Setenv("HISTORY_DIR", t.TempDir())
+	previous := History
+	if err := InitLocalHistory(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { History = previous })
+}
+
+func TestDeleteRecordsHistoryOnlyOnSuccess(t *testing.T) {
+	newTestWorkspace(t, map[string]string{"src/app.js": "app", "src/lib/util.js": "util"})
+	newTestHistory(t)
+	client := NewClient(nil, NewFSManager(context.Background()), nil)
+	client.SetSession(&Session{LabID: "lab-1", Language: "node"})
+
+	deleteFile := func(path string) error {
+		payload, _ := json.Marshal(DeleteFilePayload{Path: path})
+		return DeleteFileHandler(context.Background(), payload, client)
+	}
+
+	// The root cannot be deleted, nothing below it may show up as deleted
+	if err := deleteFile("/"); !isFSErrorCode(err, FS_ERR_WORKSPACE_ROOT) {
+		t.Fatalf("expected %s; got %v", FS_ERR_WORKSPACE_ROOT, err)
+	}
+	if revisions, _ := History.List("src/app.js"); len(revisions) != 0 {
+		t.Fatalf("expected no history for a failed delete; got %+v", revisions)
+	}
+
+	if err := deleteFile("src"); err != nil {
+		t.Fatalf("expected the delete to succeed; got %v", err)
+	}
+	for _, path := range []string{"src/app.js", "src/lib/util.js"} {
+		revisions, err := History.List(path)
+		if err != nil || len(revisions) == 0 || revisions[0].Action != HISTORY_ACTION_DELETE {
+			t.Errorf("expected %s to be recorded as deleted; got %+v, %v", path, revisions, err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+var HYDRATE_CONCURRENCY = 16
+
+// hydrated flips once the workspace holds the lab's code, the runner reports
+// itself unhealthy and refuses connections until then
+var hydrated atomic.Bool
+
+func isHydrated() bool {
+	return hydrated.Load()
+}
+
+func whenHydrated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isHydrated() {
+			http.Error(w, "workspace is still loading", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+type hydrateObject struct {
+	key     string
+	relPath string
+	size    int64
+	isDir   bool // folder marker, keeps empty directories around
+}
+
+func reportHydrateProgress(labID string, status LabStatus, message string) {
+	log.Println(message)
+	// A pod deployed without LAB_ID has no lab instance to report to yet
+	if labID == "" {
+		return
+	}
+	AppendLabHydrationProgress(labID, LabProgressEntry{
+		Timestamp:   time.Now().Unix(),
+		Status:      status,
+		Message:     message,
+		ServiceName: S3_SERVICE,
+	})
+}
+
+// listHydrateObjects lists the code link and maps every object onto a workspace path
+func listHydrateObjects(ctx context.Context, storage ObjectStorage, codeLink string) ([]hydrateObject, error) {
+	prefix := codeLink + "/"
+	listed, err := storage.List(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+
+	var objects []hydrateObject
+	for _, obj := range listed {
+		name := strings.TrimPrefix(obj.Key, prefix)
+		if name == "" {
+			continue
+		}
+		relPath, err := WorkspaceFS.Clean(strings.TrimSuffix(name, "/"))
+		if err != nil {
+			log.Printf("Skipping object outside of the workspace: %s", obj.Key)
+			continue
+		}
+		objects = append(objects, hydrateObject{
+			key:     obj.Key,
+			relPath: relPath,
+			size:    obj.Size,
+			isDir:   strings.HasSuffix(name, "/"),
+		})
+	}
+	return objects, nil
+}
+
+// hydrateFile downloads a single object, returns false when the local copy was kept
+func hydrateFile(ctx context.Context, storage ObjectStorage, obj hydrateObject) (bool, error) {
+	// A restarted container keeps the volume, the local file may hold edits that were never synced
+	target, err := WorkspaceFS.ResolveNoFollow(obj.relPath)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return false, nil
+	}
+
+	body, info, err := storage.Get(ctx, obj.key)
+	if err != nil {
+		return false, fmt.Errorf("failed to download %s: %w", obj.key, err)
+	}
+	defer body.Close()
+
+	// Written next to the target and renamed, a half downloaded file is never mistaken for a local one
+	staging := obj.relPath + ".hydrating"
+	file, err := WorkspaceFS.Create(staging)
+	if err != nil {
+		return false, err
+	}
+	sum := md5.New()
+	n, err := io.Copy(io.MultiWriter(file, sum), body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = WorkspaceFS.Rename(staging, obj.relPath)
+	}
+	if err != nil {
+		WorkspaceFS.RemoveAll(staging)
+		return false, fmt.Errorf("failed to download %s: %w", obj.key, err)
+	}
+
+	// The storage already holds this content, the first sync does not need to upload it again
+	Manifest.Set(obj.key, syncManifestEntry{Hash: hex.EncodeToString(sum.Sum(nil)), ETag: info.ETag, Size: n})
+	return true, nil
+}
+
+// HydrateWorkspace downloads the lab's code from LAB_CODE_LINK into the
+// workspace, reporting progress to the lab instance as it goes
+func HydrateWorkspace(ctx context.Context, storage ObjectStorage, labID string) error {
+	codeLink := strings.Trim(os.Getenv("LAB_CODE_LINK"), "/")
+	if codeLink == "" {
+		log.Println("No code link, starting with the workspace as it is")
+		hydrated.Store(true)
+		return nil
+	}
+	if storage == nil {
+		return fmt.Errorf("storage is not available")
+	}
+
+	start := time.Now()
+
+	reportHydrateProgress(labID, Booting, "Listing workspace files")
+	listed, err := listHydrateObjects(ctx, storage, codeLink)
+	if err != nil {
+		reportHydrateProgress(labID, Error, fmt.Sprintf("Failed to list workspace files: %v", err))
+		return err
+	}
+
+	// The root ignore files come down first so their rules apply to everything else
+	isRootIgnoreFile := func(obj hydrateObject) bool {
+		return !obj.isDir && (obj.relPath == GITIGNORE_FILE || obj.relPath == DEVSARENAIGNORE_FILE)
+	}
+	for _, obj := range listed {
+		if !isRootIgnoreFile(obj) {
+			continue
+		}
+		if _, err := hydrateFile(ctx, storage, obj); err != nil {
+			reportHydrateProgress(labID, Error, fmt.Sprintf("Failed to download workspace files: %v", err))
+			return err
+		}
+	}
+	if err := Ignore.Reload(); err != nil {
+		log.Printf("Failed to load ignore rules: %v", err)
+	}
+
+	var objects []hydrateObject
+	var total int64
+	for _, obj := range listed {
+		if isRootIgnoreFile(obj) || Ignore.IsIgnored(obj.relPath, obj.isDir) {
+			continue
+		}
+		if obj.isDir {
+			if err := WorkspaceFS.MkdirAll(obj.relPath); err != nil {
+				return err
+			}
+			continue
+		}
+		objects = append(objects, obj)
+		total += obj.size
+	}
+	reportHydrateProgress(labID, Booting, fmt.Sprintf("Downloading %d workspace files (%d bytes)", len(objects), total))
+
+	var done, downloaded, kept atomic.Int64
+	var milestone atomic.Int64
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(HYDRATE_CONCURRENCY)
+	for _, obj := range objects {
+		g.Go(func() error {
+			fetched, err := hydrateFile(gctx, storage, obj)
+			if err != nil {
+				return err
+			}
+			if fetched {
+				downloaded.Add(1)
+			} else {
+				kept.Add(1)
+			}
+
+			// Progress entries every quarter, each one is a round trip to Redis
+			percent := done.Add(1) * 100 / int64(len(objects))
+			if quarter := percent / 25; quarter > milestone.Load() && quarter < 4 {
+				if milestone.Swap(quarter) < quarter {
+					reportHydrateProgress(labID, Booting, fmt.Sprintf("Downloaded %d%% of workspace files", quarter*25))
+				}
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		reportHydrateProgress(labID, Error, fmt.Sprintf("Failed to download workspace files: %v", err))
+		return err
+	}
+	if err := Manifest.Save(); err != nil {
+		log.Printf("Failed to save sync manifest: %v", err)
+	}
+
+	reportHydrateProgress(labID, Booting, fmt.Sprintf("Workspace ready, downloaded %d files in %s (%d kept from a previous start)",
+		downloaded.Load(), time.Since(start).Round(time.Millisecond), kept.Load()))
+	hydrated.Store(true)
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Ignore files read from the workspace. A .devsarenaignore is read after the
+// .gitignore of the same directory, so it can re-include what git ignores.
+const (
+	GITIGNORE_FILE       = ".gitignore"
+	DEVSARENAIGNORE_FILE = ".devsarenaignore"
+)
+
+var IGNORE_MAX_FILE_SIZE = int64(256 * 1024)
+
+// Always ignored, whatever the workspace says
+var IGNORE_BASE_RULES = []string{".git/", ".DS_Store", "__MACOSX/"}
+
+// Defaults per language, only used when the quest sets no IGNORE_DEFAULTS.
+// A .devsarenaignore in the boilerplate still changes them per directory.
+var IGNORE_LANGUAGE_DEFAULTS = map[string][]string{
+	"react":        {"node_modules/", "dist/", "build/", ".vite/", ".cache/", "coverage/"},
+	"node":         {"node_modules/", "dist/", ".cache/", "coverage/"},
+	"node-express": {"node_modules/", "dist/", ".cache/", "coverage/"},
+	"next":         {"node_modules/", ".next/", "out/", ".cache/", "coverage/"},
+	"python":       {"__pycache__/", "*.pyc", ".venv/", "venv/", ".pytest_cache/"},
+	"go":           {"bin/"},
+	"rust":         {"target/"},
+	"java":         {"target/", "build/", ".gradle/"},
+}
+
+// Used when the language is unknown
+var IGNORE_FALLBACK_RULES = []string{"node_modules/", "dist/", "build/", ".next/", ".cache/", "__pycache__/", ".venv/", "target/"}
+
+// Get the lab language from environment, the client sends it on init when the deployment does not
+func getIgnoreLanguage(clientLanguage string) string {
+	if language := os.Getenv("LAB_LANGUAGE"); language != "" {
+		return language
+	}
+	return clientLanguage
+}
+
+// defaultIgnoreRules are the rules that apply before any ignore file is read.
+// IGNORE_DEFAULTS comes from the quest at deploy time and replaces the
+// language defaults, IGNORE_RULES adds comma or newline separated rules on top.
+func defaultIgnoreRules(language string) []string {
+	rules := append([]string{}, IGNORE_BASE_RULES...)
+	if defaults := getPathList("IGNORE_DEFAULTS"); len(defaults) > 0 {
+		rules = append(rules, defaults...)
+	} else if defaults, ok := IGNORE_LANGUAGE_DEFAULTS[language]; ok {
+		rules = append(rules, defaults...)
+	} else {
+		rules = append(rules, IGNORE_FALLBACK_RULES...)
+	}
+	if extra := os.Getenv("IGNORE_RULES"); extra != "" {
+		rules = append(rules, strings.FieldsFunc(extra, func(r rune) bool { return r == ',' || r == '\n' })...)
+	}
+	return rules
+}
+
+type ignoreRule struct {
+	base    string // directory of the ignore file the rule came from, "" for the root
+	glob    *Glob
+	negate  bool
+	dirOnly bool
+}
+
+func (r ignoreRule) match(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(relPath, r.base+"/") {
+			return false
+		}
+		relPath = relPath[len(r.base)+1:]
+	}
+	return r.glob.Match(relPath)
+}
+
+// parseIgnoreLines turns .gitignore style lines into rules relative to base
+func parseIgnoreLines(base string, lines []string) []ignoreRule {
+	var rules []ignoreRule
+	for _, line := range lines {
+		line = strings.TrimRight(strings.TrimSuffix(line, "\r"), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{base: base}
+		switch {
+		case strings.HasPrefix(line, "!"):
+			rule.negate = true
+			line = line[1:]
+		case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		glob, err := CompileGlob(line)
+		if err != nil {
+			log.Printf("Skipping ignore rule %q: %v", line, err)
+			continue
+		}
+		rule.glob = glob
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// IgnoreRules decides which workspace paths are left out of tree walks,
+// search, slim exports and sync. Rules follow .gitignore semantics: the last
+// matching rule wins, ! re-includes, and nothing inside an ignored directory
+// can be re-included.
+type IgnoreRules struct {
+	mu    sync.RWMutex
+	rules []ignoreRule
+	// language of the first initialized session, used without LAB_LANGUAGE
+	clientLanguage string
+}
+
+var Ignore = &IgnoreRules{}
+
+func (m *IgnoreRules) matchEntry(relPath string, isDir bool) bool {
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.match(relPath, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// IgnoredEntry checks a path whose parent directories were already checked,
+// as when walking the tree and skipping ignored directories
+func (m *IgnoreRules) IgnoredEntry(relPath string, isDir bool) bool {
+	if relPath == "." || relPath == "" {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.matchEntry(relPath, isDir)
+}
+
+// IsIgnored checks a path and every directory above it
+func (m *IgnoreRules) IsIgnored(relPath string, isDir bool) bool {
+	relPath = path.Clean(filepath.ToSlash(relPath))
+	if relPath == "." {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for i := 0; i < len(relPath); i++ {
+		if relPath[i] == '/' && m.matchEntry(relPath[:i], true) {
+			return true
+		}
+	}
+	return m.matchEntry(relPath, isDir)
+}
+
+// SetClientLanguage picks the per language defaults when the deployment did
+// not pass LAB_LANGUAGE. The workspace has one set of rules, so only the first
+// session decides.
+func (m *IgnoreRules) SetClientLanguage(language string) error {
+	m.mu.Lock()
+	if os.Getenv("LAB_LANGUAGE") != "" || m.clientLanguage != "" || language == "" {
+		m.mu.Unlock()
+		return nil
+	}
+	m.clientLanguage = language
+	m.mu.Unlock()
+	return m.Reload()
+}
+
+func isIgnoreFile(relPath string) bool {
+	base := path.Base(relPath)
+	return base == GITIGNORE_FILE || base == DEVSARENAIGNORE_FILE
+}
+
+// readIgnoreFile loads the rules of one ignore file, missing files have none
+func readIgnoreFile(dir, name string) []ignoreRule {
+	relPath := path.Join(dir, name)
+	target, err := WorkspaceFS.ResolveNoFollow(relPath)
+	if err != nil {
+		return nil
+	}
+	info, err := os.Lstat(target)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > IGNORE_MAX_FILE_SIZE {
+		return nil
+	}
+	content, err := os.ReadFile(target)
+	if err != nil {
+		log.Printf("Failed to read %s: %v", relPath, err)
+		return nil
+	}
+	base := dir
+	if base == "." {
+		base = ""
+	}
+	return parseIgnoreLines(base, strings.Split(string(content), "\n"))
+}
+
+// Reload rebuilds the rules from the defaults and every ignore file in the
+// workspace. Directories that are already ignored are not looked into.
+func (m *IgnoreRules) Reload() error {
+	m.mu.RLock()
+	language := getIgnoreLanguage(m.clientLanguage)
+	m.mu.RUnlock()
+	loading := &IgnoreRules{rules: parseIgnoreLines("", defaultIgnoreRules(language))}
+	files := 0
+
+	err := WorkspaceFS.WalkDir("", func(relPath string, d fs.DirEntry) error {
+		if !d.IsDir() {
+			return nil
+		}
+		if relPath != "." && loading.matchEntry(relPath, true) {
+			return filepath.SkipDir
+		}
+		for _, name := range []string{GITIGNORE_FILE, DEVSARENAIGNORE_FILE} {
+			if rules := readIgnoreFile(relPath, name); rules != nil {
+				loading.rules = append(loading.rules, rules...)
+				files++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.rules = loading.rules
+	m.mu.Unlock()
+	// Ignored directories are not hashed into, the tree hashes follow the rules
+	Trees.Invalidate()
+	log.Printf("Loaded %d ignore rules from %d ignore files", len(loading.rules), files)
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import "testing"
+
+func TestIgnoreRules(t *testing.T) {
+	rules := &IgnoreRules{rules: append(
+		parseIgnoreLines("", []string{
+			"# comment",
+			"",
+			"*.log",
+			"!keep.log",
+			"/build",
+			"dist/",
+			"docs/*.md",
+			"!docs/README.md",
+			"node_modules/",
+			"!node_modules/keep.js",
+			`\!important`,
+			`\#hash`,
+			"trailing.txt   ",
+			"**/cache/",
+			"secret/**",
+		}),
+		parseIgnoreLines("sub", []string{"*.tmp", "/local", "!special.log"})...,
+	)}
+
+	tests := []struct {
+		name  string
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"pattern without a slash at the root", "app.log", false, true},
+		{"pattern without a slash at any depth", "a/b/app.log", false, true},
+		{"negation re-includes", "keep.log", false, false},
+		{"negation at any depth", "a/keep.log", false, false},
+		{"leading slash anchors to the root", "build", true, true},
+		{"anchored pattern misses deeper paths", "src/build", true, false},
+		{"inside an anchored directory", "build/out.js", false, true},
+		{"dir only rule on a directory", "dist", true, true},
+		{"dir only rule skips files", "dist", false, false},
+		{"dir only rule at any depth", "pkg/dist", true, true},
+		{"inside a dir only directory", "dist/app.js", false, true},
+		{"middle slash anchors", "docs/guide.md", false, true},
+		{"middle slash anchors to the root", "src/docs/guide.md", false, false},
+		{"middle slash does not cross directories", "docs/a/guide.md", false, false},
+		{"negated file next to ignored ones", "docs/README.md", false, false},
+		{"ignored directory cannot be re-included into", "node_modules/keep.js", false, true},
+		{"escaped bang is literal", "!important", false, true},
+		{"escaped hash is literal", "#hash", false, true},
+		{"trailing spaces are trimmed", "trailing.txt", false, true},
+		{"double star prefix", "a/b/cache", true, true},
+		{"double star prefix at the root", "cache", true, true},
+		{"double star suffix", "secret/a/b.txt", false, true},
+		{"comment is not a rule", "# comment", false, false},
+		{"nested rules apply below their directory", "sub/a/x.tmp", false, true},
+		{"nested rules do not apply elsewhere", "x.tmp", false, false},
+		{"nested anchor is relative to its directory", "sub/local", false, true},
+		{"nested anchor misses deeper paths", "sub/a/local", false, false},
+		{"nested negation overrides the root", "sub/special.log", false, false},
+		{"nested negation stays in its directory", "special.log", false, true},
+		{"unrelated path", "src/app.js", false, false},
+		{"root", ".", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules.IsIgnored(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("expected IsIgnored(%q)=%v; got %v", tt.path, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestIgnoreReload(t *testing.T) {
+	newTestWorkspace(t, map[string]string{
+		".gitignore":           "*.log\nvendor/\n",
+		"app/.gitignore":       "generated/\n",
+		"app/.devsarenaignore": "!debug.log\n",
+		"app/src/main.go":      "package main",
+		"vendor/.gitignore":    "!*.log\n",
+		"vendor/lib/lib.go":    "package lib",
+		"bin/tool":             "binary",
+		".git/HEAD":            "ref: refs/heads/main",
+		"app/generated/gen.go": "package generated",
+		"app/debug.log":        "kept",
+		"app/trace.log":        "ignored",
+	})
+	t.Setenv("LAB_LANGUAGE", "go")
+	t.Setenv("IGNORE_RULES", "*.bak")
+	rules := &IgnoreRules{}
+	if err := rules.Reload(); err != nil {
+		t.Fatalf("expected the rules to load; got %v", err)
+	}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{".git", true, true},
+		{"bin", true, true},
+		{"notes.bak", false, true},
+		{"vendor", true, true},
+		{"app/generated", true, true},
+		{"app/trace.log", false, true},
+		// .devsarenaignore is read after .gitignore and wins
+		{"app/debug.log", false, false},
+		{"app/src/main.go", false, false},
+		// Ignore files inside ignored directories are never read
+		{"vendor/x.log", false, true},
+	}
+	for _, tt := range tests {
+		if got := rules.IsIgnored(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("expected IsIgnored(%q)=%v; got %v", tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestDefaultIgnoreRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		language string
+		defaults string
+		want     []string
+	}{
+		{"language defaults", "go", "", []string{".git/", ".DS_Store", "__MACOSX/", "bin/"}},
+		{"quest defaults win", "go", "tmp/, *.out", []string{".git/", ".DS_Store", "__MACOSX/", "tmp/", "*.out"}},
+		{"unknown language", "cobol", "", append([]string{".git/", ".DS_Store", "__MACOSX/"}, IGNORE_FALLBACK_RULES...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("IGNORE_DEFAULTS", tt.defaults)
+			t.Setenv("IGNORE_RULES", "")
+			if got := defaultIgnoreRules(tt.language); !equalStrings(got, tt.want) {
+				t.Errorf("expected %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
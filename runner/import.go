@@ -0,0 +1,337 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// Get the bucket prefix a lab can import archives from, each lab only sees
+// its own imports so it cannot read other users' code
+func getImportBucketPrefix(labID string) string {
+	prefix := os.Getenv("IMPORT_BUCKET_PREFIX")
+	if prefix == "" {
+		prefix = "imports/"
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + labID + "/"
+}
+
+// checkImportKey makes sure a bucket key belongs to the lab of the session
+func checkImportKey(key string, session *Session) error {
+	if session == nil || session.LabID == "" {
+		return newFSError(FS_ERR_PERMISSION, key, "archives can only be imported into an initialized lab")
+	}
+	prefix := getImportBucketPrefix(session.LabID)
+	if path.Clean(key) != key || !strings.HasPrefix(key, prefix) || len(key) == len(prefix) {
+		return newFSError(FS_ERR_PERMISSION, key, "archives can only be imported from "+prefix)
+	}
+	return nil
+}
+
+type importStats struct {
+	files       int
+	directories int
+	skipped     int
+	bytes       int64
+	written     []string
+}
+
+// detectArchiveFormat sniffs the magic bytes when the client did not say what it sent
+func detectArchiveFormat(f *os.File) (string, error) {
+	head := make([]byte, 4)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return ARCHIVE_FORMAT_ZIP, nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return ARCHIVE_FORMAT_TARGZ, nil
+	}
+	return "", newFSError(FS_ERR_INVALID_ARCHIVE, "", "archive must be a zip or tar.gz")
+}
+
+// walkArchive calls fn for every entry of the archive, r is nil for directories
+func walkArchive(f *os.File, format string, fn func(name string, info fs.FileInfo, r io.Reader) error) error {
+	switch format {
+	case ARCHIVE_FORMAT_ZIP:
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		zr, err := zip.NewReader(f, stat.Size())
+		if err != nil {
+			return &FSError{Code: FS_ERR_INVALID_ARCHIVE, Message: "archive is not a valid zip", Err: err}
+		}
+		for _, zf := range zr.File {
+			info := zf.FileInfo()
+			if info.IsDir() || !info.Mode().IsRegular() {
+				if err := fn(zf.Name, info, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return &FSError{Code: FS_ERR_INVALID_ARCHIVE, Path: zf.Name, Message: "failed to read archive entry", Err: err}
+			}
+			err = fn(zf.Name, info, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case ARCHIVE_FORMAT_TARGZ:
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return &FSError{Code: FS_ERR_INVALID_ARCHIVE, Message: "archive is not a valid gzip stream", Err: err}
+		}
+		defer gz.Close()
+
+		tr := tar.NewReader(gz)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return &FSError{Code: FS_ERR_INVALID_ARCHIVE, Message: "archive is not a valid tar", Err: err}
+			}
+			var r io.Reader
+			if header.Typeflag == tar.TypeReg {
+				r = tr
+			}
+			if err := fn(header.Name, header.FileInfo(), r); err != nil {
+				return err
+			}
+		}
+	}
+	return newFSError(FS_ERR_INVALID_ARCHIVE, "", "unsupported archive format "+format)
+}
+
+// archiveEntryPath maps an entry name onto a workspace path below target,
+// rejecting names that would escape it (zip-slip)
+func archiveEntryPath(target, name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	relName, err := WorkspaceFS.Clean(name)
+	if err != nil {
+		return "", &FSError{Code: FS_ERR_INVALID_ARCHIVE, Path: name, Message: "archive entry points outside of the target directory", Err: err}
+	}
+	return path.Join(target, relName), nil
+}
+
+func isArchiveJunk(name string) bool {
+	return strings.HasPrefix(name, "__MACOSX/") || path.Base(name) == ".DS_Store"
+}
+
+// validateArchive checks every entry name and the limits before anything is written
+func validateArchive(f *os.File, format, target string) error {
+	entries := 0
+	var total, files int64
+	err := walkArchive(f, format, func(name string, info fs.FileInfo, r io.Reader) error {
+		entries++
+		if entries > IMPORT_MAX_ENTRIES {
+			return newFSError(FS_ERR_TOO_LARGE, target, fmt.Sprintf("archives are limited to %d entries", IMPORT_MAX_ENTRIES))
+		}
+		relPath, err := archiveEntryPath(target, name)
+		if err != nil {
+			return err
+		}
+		if err := Protected.CheckWrite(relPath); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files++
+			total += info.Size()
+			if total > IMPORT_MAX_SIZE {
+				return newFSError(FS_ERR_TOO_LARGE, target, fmt.Sprintf("archive expands to more than %d bytes", IMPORT_MAX_SIZE))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Files the archive overwrites are counted as new, the next rescan settles it
+	return Quota.Reserve(target, total, files)
+}
+
+// extractArchive writes the archive into target. Declared sizes are not trusted,
+// the uncompressed budget is enforced on the bytes actually written.
+func extractArchive(f *os.File, format, target string) (*importStats, error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	stats := &importStats{}
+	err := walkArchive(f, format, func(name string, info fs.FileInfo, r io.Reader) error {
+		relPath, err := archiveEntryPath(target, name)
+		if err != nil {
+			return err
+		}
+		if isArchiveJunk(strings.ReplaceAll(name, "\\", "/")) {
+			stats.skipped++
+			return nil
+		}
+
+		switch {
+		case info.IsDir():
+			stats.directories++
+			return WorkspaceFS.MkdirAll(relPath)
+		case r == nil || !info.Mode().IsRegular():
+			// Symlinks, hard links and devices are never extracted
+			stats.skipped++
+			return nil
+		}
+
+		file, err := WorkspaceFS.Create(relPath)
+		if err != nil {
+			return err
+		}
+		remaining := IMPORT_MAX_SIZE - stats.bytes
+		n, err := io.Copy(file, io.LimitReader(r, remaining+1))
+		closeErr := file.Close()
+		stats.written = append(stats.written, relPath)
+		stats.bytes += n
+		if err != nil {
+			return &FSError{Code: FS_ERR_INVALID_ARCHIVE, Path: relPath, Message: "failed to extract archive entry", Err: err}
+		}
+		if closeErr != nil {
+			return wrapFSError(relPath, "failed to write file", closeErr)
+		}
+		if n > remaining {
+			return newFSError(FS_ERR_TOO_LARGE, target, fmt.Sprintf("archive expands to more than %d bytes", IMPORT_MAX_SIZE))
+		}
+		stats.files++
+		return nil
+	})
+	return stats, err
+}
+
+// stageBucketArchive downloads an archive from the storage into the staging directory
+func stageBucketArchive(ctx context.Context, key string, session *Session) (*os.File, error) {
+	if err := checkImportKey(key, session); err != nil {
+		return nil, err
+	}
+	if Storage == nil {
+		return nil, fmt.Errorf("storage is not available")
+	}
+
+	body, info, err := Storage.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch archive %s: %w", key, err)
+	}
+	defer body.Close()
+
+	if info.Size > MAX_UPLOAD_SIZE {
+		return nil, newFSError(FS_ERR_TOO_LARGE, key, fmt.Sprintf("archives are limited to %d bytes", MAX_UPLOAD_SIZE))
+	}
+
+	staging, err := os.CreateTemp(getUploadStagingDir(), "import-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging file: %w", err)
+	}
+	n, err := io.Copy(staging, io.LimitReader(body, MAX_UPLOAD_SIZE+1))
+	if err == nil && n > MAX_UPLOAD_SIZE {
+		err = newFSError(FS_ERR_TOO_LARGE, key, fmt.Sprintf("archives are limited to %d bytes", MAX_UPLOAD_SIZE))
+	}
+	if err != nil {
+		staging.Close()
+		os.Remove(staging.Name())
+		return nil, fmt.Errorf("failed to download archive %s: %w", key, err)
+	}
+	return staging, nil
+}
+
+// Extract a zip or tar.gz, either uploaded in chunks or stored in the bucket, into a directory
+func ImportArchiveHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req ImportArchivePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal import archive payload: %w", err)
+	}
+
+	target, err := WorkspaceFS.Clean(req.Path)
+	if err != nil {
+		return err
+	}
+	if (req.UploadID == "") == (req.Key == "") {
+		return newFSError(FS_ERR_INVALID_ARCHIVE, req.Path, "an import needs either an uploadId or a bucket key")
+	}
+
+	var archive *os.File
+	if req.UploadID != "" {
+		upload, err := client.getUpload(req.UploadID)
+		if err != nil {
+			return err
+		}
+		if upload.received != upload.size {
+			return newFSError(FS_ERR_INVALID_UPLOAD, upload.path, fmt.Sprintf("received %d of %d bytes", upload.received, upload.size))
+		}
+		client.takeUpload(upload.id)
+		defer upload.discard()
+
+		checksum, err := fileChecksum(upload.file)
+		if err != nil {
+			return fmt.Errorf("failed to checksum upload %s: %w", upload.id, err)
+		}
+		if !strings.EqualFold(checksum, req.Checksum) {
+			return newFSError(FS_ERR_CHECKSUM_MISMATCH, upload.path, "uploaded archive does not match the checksum, upload discarded")
+		}
+		archive = upload.file
+	} else {
+		archive, err = stageBucketArchive(ctx, req.Key, client.Session())
+		if err != nil {
+			return err
+		}
+		defer func() {
+			archive.Close()
+			os.Remove(archive.Name())
+		}()
+	}
+
+	format := req.Format
+	if format == "" {
+		if format, err = detectArchiveFormat(archive); err != nil {
+			return err
+		}
+	}
+	if err := validateArchive(archive, format, target); err != nil {
+		return err
+	}
+
+	stats, err := extractArchive(archive, format, target)
+	// Whatever made it to disk has to be synced, even when extraction stopped half way
+	for _, relPath := range stats.written {
+		client.Session().MarkDirty(relPath, "edit")
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported archive into %s (%d files, %d bytes)", target, stats.files, stats.bytes)
+
+	return client.Reply(ctx, RESPONSE_ARCHIVE_IMPORTED, map[string]interface{}{
+		"path":        target,
+		"files":       stats.files,
+		"directories": stats.directories,
+		"skipped":     stats.skipped,
+		"bytes":       stats.bytes,
+		"success":     true,
+	})
+}
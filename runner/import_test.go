@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testArchiveEntry struct {
+	name    string
+	content string
+	link    string
+	dir     bool
+}
+
+// writeTestArchive builds a zip or tar.gz in a temporary file
+func writeTestArchive(t *testing.T, format string, entries []testArchiveEntry) *os.File {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "archive-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	switch format {
+	case ARCHIVE_FORMAT_ZIP:
+		zw := zip.NewWriter(f)
+		for _, entry := range entries {
+			header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+			content := entry.content
+			switch {
+			case entry.dir:
+				header.Name += "/"
+				header.SetMode(os.ModeDir | 0755)
+			case entry.link != "":
+				header.SetMode(os.ModeSymlink | 0777)
+				content = entry.link
+			default:
+				header.SetMode(0644)
+			}
+			w, err := zw.CreateHeader(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(content))
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case ARCHIVE_FORMAT_TARGZ:
+		gz := gzip.NewWriter(f)
+		tw := tar.NewWriter(gz)
+		for _, entry := range entries {
+			header := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.content))}
+			switch {
+			case entry.dir:
+				header = &tar.Header{Name: entry.name + "/", Mode: 0755, Typeflag: tar.TypeDir}
+			case entry.link != "":
+				header = &tar.Header{Name: entry.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.link}
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				t.Fatal(err)
+			}
+			if header.Typeflag == tar.TypeReg {
+				tw.Write([]byte(entry.content))
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f
+}
+
+func TestCheckImportKey(t *testing.T) {
+	t.Setenv("IMPORT_BUCKET_PREFIX", "")
+	session := &Session{LabID: "lab-1"}
+
+	tests := []struct {
+		name    string
+		key     string
+		session *Session
+		wantErr bool
+	}{
+		{"own lab", "imports/lab-1/project.zip", session, false},
+		{"nested", "imports/lab-1/a/b/project.zip", session, false},
+		{"other lab", "imports/lab-2/project.zip", session, true},
+		{"lab id prefix", "imports/lab-10/project.zip", session, true},
+		{"traversal", "imports/lab-1/../lab-2/project.zip", session, true},
+		{"double slash", "imports/lab-1//project.zip", session, true},
+		{"prefix only", "imports/lab-1/", session, true},
+		{"outside imports", "code/node/lab-1/index.js", session, true},
+		{"no session", "imports/lab-1/project.zip", nil, true},
+		{"session without lab", "imports//project.zip", &Session{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkImportKey(tt.key, tt.session)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("expected error=%v; got %v", tt.wantErr, err)
+			}
+			if err != nil && !isFSErrorCode(err, FS_ERR_PERMISSION) {
+				t.Errorf("expected %s; got %v", FS_ERR_PERMISSION, err)
+			}
+		})
+	}
+
+	t.Setenv("IMPORT_BUCKET_PREFIX", "uploads")
+	if err := checkImportKey("uploads/lab-1/project.zip", session); err != nil {
+		t.Errorf("expected the configured prefix to be used; got %v", err)
+	}
+}
+
+func TestImportArchive(t *testing.T) {
+	for _, format := range []string{ARCHIVE_FORMAT_ZIP, ARCHIVE_FORMAT_TARGZ} {
+		t.Run(format, func(t *testing.T) {
+			root := newTestWorkspace(t, nil)
+			archive := writeTestArchive(t, format, []testArchiveEntry{
+				{name: "src", dir: true},
+				{name: "src/index.js", content: "console.log(1)"},
+				{name: "src/passwd", link: "/etc/passwd"},
+				{name: "escape", link: "../../outside"},
+				{name: "__MACOSX/._index.js", content: "junk"},
+			})
+
+			detected, err := detectArchiveFormat(archive)
+			if err != nil || detected != format {
+				t.Fatalf("expected %s to be detected; got %q, %v", format, detected, err)
+			}
+			if err := validateArchive(archive, format, "project"); err != nil {
+				t.Fatalf("expected the archive to validate; got %v", err)
+			}
+			stats, err := extractArchive(archive, format, "project")
+			if err != nil {
+				t.Fatalf("expected the archive to extract; got %v", err)
+			}
+			if stats.files != 1 || stats.skipped != 3 {
+				t.Errorf("expected 1 file and 3 skipped entries; got %d and %d", stats.files, stats.skipped)
+			}
+			if content, err := os.ReadFile(filepath.Join(root, "project", "src", "index.js")); err != nil || string(content) != "console.log(1)" {
+				t.Errorf("expected index.js to be extracted; got %q, %v", content, err)
+			}
+			for _, link := range []string{"project/src/passwd", "project/escape"} {
+				if _, err := os.Lstat(filepath.Join(root, filepath.FromSlash(link))); !os.IsNotExist(err) {
+					t.Errorf("expected symlink %s to be skipped; got %v", link, err)
+				}
+			}
+		})
+	}
+}
+
+func TestImportArchiveZipSlip(t *testing.T) {
+	for _, format := range []string{ARCHIVE_FORMAT_ZIP, ARCHIVE_FORMAT_TARGZ} {
+		for _, name := range []string{"../evil.txt", "src/../../evil.txt", "..\\evil.txt"} {
+			t.Run(format+" "+name, func(t *testing.T) {
+				root := newTestWorkspace(t, nil)
+				archive := writeTestArchive(t, format, []testArchiveEntry{
+					{name: "ok.txt", content: "ok"},
+					{name: name, content: "evil"},
+				})
+				if err := validateArchive(archive, format, "project"); !isFSErrorCode(err, FS_ERR_INVALID_ARCHIVE) {
+					t.Fatalf("expected %s; got %v", FS_ERR_INVALID_ARCHIVE, err)
+				}
+				entries, _ := os.ReadDir(root)
+				if len(entries) != 0 {
+					t.Errorf("expected nothing to be written; found %d entries", len(entries))
+				}
+				if _, err := os.Stat(filepath.Join(filepath.Dir(root), "evil.txt")); !os.IsNotExist(err) {
+					t.Errorf("expected nothing outside the workspace; got %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestImportArchiveLimits(t *testing.T) {
+	newTestWorkspace(t, nil)
+	entries := []testArchiveEntry{
+		{name: "a.txt", content: "aaaa"},
+		{name: "b.txt", content: "bbbb"},
+		{name: "c.txt", content: "cccc"},
+	}
+
+	t.Run("entries", func(t *testing.T) {
+		previous := IMPORT_MAX_ENTRIES
+		IMPORT_MAX_ENTRIES = 2
+		t.Cleanup(func() { IMPORT_MAX_ENTRIES = previous })
+		archive := writeTestArchive(t, ARCHIVE_FORMAT_ZIP, entries)
+		if err := validateArchive(archive, ARCHIVE_FORMAT_ZIP, "project"); !isFSErrorCode(err, FS_ERR_TOO_LARGE) {
+			t.Fatalf("expected %s; got %v", FS_ERR_TOO_LARGE, err)
+		}
+	})
+
+	t.Run("declared size", func(t *testing.T) {
+		previous := IMPORT_MAX_SIZE
+		IMPORT_MAX_SIZE = 10
+		t.Cleanup(func() { IMPORT_MAX_SIZE = previous })
+		archive := writeTestArchive(t, ARCHIVE_FORMAT_TARGZ, entries)
+		if err := validateArchive(archive, ARCHIVE_FORMAT_TARGZ, "project"); !isFSErrorCode(err, FS_ERR_TOO_LARGE) {
+			t.Fatalf("expected %s; got %v", FS_ERR_TOO_LARGE, err)
+		}
+	})
+
+	t.Run("written size", func(t *testing.T) {
+		previous := IMPORT_MAX_SIZE
+		IMPORT_MAX_SIZE = 10
+		t.Cleanup(func() { IMPORT_MAX_SIZE = previous })
+		// Sizes in the headers are not trusted, extraction stops on the bytes written
+		archive := writeTestArchive(t, ARCHIVE_FORMAT_ZIP, entries)
+		stats, err := extractArchive(archive, ARCHIVE_FORMAT_ZIP, "project")
+		if !isFSErrorCode(err, FS_ERR_TOO_LARGE) {
+			t.Fatalf("expected %s; got %v", FS_ERR_TOO_LARGE, err)
+		}
+		if stats.bytes > IMPORT_MAX_SIZE+1 {
+			t.Errorf("expected extraction to stop at the limit; wrote %d bytes", stats.bytes)
+		}
+	})
+}
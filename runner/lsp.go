@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// Connections without a message from the browser for this long are closed
+	// and their language server stopped
+	LSP_IDLE_TIMEOUT = 15 * time.Minute
+	// How long a language server gets to exit once its stdin is closed
+	LSP_SHUTDOWN_GRACE = 3 * time.Second
+	// Each connection runs its own server, they are heavy so only a few at once
+	LSP_MAX_SERVERS      = int32(3)
+	LSP_MAX_MESSAGE_SIZE = 32 * 1024 * 1024
+	// Root the browser uses in its URIs, the client may pick another with ?root=
+	LSP_CLIENT_ROOT = "file:///workspace"
+)
+
+var lspServers atomic.Int32
+
+// uriRewriter swaps one root URI for another in raw JSON-RPC messages. Only
+// whole roots are replaced, file:///workspace does not touch file:///workspace2.
+type uriRewriter struct {
+	pattern *regexp.Regexp
+	to      []byte
+}
+
+func newURIRewriter(from, to string) *uriRewriter {
+	if from == to {
+		return nil
+	}
+	return &uriRewriter{
+		pattern: regexp.MustCompile(regexp.QuoteMeta(from) + `(?:[/"?#]|$)`),
+		to:      []byte(to),
+	}
+}
+
+func (u *uriRewriter) rewrite(message []byte) []byte {
+	if u == nil {
+		return message
+	}
+	return u.pattern.ReplaceAllFunc(message, func(match []byte) []byte {
+		// Keep the character that ended the root
+		rewritten := append([]byte{}, u.to...)
+		if last := match[len(match)-1]; strings.IndexByte(`/"?#`, last) >= 0 {
+			rewritten = append(rewritten, last)
+		}
+		return rewritten
+	})
+}
+
+// workspaceRootURI is the file URI the language server sees for the workspace
+func workspaceRootURI() string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(WorkspaceFS.Root())}).String()
+}
+
+// getLSPClientRoot validates the root URI the browser asked for
+func getLSPClientRoot(r *http.Request) (string, error) {
+	root := r.URL.Query().Get("root")
+	if root == "" {
+		return LSP_CLIENT_ROOT, nil
+	}
+	u, err := url.Parse(root)
+	if err != nil || u.Scheme != "file" || u.Path == "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("root must be a file:// URI")
+	}
+	return strings.TrimSuffix(root, "/"), nil
+}
+
+// readLSPMessage reads one Content-Length framed message from a language server
+func readLSPMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("invalid Content-Length %q", value)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("message without Content-Length")
+	}
+	if length > LSP_MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("message of %d bytes is over the %d byte limit", length, LSP_MAX_MESSAGE_SIZE)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func writeLSPMessage(w io.Writer, message []byte) error {
+	if _, err := fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(message)); err != nil {
+		return err
+	}
+	_, err := w.Write(message)
+	return err
+}
+
+// languageServer is a server process started for one connection
+type languageServer struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	exited chan struct{}
+}
+
+func startLanguageServer(command []string) (*languageServer, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = WorkspaceFS.Root()
+	cmd.Env = os.Environ()
+	// Whatever the server logs is kept for debugging, the protocol is on stdout
+	cmd.Stderr = &lspLogWriter{name: command[0]}
+	cmd.WaitDelay = LSP_SHUTDOWN_GRACE
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	server := &languageServer{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReaderSize(stdout, 64*1024),
+		exited: make(chan struct{}),
+	}
+	go func() {
+		err := cmd.Wait()
+		log.Printf("Language server %s exited: %v", command[0], err)
+		close(server.exited)
+	}()
+	return server, nil
+}
+
+// stop closes stdin, which tells well behaved servers to exit, and kills
+// the process when it does not within LSP_SHUTDOWN_GRACE
+func (s *languageServer) stop() {
+	s.stdin.Close()
+	select {
+	case <-s.exited:
+	case <-time.After(LSP_SHUTDOWN_GRACE):
+		s.cmd.Process.Kill()
+		<-s.exited
+	}
+}
+
+// lspLogWriter logs the stderr of a language server line by line
+type lspLogWriter struct {
+	name string
+	mu   sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (w *lspLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep the partial line for the next write
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			break
+		}
+		log.Printf("[%s] %s", w.name, strings.TrimRight(line, "\n"))
+	}
+	return len(p), nil
+}
+
+// LSPHandler bridges a WebSocket to a language server for the lab's
+// language. Every text message is one JSON-RPC message, the runner adds and
+// strips the stdio framing and rewrites workspace URIs in both directions.
+//
+//	root      URI the browser uses for the workspace, file:///workspace by default
+//	language  the lab language, only needed when the pod was not deployed with one
+func LSPHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+	session := podSession(claims)
+	if session == nil {
+		var err error
+		query := r.URL.Query()
+		if session, err = newClientSession(InitializeClient{LabID: query.Get("labId"), Language: query.Get("language")}, claims); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	command := getLanguageTools(session.Language).LanguageServer
+	if len(command) == 0 {
+		http.Error(w, "no language server is configured for "+session.Language+" labs", http.StatusNotFound)
+		return
+	}
+	clientRoot, err := getLSPClientRoot(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if lspServers.Add(1) > LSP_MAX_SERVERS {
+		lspServers.Add(-1)
+		http.Error(w, "too many language servers are running, close another editor first", http.StatusServiceUnavailable)
+		return
+	}
+	defer lspServers.Add(-1)
+
+	conn, err := websocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	server, err := startLanguageServer(command)
+	if err != nil {
+		log.Printf("Failed to start language server %s: %v", command[0], err)
+		message := "failed to start " + command[0]
+		if errors.Is(err, exec.ErrNotFound) {
+			message = command[0] + " is not installed in this lab"
+		}
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, message), time.Now().Add(10*time.Second))
+		return
+	}
+	defer server.stop()
+	log.Printf("Started language server %s for %s", command[0], session.Language)
+
+	bridge := &lspBridge{
+		conn:     conn,
+		server:   server,
+		toServer: newURIRewriter(clientRoot, workspaceRootURI()),
+		toClient: newURIRewriter(workspaceRootURI(), clientRoot),
+		outgoing: make(chan []byte, 64),
+		done:     make(chan struct{}),
+	}
+	bridge.run()
+	log.Printf("Language server connection for %s closed", session.Language)
+}
+
+type lspBridge struct {
+	conn     *websocket.Conn
+	server   *languageServer
+	toServer *uriRewriter
+	toClient *uriRewriter
+	outgoing chan []byte
+	done     chan struct{}
+	// The idle timer and every goroutine of the bridge may close it, only the first does
+	closeOnce sync.Once
+}
+
+func (b *lspBridge) run() {
+	go b.readServer()
+	go b.writeMessages()
+	b.readClient()
+}
+
+// close tells the browser why the connection ends, the first reason wins
+func (b *lspBridge) close(code int, reason string) {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		b.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(10*time.Second))
+		b.conn.Close()
+	})
+}
+
+func (b *lspBridge) readClient() {
+	defer b.close(websocket.CloseNormalClosure, "")
+
+	b.conn.SetReadLimit(READ_LIMIT)
+	if err := b.conn.SetReadDeadline(time.Now().Add(PONG_WAIT_DURATION)); err != nil {
+		log.Println(err)
+		return
+	}
+	b.conn.SetPongHandler(func(string) error {
+		return b.conn.SetReadDeadline(time.Now().Add(PONG_WAIT_DURATION))
+	})
+
+	// Pongs keep the connection up, only messages count as activity
+	idle := time.AfterFunc(LSP_IDLE_TIMEOUT, func() {
+		log.Printf("Closing language server connection idle for %s", LSP_IDLE_TIMEOUT)
+		b.close(websocket.CloseGoingAway, "idle")
+	})
+	defer idle.Stop()
+
+	for {
+		_, message, err := b.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure, websocket.CloseAbnormalClosure) {
+				log.Printf("error reading language server message: %v", err)
+			}
+			return
+		}
+		idle.Reset(LSP_IDLE_TIMEOUT)
+		if err := writeLSPMessage(b.server.stdin, b.toServer.rewrite(message)); err != nil {
+			log.Printf("Failed to write to language server: %v", err)
+			return
+		}
+	}
+}
+
+func (b *lspBridge) readServer() {
+	for {
+		message, err := readLSPMessage(b.server.stdout)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+				log.Printf("Failed to read from language server: %v", err)
+			}
+			b.close(websocket.CloseInternalServerErr, "language server exited")
+			return
+		}
+		select {
+		case b.outgoing <- b.toClient.rewrite(message):
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *lspBridge) writeMessages() {
+	ticker := time.NewTicker(PING_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message := <-b.outgoing:
+			b.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := b.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Printf("Error writing language server message: %v", err)
+				b.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+
+		case <-ticker.C:
+			b.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := b.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Printf("Error sending ping: %v", err)
+				b.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+
+		case <-b.done:
+			return
+		}
+	}
+}
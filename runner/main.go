@@ -5,11 +5,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 var (
@@ -18,10 +16,20 @@ var (
 	PING_INTERVAL        = 10 * time.Second
 	PONG_WAIT_DURATION   = PING_INTERVAL * 2
 	READ_LIMIT           = int64(1024 * 1024 * 5) // 5 MB
+	INLINE_CONTENT_LIMIT = int64(1024 * 1024 * 2) // 2 MB, larger files use chunked downloads
+	CHUNK_SIZE           = int64(1024 * 1024)     // 1 MB
+	MAX_UPLOAD_SIZE      = int64(1024 * 1024 * 100)
+	IMPORT_MAX_SIZE      = int64(1024 * 1024 * 500) // uncompressed
+	IMPORT_MAX_ENTRIES   = 10000
+	FS_WATCH_DEBOUNCE    = 250 * time.Millisecond
+	FS_WATCH_MAX_WAIT    = 2 * time.Second
+	FS_WATCH_MAX_BATCH   = 500
 )
 
 func main() {
-	ctx := context.Background()
+	// SIGTERM gives the pod a chance to flush dirty files before it goes away
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
 	// Initialize Redis first
 	InitRedis()
@@ -29,55 +37,82 @@ func main() {
 	if err := InitWorkspaceDir(); err != nil {
 		log.Fatal("Failed to initialize workspace:", err)
 	}
+	if err := InitProtectedPaths(); err != nil {
+		log.Fatal("Failed to load protected paths: ", err)
+	}
+	if err := InitLocalHistory(); err != nil {
+		log.Printf("Failed to initialize local history, file history is disabled: %v", err)
+	}
+	InitSyncManifest()
 
 	fsMux := http.NewServeMux()
 	manager := NewFSManager(ctx)
-	manager.setupHandlers()
-	fsMux.HandleFunc("/fs", manager.serveFS)
+	fsMux.HandleFunc("/fs", whenHydrated(manager.serveFS))
 	fsMux.HandleFunc("/fs/health", func(w http.ResponseWriter, r *http.Request) {
+		// Doubles as the startup probe, the pod only goes ahead once the workspace is in place
+		if !isHydrated() {
+			http.Error(w, "workspace is still loading", http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
+	fsMux.HandleFunc("/fs/archive", whenHydrated(ArchiveHandler))
+	fsMux.HandleFunc("/lsp", whenHydrated(LSPHandler))
 
 	log.Println("File system service starting on :8081")
-	labId := os.Getenv("LAB_ID")
-	UpdateLabInstanceProgress(labId, LabProgressEntry{
-		Timestamp:   time.Now().Unix(),
-		Status:      Active,
-		Message:     "File System Service Started",
-		ServiceName: FILE_SYSTEM_SERVICE,
-	})
+	server := &http.Server{Addr: ":8081", Handler: fsMux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("File system server error: ", err)
+		}
+	}()
 
-	if err := http.ListenAndServe(":8081", fsMux); err != nil {
-		log.Fatal("File system server error: ", err)
+	storage, err := InitStorage()
+	if err != nil {
+		log.Printf("Failed to initialize storage: %v", err)
+	} else {
+		Storage = storage
+	}
+	if err := HydrateWorkspace(ctx, Storage, PodLabID()); err != nil && ctx.Err() == nil {
+		// Exiting lets the container restart and pick up where it stopped
+		log.Fatal("Failed to hydrate workspace: ", err)
+	}
+	if err := Ignore.Reload(); err != nil {
+		log.Printf("Failed to load ignore rules: %v", err)
 	}
-}
 
-func InitS3Client() (*s3.Client, error) {
-	r2AccessKey := os.Getenv("AWS_ACCESS_KEY_ID")
-	r2SecretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-	r2AccountId := os.Getenv("R2_ACCOUNT_ID")
+	Quota = NewWorkspaceQuota(manager)
+	go Quota.Run(ctx)
 
-	r2Endpoint := "https://" + r2AccountId + ".r2.cloudflarestorage.com"
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			r2AccessKey,
-			r2SecretKey,
-			"",
-		)),
-		config.WithRegion("auto"),
-		config.WithBaseEndpoint(r2Endpoint),
-	)
+	// Started after hydration so the downloaded files are not reported as changes
+	watcher, err := NewFSWatcher(manager)
 	if err != nil {
-		log.Printf("FAILED TO INITIALIZE S3 CLIENT: %v", err)
-		return nil, err
+		log.Printf("Failed to start workspace watcher, fs_changed events are disabled: %v", err)
+	} else {
+		go watcher.Run(ctx)
 	}
-	// Create base S3 client
-	svc := s3.NewFromConfig(cfg, func(o *s3.Options) {
-		o.UsePathStyle = true
-	})
 
-	log.Printf("DEBUG: s3 client initialized\n")
+	if Storage == nil {
+		log.Println("Storage is not available, background sync is disabled")
+	} else {
+		Syncer = NewAutoSyncer(manager, Storage)
+		go Syncer.Run(ctx)
+	}
+
+	UpdateLabInstanceProgress(PodLabID(), LabProgressEntry{
+		Timestamp:   time.Now().Unix(),
+		Status:      Active,
+		Message:     "File System Service Started",
+		ServiceName: FILE_SYSTEM_SERVICE,
+	})
 
-	return svc, nil
+	<-ctx.Done()
+	log.Println("Shutting down, flushing dirty files")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), SYNC_SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := Syncer.Flush(shutdownCtx); err != nil {
+		log.Printf("Final sync failed: %v", err)
+	}
+	server.Shutdown(shutdownCtx)
 }
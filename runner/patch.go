@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// applyTextEdits applies range edits to base. Offsets are UTF-16 code units,
+// matching what the browser editor reports, and all refer to the base text.
+func applyTextEdits(base string, edits []TextEdit) (string, error) {
+	units := utf16.Encode([]rune(base))
+
+	sorted := make([]TextEdit, len(edits))
+	copy(sorted, edits)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].From < sorted[j].From })
+
+	out := make([]uint16, 0, len(units))
+	last := 0
+	for _, edit := range sorted {
+		if edit.From < last || edit.To < edit.From || edit.To > len(units) {
+			return "", fmt.Errorf("edit range %d-%d is invalid or overlaps another edit", edit.From, edit.To)
+		}
+		if splitsSurrogatePair(units, edit.From) || splitsSurrogatePair(units, edit.To) {
+			return "", fmt.Errorf("edit range %d-%d splits a character", edit.From, edit.To)
+		}
+		out = append(out, units[last:edit.From]...)
+		out = append(out, utf16.Encode([]rune(edit.Text))...)
+		last = edit.To
+	}
+	out = append(out, units[last:]...)
+
+	return string(utf16.Decode(out)), nil
+}
+
+// splitsSurrogatePair reports whether offset falls between the two halves
+// of a character outside the Basic Multilingual Plane, e.g. an emoji
+func splitsSurrogatePair(units []uint16, offset int) bool {
+	if offset <= 0 || offset >= len(units) {
+		return false
+	}
+	high, low := units[offset-1], units[offset]
+	return high >= 0xd800 && high < 0xdc00 && low >= 0xdc00 && low < 0xe000
+}
+
+type diffHunk struct {
+	oldStart int
+	lines    []string
+}
+
+// parseHunkHeader reads the old start line from "@@ -a,b +c,d @@"
+func parseHunkHeader(header string) (int, error) {
+	fields := strings.Fields(header)
+	if len(fields) < 3 || !strings.HasPrefix(fields[1], "-") {
+		return 0, fmt.Errorf("malformed hunk header %q", header)
+	}
+	start, _, _ := strings.Cut(strings.TrimPrefix(fields[1], "-"), ",")
+	oldStart, err := strconv.Atoi(start)
+	if err != nil {
+		return 0, fmt.Errorf("malformed hunk header %q", header)
+	}
+	return oldStart, nil
+}
+
+func parseUnifiedDiff(diff string) ([]diffHunk, error) {
+	var hunks []diffHunk
+	for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "@@"):
+			oldStart, err := parseHunkHeader(line)
+			if err != nil {
+				return nil, err
+			}
+			hunks = append(hunks, diffHunk{oldStart: oldStart})
+		case len(hunks) == 0:
+			// File headers (diff, index, ---, +++) before the first hunk
+		case line == "" || line[0] == ' ' || line[0] == '-' || line[0] == '+' || line[0] == '\\':
+			current := &hunks[len(hunks)-1]
+			current.lines = append(current.lines, line)
+		default:
+			return nil, fmt.Errorf("unexpected line in diff %q", line)
+		}
+	}
+	if len(hunks) == 0 {
+		return nil, fmt.Errorf("diff contains no hunks")
+	}
+	return hunks, nil
+}
+
+// applyUnifiedDiff applies a unified diff to base, every context and removed
+// line has to match exactly
+func applyUnifiedDiff(base, diff string) (string, error) {
+	hunks, err := parseUnifiedDiff(diff)
+	if err != nil {
+		return "", err
+	}
+
+	baseLines := strings.SplitAfter(base, "\n")
+	if baseLines[len(baseLines)-1] == "" {
+		baseLines = baseLines[:len(baseLines)-1]
+	}
+
+	var out []string
+	cursor := 0
+	for _, hunk := range hunks {
+		// A zero start means the hunk inserts before the first line
+		start := hunk.oldStart - 1
+		if hunk.oldStart == 0 {
+			start = 0
+		}
+		if start < cursor || start > len(baseLines) {
+			return "", fmt.Errorf("hunk at line %d is out of order or beyond the end of the file", hunk.oldStart)
+		}
+		out = append(out, baseLines[cursor:start]...)
+		cursor = start
+
+		lastWasRemoval := false
+		for _, line := range hunk.lines {
+			if line == "" {
+				// Some tools strip the space of empty context lines
+				line = " "
+			}
+			prefix, text := line[0], line[1:]
+			switch prefix {
+			case ' ', '-':
+				if cursor >= len(baseLines) || strings.TrimSuffix(baseLines[cursor], "\n") != text {
+					return "", fmt.Errorf("hunk at line %d does not match the file at line %d", hunk.oldStart, cursor+1)
+				}
+				if prefix == ' ' {
+					out = append(out, baseLines[cursor])
+				}
+				cursor++
+				lastWasRemoval = prefix == '-'
+			case '+':
+				out = append(out, text+"\n")
+				lastWasRemoval = false
+			case '\\':
+				// "\ No newline at end of file" applies to the previous line
+				if !lastWasRemoval && len(out) > 0 {
+					out[len(out)-1] = strings.TrimSuffix(out[len(out)-1], "\n")
+				}
+			}
+		}
+	}
+	out = append(out, baseLines[cursor:]...)
+
+	return strings.Join(out, ""), nil
+}
+
+// Apply a patch (range edits or a unified diff) on top of a known file version
+func FilePatchHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req FilePatchPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal file patch payload: %w", err)
+	}
+
+	relPath, err := WorkspaceFS.Clean(req.Path)
+	if err != nil {
+		return err
+	}
+	if err := Protected.CheckWrite(relPath); err != nil {
+		return err
+	}
+	if req.BaseVersion == "" {
+		return newFSError(FS_ERR_INVALID_PATCH, req.Path, "baseVersion is required")
+	}
+	if (len(req.Edits) == 0) == (req.Diff == "") {
+		return newFSError(FS_ERR_INVALID_PATCH, req.Path, "a patch needs either edits or a diff")
+	}
+
+	var previous, patchedContent []byte
+	version, err := WorkspaceFS.UpdateFile(relPath, req.BaseVersion, func(current []byte, exists bool) ([]byte, error) {
+		previous = current
+		if !utf8.Valid(current) {
+			return nil, newFSError(FS_ERR_INVALID_PATCH, req.Path, "binary files cannot be patched")
+		}
+
+		var patched string
+		var err error
+		if req.Diff != "" {
+			patched, err = applyUnifiedDiff(string(current), req.Diff)
+		} else {
+			patched, err = applyTextEdits(string(current), req.Edits)
+		}
+		if err != nil {
+			return nil, &FSError{Code: FS_ERR_INVALID_PATCH, Path: req.Path, Message: "patch could not be applied", Err: err}
+		}
+		patchedContent = []byte(patched)
+		if err := Quota.Check(relPath, int64(len(patchedContent))); err != nil {
+			return nil, err
+		}
+		return patchedContent, nil
+	})
+	if err != nil {
+		return err
+	}
+	History.Record(relPath, HISTORY_ACTION_EDIT, previous, true, patchedContent, false)
+
+	client.Session().MarkDirty(relPath, "edit")
+	log.Printf("Patched file at path: %s", relPath)
+
+	return client.Reply(ctx, RESPONSE_FILE_PATCHED, map[string]interface{}{
+		"path":    req.Path,
+		"version": version,
+		"success": true,
+	})
+}
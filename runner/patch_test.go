@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyTextEdits(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		edits   []TextEdit
+		want    string
+		wantErr string
+	}{
+		{"insert", "hello world", []TextEdit{{From: 5, To: 5, Text: ","}}, "hello, world", ""},
+		{"replace", "hello world", []TextEdit{{From: 6, To: 11, Text: "there"}}, "hello there", ""},
+		{"delete", "hello world", []TextEdit{{From: 5, To: 11}}, "hello", ""},
+		{"no edits", "hello", nil, "hello", ""},
+		{"empty base", "", []TextEdit{{From: 0, To: 0, Text: "new"}}, "new", ""},
+		{"offsets refer to the base", "abcdef", []TextEdit{{From: 4, To: 5, Text: "EE"}, {From: 0, To: 1, Text: "AAA"}}, "AAAbcdEEf", ""},
+		{"adjacent edits", "abc", []TextEdit{{From: 0, To: 1, Text: "x"}, {From: 1, To: 2, Text: "y"}}, "xyc", ""},
+		// Characters outside the BMP take two UTF-16 code units
+		{"after an emoji", "a😀b", []TextEdit{{From: 3, To: 4, Text: "B"}}, "a😀B", ""},
+		{"replace an emoji", "a😀b", []TextEdit{{From: 1, To: 3, Text: "🎉"}}, "a🎉b", ""},
+		{"multi byte but one unit", "é!", []TextEdit{{From: 1, To: 2, Text: "?"}}, "é?", ""},
+		{"splits an emoji", "a😀b", []TextEdit{{From: 2, To: 2, Text: "x"}}, "", "splits a character"},
+		{"ends inside an emoji", "a😀b", []TextEdit{{From: 0, To: 2}}, "", "splits a character"},
+		{"overlapping", "abcdef", []TextEdit{{From: 0, To: 3}, {From: 2, To: 4}}, "", "overlaps"},
+		{"reversed range", "abc", []TextEdit{{From: 2, To: 1}}, "", "invalid"},
+		{"past the end", "abc", []TextEdit{{From: 2, To: 4}}, "", "invalid"},
+		{"negative", "abc", []TextEdit{{From: -1, To: 1}}, "", "invalid"},
+		{"past the end in bytes only", "😀", []TextEdit{{From: 2, To: 3}}, "", "invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyTextEdits(tt.base, tt.edits)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q; got %q, %v", tt.wantErr, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected the edits to apply; got %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q; got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestApplyUnifiedDiff(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\nfive\n"
+
+	tests := []struct {
+		name    string
+		base    string
+		diff    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "replace a line",
+			base: base,
+			diff: "--- a/f.txt\n+++ b/f.txt\n@@ -2,3 +2,3 @@\n two\n-three\n+THREE\n four\n",
+			want: "one\ntwo\nTHREE\nfour\nfive\n",
+		},
+		{
+			name: "several hunks",
+			base: base,
+			diff: "@@ -1,2 +1,2 @@\n-one\n+ONE\n two\n@@ -4,2 +4,3 @@\n four\n five\n+six\n",
+			want: "ONE\ntwo\nthree\nfour\nfive\nsix\n",
+		},
+		{
+			name: "insert before the first line",
+			base: base,
+			diff: "@@ -0,0 +1 @@\n+zero\n",
+			want: "zero\none\ntwo\nthree\nfour\nfive\n",
+		},
+		{
+			name: "empty context line without its space",
+			base: "a\n\nb\n",
+			diff: "@@ -1,3 +1,3 @@\n a\n\n-b\n+B\n",
+			want: "a\n\nB\n",
+		},
+		{
+			name: "new file",
+			base: "",
+			diff: "@@ -0,0 +1,2 @@\n+a\n+b\n",
+			want: "a\nb\n",
+		},
+		{
+			name: "remove the trailing newline",
+			base: "a\nb\n",
+			diff: "@@ -2 +2 @@\n-b\n+b\n\\ No newline at end of file\n",
+			want: "a\nb",
+		},
+		{
+			name: "add a trailing newline",
+			base: "a\nb",
+			diff: "@@ -2 +2 @@\n-b\n\\ No newline at end of file\n+b\n",
+			want: "a\nb\n",
+		},
+		{
+			name: "keep a missing trailing newline",
+			base: "a\nb",
+			diff: "@@ -1,2 +1,2 @@\n-a\n+A\n b\n\\ No newline at end of file\n",
+			want: "A\nb",
+		},
+		{
+			name:    "context does not match",
+			base:    base,
+			diff:    "@@ -2,2 +2,2 @@\n two\n-THREE\n+3\n",
+			wantErr: "does not match",
+		},
+		{
+			name:    "beyond the end",
+			base:    base,
+			diff:    "@@ -9,1 +9,1 @@\n-nine\n+9\n",
+			wantErr: "beyond the end",
+		},
+		{
+			name:    "hunks out of order",
+			base:    base,
+			diff:    "@@ -4,1 +4,1 @@\n-four\n+4\n@@ -1,1 +1,1 @@\n-one\n+1\n",
+			wantErr: "out of order",
+		},
+		{
+			name:    "no hunks",
+			base:    base,
+			diff:    "--- a/f.txt\n+++ b/f.txt\n",
+			wantErr: "no hunks",
+		},
+		{
+			name:    "malformed header",
+			base:    base,
+			diff:    "@@ two @@\n-two\n",
+			wantErr: "malformed hunk header",
+		},
+		{
+			name:    "unexpected line",
+			base:    base,
+			diff:    "@@ -1 +1 @@\n*one\n",
+			wantErr: "unexpected line",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyUnifiedDiff(tt.base, tt.diff)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q; got %q, %v", tt.wantErr, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected the diff to apply; got %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q; got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// How strongly a path is protected, reported on FileInfo so the IDE can show a lock
+const (
+	PROTECTION_READ_ONLY   = "read_only"
+	PROTECTION_UNDELETABLE = "undeletable"
+)
+
+// ProtectedPaths holds the globs a quest declares for files its checkpoints
+// depend on. Read only paths can neither be changed, deleted nor renamed,
+// undeletable ones can still be edited. A glob protects a directory and
+// everything inside it.
+type ProtectedPaths struct {
+	readOnly    []*Glob
+	undeletable []*Glob
+	response    ProtectedPathsResponse
+}
+
+var Protected = &ProtectedPaths{}
+
+// Split a comma separated list of globs from environment
+func getPathList(name string) []string {
+	patterns := []string{}
+	for _, pattern := range strings.Split(os.Getenv(name), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// InitProtectedPaths loads READ_ONLY_PATHS and UNDELETABLE_PATHS, set by the
+// quest deployment
+func InitProtectedPaths() error {
+	readOnlyPatterns := getPathList("READ_ONLY_PATHS")
+	undeletablePatterns := getPathList("UNDELETABLE_PATHS")
+	readOnly, err := compileGlobs(readOnlyPatterns)
+	if err != nil {
+		return err
+	}
+	undeletable, err := compileGlobs(undeletablePatterns)
+	if err != nil {
+		return err
+	}
+
+	Protected = &ProtectedPaths{
+		readOnly:    readOnly,
+		undeletable: undeletable,
+		response: ProtectedPathsResponse{
+			ReadOnly:    readOnlyPatterns,
+			Undeletable: undeletablePatterns,
+		},
+	}
+	if len(readOnly)+len(undeletable) > 0 {
+		log.Printf("Protecting %d read only and %d undeletable paths", len(readOnly), len(undeletable))
+	}
+	return nil
+}
+
+func (p *ProtectedPaths) active() bool {
+	return len(p.readOnly)+len(p.undeletable) > 0
+}
+
+// matchPath checks a path and every directory above it
+func matchPath(globs []*Glob, relPath string) bool {
+	if len(globs) == 0 {
+		return false
+	}
+	for i := 0; i < len(relPath); i++ {
+		if relPath[i] == '/' && matchAny(globs, relPath[:i]) {
+			return true
+		}
+	}
+	return matchAny(globs, relPath)
+}
+
+// Level returns how a workspace relative path is protected, empty when it is not
+func (p *ProtectedPaths) Level(relPath string) string {
+	relPath = path.Clean(filepath.ToSlash(relPath))
+	if relPath == "." || !p.active() {
+		return ""
+	}
+	if matchPath(p.readOnly, relPath) {
+		return PROTECTION_READ_ONLY
+	}
+	if matchPath(p.undeletable, relPath) {
+		return PROTECTION_UNDELETABLE
+	}
+	return ""
+}
+
+// targetLevel is the protection of where target, an absolute path from
+// Resolve, lands in the workspace. A symlink into a protected directory
+// must not get around the rule, so the checks look at both paths.
+func (p *ProtectedPaths) targetLevel(target string) string {
+	rel, err := WorkspaceFS.Rel(target)
+	if err != nil {
+		return ""
+	}
+	return p.Level(rel)
+}
+
+// CheckWrite refuses to create or change a read only path, or one that
+// resolves to a read only path through a symlink
+func (p *ProtectedPaths) CheckWrite(relPath string) error {
+	if p.Level(relPath) == PROTECTION_READ_ONLY {
+		return newFSError(FS_ERR_PROTECTED, filepath.ToSlash(relPath), "path is read only in this quest")
+	}
+	if !p.active() {
+		return nil
+	}
+	// Paths that do not resolve are refused by the write itself
+	if target, err := WorkspaceFS.Resolve(relPath); err == nil && p.targetLevel(target) == PROTECTION_READ_ONLY {
+		return newFSError(FS_ERR_PROTECTED, filepath.ToSlash(relPath), "path leads to a read only path in this quest")
+	}
+	return nil
+}
+
+// CheckDelete refuses to remove a protected path, or a directory holding one
+func (p *ProtectedPaths) CheckDelete(relPath string) error {
+	if !p.active() {
+		return nil
+	}
+	if p.Level(relPath) != "" {
+		return newFSError(FS_ERR_PROTECTED, filepath.ToSlash(relPath), "path cannot be deleted in this quest")
+	}
+
+	target, err := WorkspaceFS.ResolveNoFollow(relPath)
+	if err != nil {
+		return err
+	}
+	// The final element is removed itself, but a symlinked parent moves it elsewhere
+	if p.targetLevel(target) != "" {
+		return newFSError(FS_ERR_PROTECTED, filepath.ToSlash(relPath), "path leads to a path that cannot be deleted in this quest")
+	}
+	if info, err := os.Lstat(target); err != nil || !info.IsDir() {
+		return nil
+	}
+	return WorkspaceFS.WalkDir(relPath, func(childPath string, d fs.DirEntry) error {
+		if p.Level(childPath) != "" {
+			return newFSError(FS_ERR_PROTECTED, childPath, "directory holds files that cannot be deleted in this quest")
+		}
+		return nil
+	})
+}
+
+// CheckRename treats a move as deleting the old path and writing the new one
+func (p *ProtectedPaths) CheckRename(oldPath, newPath string) error {
+	if err := p.CheckDelete(oldPath); err != nil {
+		return err
+	}
+	return p.CheckWrite(newPath)
+}
+
+// Check applies the rule for a dirty action, "edit" or "delete"
+func (p *ProtectedPaths) Check(relPath, action string) error {
+	if action == "delete" {
+		return p.CheckDelete(relPath)
+	}
+	return p.CheckWrite(relPath)
+}
+
+func (p *ProtectedPaths) Response() ProtectedPathsResponse {
+	return p.response
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProtectedPathsFollowSymlinks(t *testing.T) {
+	root := newTestWorkspace(t, map[string]string{
+		"tests/spec.js": "it()",
+		"src/app.js":    "app",
+	})
+	if err := os.Symlink("tests", filepath.Join(root, "t")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("tests/spec.js", filepath.Join(root, "spec-link.js")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("READ_ONLY_PATHS", "tests/**")
+	t.Setenv("UNDELETABLE_PATHS", "")
+	previous := Protected
+	t.Cleanup(func() { Protected = previous })
+	if err := InitProtectedPaths(); err != nil {
+		t.Fatalf("failed to load protected paths: %v", err)
+	}
+
+	writes := []struct {
+		path    string
+		blocked bool
+	}{
+		{"tests/spec.js", true},
+		{"t/spec.js", true},
+		{"t/new.js", true},
+		{"spec-link.js", true},
+		{"src/app.js", false},
+		{"src/new.js", false},
+	}
+	for _, tt := range writes {
+		err := Protected.CheckWrite(tt.path)
+		if got := isFSErrorCode(err, FS_ERR_PROTECTED); got != tt.blocked {
+			t.Errorf("CheckWrite(%q): expected blocked=%v; got %v", tt.path, tt.blocked, err)
+		}
+	}
+
+	deletes := []struct {
+		path    string
+		blocked bool
+	}{
+		{"t/spec.js", true},
+		// Removing the link itself leaves the protected files alone
+		{"t", false},
+		{"spec-link.js", false},
+	}
+	for _, tt := range deletes {
+		err := Protected.CheckDelete(tt.path)
+		if got := isFSErrorCode(err, FS_ERR_PROTECTED); got != tt.blocked {
+			t.Errorf("CheckDelete(%q): expected blocked=%v; got %v", tt.path, tt.blocked, err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// Kept below the 2Gi sizeLimit of the workspace volume, going over that evicts the pod
+	QUOTA_MAX_BYTES       = int64(1024 * 1024 * 1800)
+	QUOTA_MAX_FILE_SIZE   = MAX_UPLOAD_SIZE
+	QUOTA_MAX_FILES       = int64(50000)
+	QUOTA_RESCAN_DEBOUNCE = 2 * time.Second
+	// Ignored directories are not watched, a periodic scan catches what the terminal writes there
+	QUOTA_RESCAN_INTERVAL = time.Minute
+)
+
+// Get a quota limit from environment, e.g. WORKSPACE_QUOTA_BYTES=1073741824
+func getQuotaLimit(name string, fallback int64) int64 {
+	if limit, err := strconv.ParseInt(os.Getenv(name), 10, 64); err == nil && limit > 0 {
+		return limit
+	}
+	return fallback
+}
+
+// WorkspaceQuota enforces soft limits on what the runner writes into the
+// workspace. Usage comes from a scan of the workspace, kept current by the
+// writes counted against it and rescans after the watcher sees a change.
+// Writes made outside the runner, e.g. from the terminal, are not stopped,
+// they only show up in the usage.
+type WorkspaceQuota struct {
+	manager     *WSManager
+	maxBytes    int64
+	maxFiles    int64
+	maxFileSize int64
+
+	mu    sync.Mutex
+	bytes int64
+	files int64
+	// staged counts uploads still held outside the workspace, rescans do not see them
+	staged    int64
+	scanned   bool
+	timer     *time.Timer
+	published QuotaUsage
+}
+
+var Quota *WorkspaceQuota
+
+func NewWorkspaceQuota(manager *WSManager) *WorkspaceQuota {
+	return &WorkspaceQuota{
+		manager:     manager,
+		maxBytes:    getQuotaLimit("WORKSPACE_QUOTA_BYTES", QUOTA_MAX_BYTES),
+		maxFiles:    getQuotaLimit("WORKSPACE_QUOTA_FILES", QUOTA_MAX_FILES),
+		maxFileSize: getQuotaLimit("WORKSPACE_QUOTA_FILE_SIZE", QUOTA_MAX_FILE_SIZE),
+	}
+}
+
+// scanWorkspaceUsage counts every file in the workspace, ignored or not, they
+// all take up space on the volume
+func scanWorkspaceUsage() (int64, int64, error) {
+	var bytes, files int64
+	err := filepath.WalkDir(WorkspaceFS.Root(), func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files++
+		if info.Mode().IsRegular() {
+			bytes += info.Size()
+		}
+		return nil
+	})
+	return bytes, files, err
+}
+
+// usageLocked must be called with q.mu held
+func (q *WorkspaceQuota) usageLocked() QuotaUsage {
+	return QuotaUsage{
+		Bytes:       q.bytes,
+		Files:       q.files,
+		MaxBytes:    q.maxBytes,
+		MaxFiles:    q.maxFiles,
+		MaxFileSize: q.maxFileSize,
+		Exceeded:    q.bytes > q.maxBytes || q.files > q.maxFiles,
+	}
+}
+
+func (q *WorkspaceQuota) Usage() (QuotaUsage, error) {
+	if err := q.ensureScanned(); err != nil {
+		return QuotaUsage{}, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usageLocked(), nil
+}
+
+func (q *WorkspaceQuota) ensureScanned() error {
+	q.mu.Lock()
+	scanned := q.scanned
+	q.mu.Unlock()
+	if scanned {
+		return nil
+	}
+	return q.Rescan()
+}
+
+// Rescan recounts the workspace and tells clients when the usage changed
+func (q *WorkspaceQuota) Rescan() error {
+	bytes, files, err := scanWorkspaceUsage()
+	if err != nil {
+		return fmt.Errorf("failed to scan workspace usage: %w", err)
+	}
+	q.mu.Lock()
+	q.bytes, q.files, q.scanned = bytes, files, true
+	usage := q.usageLocked()
+	q.mu.Unlock()
+	q.publish(usage, false)
+	return nil
+}
+
+// publish broadcasts the usage, unless it is what clients were last told
+func (q *WorkspaceQuota) publish(usage QuotaUsage, force bool) {
+	q.mu.Lock()
+	if !force && usage == q.published {
+		q.mu.Unlock()
+		return
+	}
+	q.published = usage
+	q.mu.Unlock()
+	q.manager.Broadcast(RESPONSE_QUOTA_USAGE, usage)
+}
+
+// Invalidate schedules a rescan once the workspace settles
+func (q *WorkspaceQuota) Invalidate() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.timer != nil {
+		return
+	}
+	q.timer = time.AfterFunc(QUOTA_RESCAN_DEBOUNCE, func() {
+		q.mu.Lock()
+		q.timer = nil
+		q.mu.Unlock()
+		if err := q.Rescan(); err != nil {
+			log.Printf("Quota rescan failed: %v", err)
+		}
+	})
+}
+
+func (q *WorkspaceQuota) Run(ctx context.Context) {
+	if err := q.Rescan(); err != nil {
+		log.Printf("Quota scan failed: %v", err)
+	}
+	ticker := time.NewTicker(QUOTA_RESCAN_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := q.Rescan(); err != nil {
+				log.Printf("Quota rescan failed: %v", err)
+			}
+		}
+	}
+}
+
+// Check fails with a quota error when writing size bytes to relPath would
+// take the workspace over one of its limits, and counts the write otherwise
+func (q *WorkspaceQuota) Check(relPath string, size int64) error {
+	return q.CheckStaged(relPath, size, 0)
+}
+
+// CheckStaged is Check for content counted by Stage before, the staged
+// bytes are released when the write is counted
+func (q *WorkspaceQuota) CheckStaged(relPath string, size, staged int64) error {
+	if q == nil {
+		return nil
+	}
+	if size > q.maxFileSize {
+		return newFSError(FS_ERR_QUOTA_EXCEEDED, relPath, fmt.Sprintf("files are limited to %d bytes", q.maxFileSize))
+	}
+
+	var previous int64
+	files := int64(1)
+	if target, err := WorkspaceFS.Resolve(relPath); err == nil {
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			previous = info.Size()
+			files = 0
+		}
+	}
+	return q.reserve(relPath, size-previous, files, staged)
+}
+
+// Reserve counts bytes and files about to be added under relPath against the
+// quota. A write that fails afterwards is corrected by the next rescan.
+func (q *WorkspaceQuota) Reserve(relPath string, bytes, files int64) error {
+	return q.reserve(relPath, bytes, files, 0)
+}
+
+func (q *WorkspaceQuota) reserve(relPath string, bytes, files, staged int64) error {
+	if q == nil {
+		return nil
+	}
+	if err := q.ensureScanned(); err != nil {
+		// The quota is soft, a workspace that cannot be scanned is not locked
+		log.Printf("Skipping quota check for %s: %v", relPath, err)
+		q.Unstage(staged)
+		return nil
+	}
+
+	q.mu.Lock()
+	inUse := q.bytes + max(q.staged-staged, 0)
+	// Writes that shrink the workspace always go through, they are how a user gets back under the quota
+	var err error
+	switch {
+	case bytes > 0 && inUse+bytes > q.maxBytes:
+		err = newFSError(FS_ERR_QUOTA_EXCEEDED, relPath, fmt.Sprintf("workspace is limited to %d bytes, %d are in use", q.maxBytes, inUse))
+	case files > 0 && q.files+files > q.maxFiles:
+		err = newFSError(FS_ERR_QUOTA_EXCEEDED, relPath, fmt.Sprintf("workspace is limited to %d files, %d are in use", q.maxFiles, q.files))
+	default:
+		q.bytes += bytes
+		q.files += files
+		q.staged = max(q.staged-staged, 0)
+	}
+	usage := q.usageLocked()
+	q.mu.Unlock()
+
+	// Accepted writes are reported by the rescan that follows them
+	if err != nil {
+		q.publish(usage, true)
+	}
+	return err
+}
+
+// Stage counts bytes held outside the workspace for relPath, e.g. a chunked
+// upload, against the byte limit until CheckStaged or Unstage releases them
+func (q *WorkspaceQuota) Stage(relPath string, bytes int64) error {
+	if q == nil || bytes <= 0 {
+		return nil
+	}
+	if bytes > q.maxFileSize {
+		return newFSError(FS_ERR_QUOTA_EXCEEDED, relPath, fmt.Sprintf("files are limited to %d bytes", q.maxFileSize))
+	}
+	if err := q.ensureScanned(); err != nil {
+		log.Printf("Skipping quota check for %s: %v", relPath, err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if inUse := q.bytes + q.staged; inUse+bytes > q.maxBytes {
+		return newFSError(FS_ERR_QUOTA_EXCEEDED, relPath, fmt.Sprintf("workspace is limited to %d bytes, %d are in use or being uploaded", q.maxBytes, inUse))
+	}
+	q.staged += bytes
+	return nil
+}
+
+// Unstage releases bytes counted by Stage that never made it into the workspace
+func (q *WorkspaceQuota) Unstage(bytes int64) {
+	if q == nil || bytes <= 0 {
+		return
+	}
+	q.mu.Lock()
+	q.staged = max(q.staged-bytes, 0)
+	q.mu.Unlock()
+}
+
+// Report the current workspace usage
+func QuotaStatusHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	if Quota == nil {
+		return newFSError(FS_ERR_IO, "", "workspace quotas are not available")
+	}
+	usage, err := Quota.Usage()
+	if err != nil {
+		return err
+	}
+	return client.Reply(ctx, RESPONSE_QUOTA_USAGE, usage)
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -13,6 +16,8 @@ import (
 var (
 	RedisClient *redis.Client
 	Context     context.Context
+	// Hydration progress outlives the boot it describes only long enough to debug it
+	HYDRATION_PROGRESS_TTL = 24 * time.Hour
 )
 
 type LabProgressEntry struct {
@@ -43,8 +48,9 @@ const (
 )
 
 type DirtyFileEntry struct {
-	Path   string `json:"path"`
-	Action string `json:"action"` // "edit" or "delete"
+	Path    string `json:"path"`
+	Action  string `json:"action"` // "edit" or "delete"
+	version string // version of the mark the entry was read at
 }
 
 type DevsArenaRunnerError struct {
@@ -68,10 +74,10 @@ type LabInstanceEntry struct {
 	CreatedAt        int64
 	CodeLink         string
 	Language         string
-	DirtyReadPaths   []DirtyFileEntry
 	Status           LabStatus
 	ActiveCheckpoint int `json:"activeCheckpoint"`
 	LastUpdatedAt    int64
+	UserId           string
 	TestResults      []DevsArenaRunnerResult `json:"testResults"`
 	ProgressLogs     []LabProgressEntry
 }
@@ -141,6 +147,33 @@ func UpdateLabInstanceProgress(labID string, progress LabProgressEntry) {
 	log.Printf("Lab instance %s progress updated", labID)
 }
 
+// Hydration progress is a list of its own per lab, the server rewrites the
+// lab_instances blob while the pod boots and would drop entries appended to it
+func hydrationProgressKey(labID string) string {
+	return "lab_hydration_progress:" + labID
+}
+
+// AppendLabHydrationProgress pushes a progress entry in a single atomic RPUSH
+func AppendLabHydrationProgress(labID string, progress LabProgressEntry) {
+	if RedisClient == nil {
+		log.Printf("Redis client is not initialized, dropping hydration progress for lab %s", labID)
+		return
+	}
+	data, err := json.Marshal(progress)
+	if err != nil {
+		log.Printf("Failed to marshal hydration progress: %v", err)
+		return
+	}
+
+	key := hydrationProgressKey(labID)
+	pipe := RedisClient.TxPipeline()
+	pipe.RPush(Context, key, data)
+	pipe.Expire(Context, key, HYDRATION_PROGRESS_TTL)
+	if _, err := pipe.Exec(Context); err != nil {
+		log.Printf("Failed to append hydration progress for lab %s: %v", labID, err)
+	}
+}
+
 // UpdateLabMonitorQueue updates the updatedAt field for a lab in the lab_monitor queue
 func UpdateLabMonitorQueue(labID string) {
 	if RedisClient == nil {
@@ -190,93 +223,113 @@ func UpdateLabMonitorQueue(labID string) {
 
 	log.Printf("Lab %s not found in monitor queue, skipping update", labID)
 }
-func UpdateLabInstanceDirtyWrites(labID string, filePath string, action string) {
-	if RedisClient == nil {
-		log.Fatalf("Redis client is not initialized")
-	}
 
-	data, err := RedisClient.HGet(Context, "lab_instances", labID).Result()
-	if err != nil {
-		log.Printf("Failed to fetch lab instance %s: %v", labID, err)
-		return
-	}
+// Dirty paths live in a hash of their own per lab, path -> "<version>:<action>",
+// so they are never part of the lab_instances blob other services rewrite.
+// Every mark takes a new version from the lab's counter, a synced entry is
+// only cleared when its version is still the one that was synced.
+func dirtyPathsKey(labID string) string {
+	return "lab_dirty_paths:" + labID
+}
 
-	var instance LabInstanceEntry
-	if err := json.Unmarshal([]byte(data), &instance); err != nil {
-		log.Printf("Failed to unmarshal lab instance: %v", err)
-		return
-	}
+func dirtyVersionKey(labID string) string {
+	return "lab_dirty_version:" + labID
+}
 
-	found := false
-	for i, entry := range instance.DirtyReadPaths {
-		if entry.Path == filePath {
-			instance.DirtyReadPaths[i].Action = action
-			found = true
-			break
-		}
+// KEYS: dirty paths, version counter. ARGV: path, action pairs.
+var markDirtyScript = redis.NewScript(`
+for i = 1, #ARGV, 2 do
+	local version = redis.call('INCR', KEYS[2])
+	redis.call('HSET', KEYS[1], ARGV[i], version .. ':' .. ARGV[i + 1])
+end
+return #ARGV / 2
+`)
+
+// KEYS: dirty paths. ARGV: path, value pairs as read by the snapshot.
+var clearDirtyScript = redis.NewScript(`
+local cleared = 0
+for i = 1, #ARGV, 2 do
+	if redis.call('HGET', KEYS[1], ARGV[i]) == ARGV[i + 1] then
+		redis.call('HDEL', KEYS[1], ARGV[i])
+		cleared = cleared + 1
+	end
+end
+return cleared
+`)
+
+func markDirtyPaths(labID string, pathActions ...string) error {
+	if RedisClient == nil {
+		return fmt.Errorf("redis client is not initialized")
 	}
-
-	if !found {
-		instance.DirtyReadPaths = append(instance.DirtyReadPaths, DirtyFileEntry{
-			Path:   filePath,
-			Action: action,
-		})
+	keys := []string{dirtyPathsKey(labID), dirtyVersionKey(labID)}
+	args := make([]interface{}, len(pathActions))
+	for i, arg := range pathActions {
+		args[i] = arg
 	}
-
-	instance.LastUpdatedAt = time.Now().Unix()
-	saveInstance(labID, instance)
+	return markDirtyScript.Run(Context, RedisClient, keys, args...).Err()
 }
 
-// 4. NEW: Function to handle Rename specifically
-func UpdateLabInstanceDirtyRename(labID string, oldPath string, newPath string) {
-	if RedisClient == nil {
+func UpdateLabInstanceDirtyWrites(labID string, filePath string, action string) {
+	if err := markDirtyPaths(labID, filePath, action); err != nil {
+		log.Printf("Failed to mark %s dirty for lab %s: %v", filePath, labID, err)
 		return
 	}
+	Syncer.Notify()
+}
 
-	data, err := RedisClient.HGet(Context, "lab_instances", labID).Result()
-	if err != nil {
+// UpdateLabInstanceDirtyRename marks the old path for deletion and the new
+// one for upload in a single step. The old path may have been synced before
+// it was edited, so it is deleted even when it was already dirty.
+func UpdateLabInstanceDirtyRename(labID string, oldPath string, newPath string) {
+	if err := markDirtyPaths(labID, oldPath, "delete", newPath, "edit"); err != nil {
+		log.Printf("Failed to mark rename of %s for lab %s: %v", oldPath, labID, err)
 		return
 	}
+	Syncer.Notify()
+}
 
-	var instance LabInstanceEntry
-	if err := json.Unmarshal([]byte(data), &instance); err != nil {
-		return
+// GetLabInstanceDirtyPaths reads the lab's dirty paths in one HGETALL, a
+// consistent snapshot even while writes keep coming in
+func GetLabInstanceDirtyPaths(labID string) ([]DirtyFileEntry, error) {
+	if RedisClient == nil {
+		return nil, fmt.Errorf("redis client is not initialized")
+	}
+	fields, err := RedisClient.HGetAll(Context, dirtyPathsKey(labID)).Result()
+	if err != nil {
+		return nil, err
 	}
 
-	found := false
-	for i, entry := range instance.DirtyReadPaths {
-		if entry.Path == oldPath {
-			instance.DirtyReadPaths[i].Path = newPath
-			// We keep the previous action (likely "edit") or force "edit"
-			instance.DirtyReadPaths[i].Action = "edit"
-			found = true
-			break
+	entries := make([]DirtyFileEntry, 0, len(fields))
+	for path, value := range fields {
+		version, action, ok := strings.Cut(value, ":")
+		if !ok {
+			log.Printf("Skipping malformed dirty entry %s=%q", path, value)
+			continue
 		}
+		entries = append(entries, DirtyFileEntry{Path: path, Action: action, version: version})
 	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
 
-	if !found {
-		// Was clean on S3, so we need to delete old and upload new
-		instance.DirtyReadPaths = append(instance.DirtyReadPaths,
-			DirtyFileEntry{Path: oldPath, Action: "delete"},
-			DirtyFileEntry{Path: newPath, Action: "edit"},
-		)
+// ClearLabInstanceDirtyPaths removes synced entries from the dirty paths.
+// Entries marked again since the snapshot have a new version and stay.
+func ClearLabInstanceDirtyPaths(labID string, synced []DirtyFileEntry) error {
+	if RedisClient == nil {
+		return fmt.Errorf("redis client is not initialized")
+	}
+	if len(synced) == 0 {
+		return nil
 	}
 
-	instance.LastUpdatedAt = time.Now().Unix()
-	saveInstance(labID, instance)
-}
-
-// Helper to save instance back to Redis
-func saveInstance(labID string, instance LabInstanceEntry) {
-	updatedData, err := json.Marshal(instance)
-	if err != nil {
-		log.Printf("Failed to marshal lab instance: %v", err)
-		return
+	args := make([]interface{}, 0, len(synced)*2)
+	for _, entry := range synced {
+		args = append(args, entry.Path, entry.version+":"+entry.Action)
 	}
-	err = RedisClient.HSet(Context, "lab_instances", labID, updatedData).Err()
-	if err != nil {
-		log.Printf("Failed to update lab instance %s: %v", labID, err)
+	if err := clearDirtyScript.Run(Context, RedisClient, []string{dirtyPathsKey(labID)}, args...).Err(); err != nil {
+		return fmt.Errorf("failed to clear synced paths for lab %s: %w", labID, err)
 	}
+	return nil
 }
 
 func GetLabInstance(labID string) (*LabInstanceEntry, error) {
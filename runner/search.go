@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	SEARCH_PAGE_SIZE     = 100
+	SEARCH_DEFAULT_LIMIT = 2000
+	SEARCH_MAX_LIMIT     = 10000
+	SEARCH_MAX_FILE_SIZE = int64(1024 * 1024) // 1 MB
+	SEARCH_PREVIEW_LIMIT = 500
+)
+
+var errSearchLimitReached = errors.New("search result limit reached")
+
+type searchRun struct {
+	id      string
+	matcher *regexp.Regexp
+	include []*Glob
+	exclude []*Glob
+	// Ignored paths are skipped unless the client asks for them
+	useIgnore bool
+	limit     int
+	client    *Client
+	page      []SearchMatch
+	matches   int
+	files     int
+	truncated bool
+}
+
+func buildSearchMatcher(req SearchPayload) (*regexp.Regexp, error) {
+	expr := req.Query
+	if !req.IsRegex {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if req.WholeWord {
+		expr = `\b(?:` + expr + `)\b`
+	}
+	if !req.CaseSensitive {
+		expr = "(?i)" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+// Search the workspace for text, matches are streamed back in pages
+func SearchHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req SearchPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal search payload: %w", err)
+	}
+	if req.Query == "" {
+		return fmt.Errorf("search query is empty")
+	}
+
+	matcher, err := buildSearchMatcher(req)
+	if err != nil {
+		return fmt.Errorf("invalid search query: %w", err)
+	}
+	include, err := compileGlobs(req.Include)
+	if err != nil {
+		return err
+	}
+	exclude, err := compileGlobs(req.Exclude)
+	if err != nil {
+		return err
+	}
+	if _, err := WorkspaceFS.Resolve(req.Path); err != nil {
+		return err
+	}
+
+	limit := req.MaxResults
+	if limit <= 0 {
+		limit = SEARCH_DEFAULT_LIMIT
+	}
+	if limit > SEARCH_MAX_LIMIT {
+		limit = SEARCH_MAX_LIMIT
+	}
+
+	searchID, err := newRandomID()
+	if err != nil {
+		return fmt.Errorf("failed to generate search id: %w", err)
+	}
+	run := &searchRun{
+		id:        searchID,
+		matcher:   matcher,
+		include:   include,
+		exclude:   exclude,
+		useIgnore: !req.IncludeIgnored,
+		limit:     limit,
+		client:    client,
+	}
+
+	searchCtx, ok := client.startTask(ctx, searchID)
+	if !ok {
+		return fmt.Errorf("client is closing")
+	}
+	if err := client.Reply(ctx, RESPONSE_SEARCH_STARTED, map[string]string{"searchId": searchID}); err != nil {
+		client.finishTask(searchID)
+		return err
+	}
+
+	// Walk in the background so the connection keeps serving other requests
+	go func() {
+		defer client.finishTask(searchID)
+		run.walk(searchCtx, req.Path)
+	}()
+	return nil
+}
+
+func (r *searchRun) walk(ctx context.Context, root string) {
+	err := WorkspaceFS.WalkDir(root, func(relPath string, d fs.DirEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if r.useIgnore && Ignore.IgnoredEntry(relPath, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if relPath != "." && matchAny(r.exclude, relPath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || matchAny(r.exclude, relPath) {
+			return nil
+		}
+		if len(r.include) > 0 && !matchAny(r.include, relPath) {
+			return nil
+		}
+		return r.searchFile(ctx, relPath)
+	})
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		log.Printf("Search %s cancelled", r.id)
+		return
+	case errors.Is(err, errSearchLimitReached):
+		r.truncated = true
+	case err != nil:
+		log.Printf("Search %s failed: %v", r.id, err)
+		r.client.ReplyError(ctx, err)
+		return
+	}
+	r.flush(ctx, true)
+}
+
+func (r *searchRun) searchFile(ctx context.Context, relPath string) error {
+	file, err := WorkspaceFS.Open(relPath)
+	if err != nil {
+		// Files can disappear or be unreadable while walking, skip them
+		return nil
+	}
+	defer file.Close()
+
+	if info, err := file.Stat(); err != nil || info.Size() > SEARCH_MAX_FILE_SIZE {
+		return nil
+	}
+
+	reader := bufio.NewReader(file)
+	head, _ := reader.Peek(8000)
+	if bytes.IndexByte(head, 0) != -1 {
+		// Binary file
+		return nil
+	}
+	r.files++
+
+	lineNumber := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			lineNumber++
+			if err := r.matchLine(ctx, relPath, lineNumber, line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func (r *searchRun) matchLine(ctx context.Context, relPath string, lineNumber int, line string) error {
+	line = strings.TrimRight(line, "\r\n")
+	for _, loc := range r.matcher.FindAllStringIndex(line, -1) {
+		if loc[0] == loc[1] {
+			continue
+		}
+		if r.matches >= r.limit {
+			return errSearchLimitReached
+		}
+
+		preview := line
+		if len(preview) > SEARCH_PREVIEW_LIMIT {
+			preview = preview[:SEARCH_PREVIEW_LIMIT]
+		}
+		r.page = append(r.page, SearchMatch{
+			Path:    relPath,
+			Line:    lineNumber,
+			Column:  utf8.RuneCountInString(line[:loc[0]]) + 1,
+			Length:  utf8.RuneCountInString(line[loc[0]:loc[1]]),
+			Preview: preview,
+		})
+		r.matches++
+
+		if len(r.page) >= SEARCH_PAGE_SIZE {
+			if err := r.flush(ctx, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flush sends the pending page, blocking while the client's send buffer is full
+func (r *searchRun) flush(ctx context.Context, done bool) error {
+	response := SearchResultsResponse{
+		SearchID:      r.id,
+		Matches:       r.page,
+		TotalMatches:  r.matches,
+		FilesSearched: r.files,
+		Done:          done,
+		Truncated:     r.truncated,
+	}
+	r.page = nil
+	return r.client.ReplyWait(ctx, RESPONSE_SEARCH_RESULTS, response)
+}
+
+// Cancel a running search
+func SearchCancelHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req SearchCancelPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal search cancel payload: %w", err)
+	}
+
+	cancelled := client.cancelTask(req.SearchID)
+	return client.Reply(ctx, RESPONSE_SEARCH_CANCELLED, map[string]interface{}{
+		"searchId":  req.SearchID,
+		"cancelled": cancelled,
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Where the identity of a session came from
+const (
+	SESSION_SOURCE_ENV    = "env"
+	SESSION_SOURCE_CLIENT = "client"
+)
+
+// Session is the lab a connection works on. It is fixed once set, every
+// handler but fs_initialize_client needs one.
+type Session struct {
+	LabID    string
+	Language string
+	Source   string
+	// UserID and Scope come from the access token, Scope is read write when auth is disabled
+	UserID string
+	Scope  string
+}
+
+// Events that change the workspace, refused on read only sessions
+var WRITE_EVENTS = map[string]bool{
+	FS_FILE_CONTENT_UPDATE: true,
+	FS_NEW_FILE:            true,
+	FS_DELETE_FILE:         true,
+	FS_EDIT_FILE_META:      true,
+	FS_UPLOAD_START:        true,
+	FS_UPLOAD_CHUNK:        true,
+	FS_UPLOAD_COMPLETE:     true,
+	FS_FILE_PATCH:          true,
+	FS_IMPORT_ARCHIVE:      true,
+	GIT_STAGE:              true,
+	GIT_COMMIT:             true,
+	GIT_CHECKOUT:           true,
+	FS_HISTORY_RESTORE:     true,
+	SYNC_FILES_TO_S3:       true,
+}
+
+func isWriteEvent(eventType string) bool {
+	return WRITE_EVENTS[eventType]
+}
+
+// withClaims copies who connected and what they may do onto the session
+func (s *Session) withClaims(claims *LabClaims) *Session {
+	s.Scope = TOKEN_SCOPE_READ_WRITE
+	if claims != nil {
+		s.UserID = claims.UserID
+		s.Scope = claims.Scope
+	}
+	return s
+}
+
+// CanWrite reports whether the session may change the workspace
+func (s *Session) CanWrite() bool {
+	return s.Scope == TOKEN_SCOPE_READ_WRITE
+}
+
+// podLab is the lab a pod deployed without LAB_ID serves, taken from the
+// first session. Dirty paths, sync and hydration all use the one lab.
+var podLab struct {
+	mu sync.Mutex
+	id string
+}
+
+// PodLabID is the lab this runner serves, "" until LAB_ID or a session names it
+func PodLabID() string {
+	if labID := os.Getenv("LAB_ID"); labID != "" {
+		return labID
+	}
+	podLab.mu.Lock()
+	defer podLab.mu.Unlock()
+	return podLab.id
+}
+
+// claimPodLab binds a pod without LAB_ID to the lab of its first session,
+// later sessions must be for the same lab
+func claimPodLab(labID string) error {
+	if podLabID := os.Getenv("LAB_ID"); podLabID != "" {
+		if labID != podLabID {
+			return newFSError(FS_ERR_PERMISSION, "", fmt.Sprintf("this runner serves lab %s", podLabID))
+		}
+		return nil
+	}
+	podLab.mu.Lock()
+	defer podLab.mu.Unlock()
+	if podLab.id == "" {
+		podLab.id = labID
+	}
+	if podLab.id != labID {
+		return newFSError(FS_ERR_PERMISSION, "", fmt.Sprintf("this runner serves lab %s", podLab.id))
+	}
+	return nil
+}
+
+// podSession is the identity the deployment gives the runner, nil when the
+// pod does not carry one and clients have to initialize themselves
+func podSession(claims *LabClaims) *Session {
+	labID := os.Getenv("LAB_ID")
+	language := os.Getenv("LAB_LANGUAGE")
+	if labID == "" || language == "" {
+		return nil
+	}
+	session := &Session{LabID: labID, Language: language, Source: SESSION_SOURCE_ENV}
+	return session.withClaims(claims)
+}
+
+// newClientSession builds a session from what the client sent on init. A
+// pod that knows its lab only accepts clients of that lab.
+func newClientSession(req InitializeClient, claims *LabClaims) (*Session, error) {
+	labID := req.LabID
+	// The token names the lab too, a pod without LAB_ID still only serves that one
+	if claims != nil {
+		if labID != "" && labID != claims.LabID {
+			return nil, newFSError(FS_ERR_PERMISSION, "", fmt.Sprintf("access token is for lab %s", claims.LabID))
+		}
+		labID = claims.LabID
+	}
+	if podLabID := PodLabID(); podLabID != "" {
+		if labID != "" && labID != podLabID {
+			return nil, newFSError(FS_ERR_PERMISSION, "", fmt.Sprintf("this runner serves lab %s", podLabID))
+		}
+		labID = podLabID
+	}
+	language := req.Language
+	if podLanguage := os.Getenv("LAB_LANGUAGE"); podLanguage != "" {
+		language = podLanguage
+	}
+	if labID == "" || language == "" {
+		return nil, newFSError(FS_ERR_NOT_INITIALIZED, "", "labId and language are required")
+	}
+	if strings.Contains(labID, "/") || strings.Contains(language, "/") {
+		return nil, newFSError(FS_ERR_INVALID_PATH, "", "labId and language cannot contain a slash")
+	}
+	if err := claimPodLab(labID); err != nil {
+		return nil, err
+	}
+	session := &Session{LabID: labID, Language: language, Source: SESSION_SOURCE_CLIENT}
+	return session.withClaims(claims), nil
+}
+
+// DirtyPath builds the S3 style dirty path tracked in Redis for a workspace relative path
+func (s *Session) DirtyPath(relPath string) string {
+	return fmt.Sprintf("code/%s/%s/%s", s.Language, s.LabID, filepath.ToSlash(relPath))
+}
+
+// MarkDirty queues a workspace path for the next sync, action is "edit" or "delete"
+func (s *Session) MarkDirty(relPath, action string) {
+	UpdateLabInstanceDirtyWrites(s.LabID, s.DirtyPath(relPath), action)
+}
+
+// MarkRenamed queues a move, the old path is deleted and the new one uploaded
+func (s *Session) MarkRenamed(oldRelPath, newRelPath string) {
+	UpdateLabInstanceDirtyRename(s.LabID, s.DirtyPath(oldRelPath), s.DirtyPath(newRelPath))
+}
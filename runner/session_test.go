@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func resetPodLab(t *testing.T) {
+	t.Helper()
+	podLab.mu.Lock()
+	podLab.id = ""
+	podLab.mu.Unlock()
+	t.Cleanup(func() {
+		podLab.mu.Lock()
+		podLab.id = ""
+		podLab.mu.Unlock()
+	})
+}
+
+func TestPodLabFromFirstSession(t *testing.T) {
+	t.Setenv("LAB_ID", "")
+	t.Setenv("LAB_LANGUAGE", "")
+	resetPodLab(t)
+
+	if id := PodLabID(); id != "" {
+		t.Fatalf("expected no lab before a session; got %q", id)
+	}
+	session, err := newClientSession(InitializeClient{LabID: "lab-1", Language: "node"}, nil)
+	if err != nil {
+		t.Fatalf("expected the first session to be accepted; got %v", err)
+	}
+	if id := PodLabID(); id != session.LabID {
+		t.Fatalf("expected the pod to serve %s; got %q", session.LabID, id)
+	}
+	// Dirty paths, sync and hydration all use one lab, so another is refused
+	if _, err := newClientSession(InitializeClient{LabID: "lab-2", Language: "node"}, nil); !isFSErrorCode(err, FS_ERR_PERMISSION) {
+		t.Fatalf("expected a session for another lab to be refused; got %v", err)
+	}
+	if _, err := newClientSession(InitializeClient{LabID: "lab-1", Language: "node"}, nil); err != nil {
+		t.Fatalf("expected another session for the same lab; got %v", err)
+	}
+}
+
+func TestPodLabFromEnvironment(t *testing.T) {
+	t.Setenv("LAB_ID", "lab-env")
+	t.Setenv("LAB_LANGUAGE", "")
+	resetPodLab(t)
+
+	session, err := newClientSession(InitializeClient{Language: "node"}, nil)
+	if err != nil || session.LabID != "lab-env" {
+		t.Fatalf("expected the session to take LAB_ID; got %+v, %v", session, err)
+	}
+	if _, err := newClientSession(InitializeClient{LabID: "lab-1", Language: "node"}, nil); !isFSErrorCode(err, FS_ERR_PERMISSION) {
+		t.Fatalf("expected another lab to be refused; got %v", err)
+	}
+}
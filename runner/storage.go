@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Backends the runner can keep lab code in, picked with STORAGE_BACKEND
+const (
+	STORAGE_BACKEND_R2    = "r2"
+	STORAGE_BACKEND_S3    = "s3"
+	STORAGE_BACKEND_LOCAL = "local"
+)
+
+var ErrObjectNotFound = errors.New("object not found")
+
+type ObjectInfo struct {
+	Key  string
+	Size int64
+	ETag string // plain md5, or md5 of the part md5s and the part count for multipart uploads
+}
+
+// ObjectStorage is where lab code lives between sessions. Keys are slash
+// separated, a key ending in a slash is a folder marker.
+type ObjectStorage interface {
+	// Put stores size bytes of body under key. The digest is checked by the
+	// backend, content that changed since it was hashed is rejected.
+	Put(ctx context.Context, key string, body io.ReaderAt, digest contentDigest) (etag string, err error)
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	// Delete succeeds for keys that do not exist
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// Storage is nil when no backend could be set up, sync and hydration are off then
+var Storage ObjectStorage
+
+// Get the storage backend from environment, defaults to Cloudflare R2
+func getStorageBackend() string {
+	if backend := os.Getenv("STORAGE_BACKEND"); backend != "" {
+		return strings.ToLower(backend)
+	}
+	return STORAGE_BACKEND_R2
+}
+
+// InitStorage sets up the backend named by STORAGE_BACKEND:
+//   - r2 (default): the R2_ACCOUNT_ID bucket, or STORAGE_ENDPOINT when set
+//   - s3: AWS S3, or any S3 compatible store such as MinIO at STORAGE_ENDPOINT
+//   - local: a directory on disk at STORAGE_LOCAL_DIR, for local development
+func InitStorage() (ObjectStorage, error) {
+	backend := getStorageBackend()
+	var storage ObjectStorage
+	var err error
+	switch backend {
+	case STORAGE_BACKEND_R2, STORAGE_BACKEND_S3:
+		storage, err = NewS3Storage(context.TODO(), backend)
+	case STORAGE_BACKEND_LOCAL:
+		storage, err = NewLocalStorage(os.Getenv("STORAGE_LOCAL_DIR"))
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize %s storage: %w", backend, err)
+	}
+	log.Printf("Using %s storage", backend)
+	return storage, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStorage keeps objects as plain files under a directory, so the runner
+// can be developed without a bucket
+type LocalStorage struct {
+	root string
+}
+
+func NewLocalStorage(root string) (*LocalStorage, error) {
+	if root == "" {
+		return nil, fmt.Errorf("STORAGE_LOCAL_DIR is required")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalStorage{root: root}, nil
+}
+
+// resolve maps a key onto a path below the root
+func (s *LocalStorage) resolve(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(cleaned)), nil
+}
+
+func (s *LocalStorage) Put(ctx context.Context, key string, body io.ReaderAt, digest contentDigest) (string, error) {
+	target, err := s.resolve(key)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".put-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	sum := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, sum), io.NewSectionReader(body, 0, digest.size))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	// Same check the bucket does with the Content-MD5 header
+	if !bytes.Equal(sum.Sum(nil), digest.sum) {
+		return "", fmt.Errorf("content of %s changed while uploading", key)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return "", err
+	}
+	return digest.ETag(), nil
+}
+
+// stat reports a stored file with the etag the bucket would have given it
+func (s *LocalStorage) stat(key, target string) (ObjectInfo, error) {
+	file, err := os.Open(target)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ObjectInfo{}, ErrObjectNotFound
+		}
+		return ObjectInfo{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if info.IsDir() {
+		return ObjectInfo{}, ErrObjectNotFound
+	}
+	digest, err := digestContent(file, info.Size())
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), ETag: digest.ETag()}, nil
+}
+
+func (s *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	target, err := s.resolve(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info, err := s.stat(key, target)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	file, err := os.Open(target)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return file, info, nil
+}
+
+func (s *LocalStorage) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	target, err := s.resolve(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return s.stat(key, target)
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	target, err := s.resolve(key)
+	if err != nil {
+		return err
+	}
+	// A directory only holds other keys, it is not an object itself
+	if info, err := os.Lstat(target); err == nil && info.IsDir() {
+		return nil
+	}
+	if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	// Walk the deepest directory the prefix names, then filter on the rest
+	dir := s.root
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		var err error
+		if dir, err = s.resolve(prefix[:i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".put-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		// Etags are left out, working them out means reading every file
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
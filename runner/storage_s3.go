@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Storage keeps objects in an S3 compatible bucket
+type S3Storage struct {
+	client *s3.Client
+	bucket string
+}
+
+// Get the S3 endpoint from environment, R2 falls back to the account's endpoint
+func getStorageEndpoint(backend string) (string, error) {
+	if endpoint := os.Getenv("STORAGE_ENDPOINT"); endpoint != "" {
+		return endpoint, nil
+	}
+	if backend != STORAGE_BACKEND_R2 {
+		// AWS itself, the SDK resolves the endpoint from the region
+		return "", nil
+	}
+	accountID := os.Getenv("R2_ACCOUNT_ID")
+	if accountID == "" {
+		return "", fmt.Errorf("R2_ACCOUNT_ID or STORAGE_ENDPOINT is required")
+	}
+	return "https://" + accountID + ".r2.cloudflarestorage.com", nil
+}
+
+func NewS3Storage(ctx context.Context, backend string) (*S3Storage, error) {
+	bucket := os.Getenv("AWS_S3_BUCKET_NAME")
+	if bucket == "" {
+		return nil, fmt.Errorf("AWS_S3_BUCKET_NAME is required")
+	}
+	endpoint, err := getStorageEndpoint(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	region := os.Getenv("AWS_DEFAULT_REGION")
+	if region == "" && backend == STORAGE_BACKEND_R2 {
+		region = "auto"
+	}
+	options := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	if accessKey := os.Getenv("AWS_ACCESS_KEY_ID"); accessKey != "" {
+		options = append(options, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			accessKey,
+			os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			"",
+		)))
+	}
+	if endpoint != "" {
+		options = append(options, config.WithBaseEndpoint(endpoint))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		// R2 and MinIO do not serve bucket subdomains
+		o.UsePathStyle = endpoint != ""
+	})
+	return &S3Storage{client: client, bucket: bucket}, nil
+}
+
+func isS3NotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	return errors.As(err, &noSuchKey) || errors.As(err, &notFound)
+}
+
+// The md5 is sent along, so a file that changed since it was hashed is
+// rejected by the bucket
+func (s *S3Storage) Put(ctx context.Context, key string, body io.ReaderAt, digest contentDigest) (string, error) {
+	if len(digest.parts) > 0 {
+		return s.putMultipart(ctx, key, body, digest)
+	}
+	result, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          io.NewSectionReader(body, 0, digest.size),
+		ContentLength: aws.Int64(digest.size),
+		ContentMD5:    aws.String(base64.StdEncoding.EncodeToString(digest.sum)),
+	})
+	if err != nil {
+		return "", err
+	}
+	return normalizeETag(result.ETag), nil
+}
+
+func (s *S3Storage) putMultipart(ctx context.Context, key string, body io.ReaderAt, digest contentDigest) (string, error) {
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	abort := func() {
+		// The sync context may be what failed, the abort still has to go out
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		if _, err := s.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: created.UploadId,
+		}); err != nil {
+			log.Printf("Failed to abort multipart upload of %s: %v", key, err)
+		}
+	}
+
+	completed := make([]types.CompletedPart, 0, len(digest.parts))
+	for i, partSum := range digest.parts {
+		offset := int64(i) * SYNC_PART_SIZE
+		length := min(SYNC_PART_SIZE, digest.size-offset)
+		partNumber := aws.Int32(int32(i + 1))
+
+		part, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(s.bucket),
+			Key:           aws.String(key),
+			UploadId:      created.UploadId,
+			PartNumber:    partNumber,
+			Body:          io.NewSectionReader(body, offset, length),
+			ContentLength: aws.Int64(length),
+			ContentMD5:    aws.String(base64.StdEncoding.EncodeToString(partSum)),
+		})
+		if err != nil {
+			abort()
+			return "", fmt.Errorf("part %d: %w", i+1, err)
+		}
+		completed = append(completed, types.CompletedPart{ETag: part.ETag, PartNumber: partNumber})
+	}
+
+	result, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		abort()
+		return "", err
+	}
+	log.Printf("Uploaded %s in %d parts", key, len(completed))
+	return normalizeETag(result.ETag), nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, ObjectInfo{}, ErrObjectNotFound
+		}
+		return nil, ObjectInfo{}, err
+	}
+	return result.Body, ObjectInfo{Key: key, Size: aws.ToInt64(result.ContentLength), ETag: normalizeETag(result.ETag)}, nil
+}
+
+func (s *S3Storage) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	result, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return ObjectInfo{}, ErrObjectNotFound
+		}
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: aws.ToInt64(result.ContentLength), ETag: normalizeETag(result.ETag)}, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:  aws.ToString(obj.Key),
+				Size: aws.ToInt64(obj.Size),
+				ETag: normalizeETag(obj.ETag),
+			})
+		}
+	}
+	return objects, nil
+}
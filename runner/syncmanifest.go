@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	SYNC_MULTIPART_THRESHOLD = int64(16 * 1024 * 1024) // files above this go up in parts
+	SYNC_PART_SIZE           = int64(8 * 1024 * 1024)
+)
+
+// Outcome of syncing a single dirty path
+const (
+	SYNC_RESULT_UPLOADED = "uploaded"
+	SYNC_RESULT_SKIPPED  = "skipped"
+	SYNC_RESULT_IGNORED  = "ignored"
+	SYNC_RESULT_DELETED  = "deleted"
+)
+
+type syncManifestEntry struct {
+	Hash string `json:"hash"` // md5 of the content
+	ETag string `json:"etag"` // etag the bucket returned for that content
+	Size int64  `json:"size"`
+}
+
+// SyncManifest remembers what was last uploaded for every key, so a file
+// that was saved without changing does not go up again. Entries loaded from
+// disk are checked against the bucket once before they are trusted, the
+// object may have been deleted or replaced while the runner was down.
+type SyncManifest struct {
+	path     string
+	mu       sync.Mutex
+	entries  map[string]syncManifestEntry
+	verified map[string]bool
+	changed  bool
+}
+
+var Manifest *SyncManifest
+
+// Get the sync manifest path from environment, defaults to a file next to the workspace
+func getSyncManifestPath(workspaceRoot string) string {
+	if path := os.Getenv("SYNC_MANIFEST_PATH"); path != "" {
+		return path
+	}
+	return filepath.Join(filepath.Dir(workspaceRoot), "."+filepath.Base(workspaceRoot)+"-sync.json")
+}
+
+// isWritableDir checks a directory by creating a file in it
+func isWritableDir(dir string) bool {
+	probe, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return false
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return true
+}
+
+func InitSyncManifest() {
+	path := getSyncManifestPath(WorkspaceFS.Root())
+	if !isWritableDir(filepath.Dir(path)) {
+		// The parent of the workspace mount is not always writable
+		fallback := filepath.Join(os.TempDir(), "workspace-sync.json")
+		log.Printf("Cannot write sync manifest %s, using %s", path, fallback)
+		path = fallback
+	}
+	Manifest = &SyncManifest{path: path, entries: make(map[string]syncManifestEntry), verified: make(map[string]bool)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read sync manifest %s, starting empty: %v", path, err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &Manifest.entries); err != nil {
+		// Worst case every file is checked against the bucket once more
+		log.Printf("Sync manifest %s is corrupt, starting empty: %v", path, err)
+		Manifest.entries = make(map[string]syncManifestEntry)
+		return
+	}
+	log.Printf("Loaded sync manifest with %d entries", len(Manifest.entries))
+}
+
+func (m *SyncManifest) Lookup(key string) (syncManifestEntry, bool) {
+	if m == nil {
+		return syncManifestEntry{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	return entry, ok
+}
+
+// Verified reports whether the entry for key was checked against the bucket since the runner started
+func (m *SyncManifest) Verified(key string) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.verified[key]
+}
+
+// Set records what the bucket holds for key, as uploaded or checked just now
+func (m *SyncManifest) Set(key string, entry syncManifestEntry) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.verified[key] = true
+	if m.entries[key] != entry {
+		m.entries[key] = entry
+		m.changed = true
+	}
+}
+
+func (m *SyncManifest) Remove(key string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.verified, key)
+	if _, ok := m.entries[key]; ok {
+		delete(m.entries, key)
+		m.changed = true
+	}
+}
+
+// Save writes the manifest out when it changed since the last save
+func (m *SyncManifest) Save() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.changed {
+		return nil
+	}
+
+	data, err := json.Marshal(m.entries)
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write sync manifest: %w", err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("failed to write sync manifest: %w", err)
+	}
+	m.changed = false
+	return nil
+}
+
+// contentDigest holds the md5 of a file, and of each part when it is big
+// enough to go up as a multipart upload
+type contentDigest struct {
+	size  int64
+	sum   []byte
+	parts [][]byte
+}
+
+func digestContent(r io.Reader, size int64) (contentDigest, error) {
+	digest := contentDigest{size: size}
+	whole := md5.New()
+
+	if size <= SYNC_MULTIPART_THRESHOLD {
+		if _, err := io.Copy(whole, r); err != nil {
+			return digest, err
+		}
+		digest.sum = whole.Sum(nil)
+		return digest, nil
+	}
+
+	for offset := int64(0); offset < size; offset += SYNC_PART_SIZE {
+		part := md5.New()
+		if _, err := io.CopyN(io.MultiWriter(whole, part), r, min(SYNC_PART_SIZE, size-offset)); err != nil {
+			return digest, err
+		}
+		digest.parts = append(digest.parts, part.Sum(nil))
+	}
+	digest.sum = whole.Sum(nil)
+	return digest, nil
+}
+
+func (d contentDigest) Hash() string {
+	return hex.EncodeToString(d.sum)
+}
+
+// ETag is what the bucket reports for this content: the plain md5, or the
+// md5 of the part md5s followed by the part count for multipart uploads
+func (d contentDigest) ETag() string {
+	if len(d.parts) == 0 {
+		return d.Hash()
+	}
+	sum := md5.New()
+	for _, part := range d.parts {
+		sum.Write(part)
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum.Sum(nil)), len(d.parts))
+}
+
+func normalizeETag(etag *string) string {
+	if etag == nil {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(*etag, `"`))
+}
+
+// syncUpload uploads a file unless the storage already holds the same content
+func syncUpload(ctx context.Context, storage ObjectStorage, key string, file *os.File) (string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	digest, err := digestContent(io.NewSectionReader(file, 0, info.Size()), info.Size())
+	if err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", key, err)
+	}
+
+	entry, known := Manifest.Lookup(key)
+	known = known && entry.Hash == digest.Hash() && entry.Size == digest.size
+	if known && Manifest.Verified(key) {
+		return SYNC_RESULT_SKIPPED, nil
+	}
+	// Unknown to the manifest, or known from before a restart, ask the storage
+	// before uploading. A deleted or replaced object goes up again, and any
+	// error here only means the file goes up.
+	head, err := storage.Head(ctx, key)
+	if err == nil && (head.ETag == digest.ETag() || known && head.ETag == entry.ETag) {
+		Manifest.Set(key, syncManifestEntry{Hash: digest.Hash(), ETag: head.ETag, Size: digest.size})
+		return SYNC_RESULT_SKIPPED, nil
+	}
+
+	// A file that changed since it was hashed is rejected by the storage and
+	// stays dirty for the next sync
+	etag, err := storage.Put(ctx, key, file, digest)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+
+	Manifest.Set(key, syncManifestEntry{Hash: digest.Hash(), ETag: etag, Size: digest.size})
+	return SYNC_RESULT_UPLOADED, nil
+}
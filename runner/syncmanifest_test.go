@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncManifestPathFallback(t *testing.T) {
+	newTestWorkspace(t, nil)
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	t.Setenv("SYNC_MANIFEST_PATH", filepath.Join(tmp, "missing", "manifest.json"))
+
+	InitSyncManifest()
+	t.Cleanup(func() { Manifest = nil })
+	if want := filepath.Join(tmp, "workspace-sync.json"); Manifest.path != want {
+		t.Fatalf("expected the manifest to fall back to %s; got %s", want, Manifest.path)
+	}
+
+	Manifest.Set("code/node/lab-1/a.js", syncManifestEntry{Hash: "h", ETag: "h", Size: 1})
+	if err := Manifest.Save(); err != nil {
+		t.Fatalf("expected the fallback manifest to save; got %v", err)
+	}
+}
+
+func TestSyncUploadChecksRemoteAfterRestart(t *testing.T) {
+	newTestWorkspace(t, map[string]string{"a.js": "console.log(1)"})
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	const key = "code/node/lab-1/a.js"
+
+	upload := func() string {
+		t.Helper()
+		file, err := WorkspaceFS.Open("a.js")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		result, err := syncUpload(ctx, storage, key, file)
+		if err != nil {
+			t.Fatalf("expected upload to succeed; got %v", err)
+		}
+		return result
+	}
+
+	// Upload once and write the manifest out, as before a restart
+	manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+	t.Setenv("SYNC_MANIFEST_PATH", manifestPath)
+	InitSyncManifest()
+	t.Cleanup(func() { Manifest = nil })
+	if result := upload(); result != SYNC_RESULT_UPLOADED {
+		t.Fatalf("expected %s; got %s", SYNC_RESULT_UPLOADED, result)
+	}
+	if result := upload(); result != SYNC_RESULT_SKIPPED {
+		t.Fatalf("expected an unchanged file to be skipped; got %s", result)
+	}
+	if err := Manifest.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The object goes away while the runner is down
+	if err := storage.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	InitSyncManifest()
+	if _, ok := Manifest.Lookup(key); !ok {
+		t.Fatal("expected the manifest entry to be loaded from disk")
+	}
+	if result := upload(); result != SYNC_RESULT_UPLOADED {
+		t.Fatalf("expected a deleted object to go up again; got %s", result)
+	}
+	if _, err := storage.Head(ctx, key); err != nil {
+		t.Fatalf("expected the object to exist again; got %v", err)
+	}
+
+	// A loaded entry that still matches the bucket is skipped
+	data, _ := json.Marshal(Manifest.entries)
+	if err := os.WriteFile(manifestPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	InitSyncManifest()
+	if result := upload(); result != SYNC_RESULT_SKIPPED {
+		t.Fatalf("expected a matching object to be skipped; got %s", result)
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	TOOL_TIMEOUT      = 20 * time.Second
+	TOOL_OUTPUT_LIMIT = 2 * INLINE_CONTENT_LIMIT
+)
+
+// How a linter's output is read
+const (
+	TOOL_OUTPUT_ESLINT = "eslint" // eslint --format json
+	TOOL_OUTPUT_LINES  = "lines"  // file:line[:column]: message, as gcc, go vet and most others print
+)
+
+// Diagnostic severities
+const (
+	SEVERITY_ERROR   = "error"
+	SEVERITY_WARNING = "warning"
+	SEVERITY_INFO    = "info"
+)
+
+// ToolCommand runs a formatter or linter from the workspace root. In Command
+// {file} is replaced with the workspace relative path of the file and {dir}
+// with its directory.
+type ToolCommand struct {
+	Name    string   `json:"name"`
+	Command []string `json:"command"`
+	// Extensions the tool handles, e.g. ".ts", every file when empty
+	Extensions []string `json:"extensions,omitempty"`
+	// Stdin tools get the content on stdin, so unsaved buffers can be checked.
+	// Formatters always do and print the result on stdout.
+	Stdin bool `json:"stdin,omitempty"`
+	// Output is how linter output is parsed, TOOL_OUTPUT_LINES by default
+	Output string `json:"output,omitempty"`
+	// Severity of diagnostics whose output does not carry one
+	Severity string `json:"severity,omitempty"`
+}
+
+type LanguageTools struct {
+	Format []ToolCommand `json:"format,omitempty"`
+	Lint   []ToolCommand `json:"lint,omitempty"`
+	// LanguageServer is the command /lsp starts, it has to speak LSP over stdio
+	LanguageServer []string `json:"languageServer,omitempty"`
+}
+
+var nodeTools = LanguageTools{
+	Format: []ToolCommand{{
+		Name:       "prettier",
+		Command:    []string{"npx", "--no-install", "prettier", "--stdin-filepath", "{file}"},
+		Extensions: []string{".js", ".jsx", ".mjs", ".cjs", ".ts", ".tsx", ".json", ".css", ".scss", ".html", ".md", ".yaml", ".yml"},
+		Stdin:      true,
+	}},
+	Lint: []ToolCommand{{
+		Name:       "eslint",
+		Command:    []string{"npx", "--no-install", "eslint", "--format", "json", "--stdin", "--stdin-filename", "{file}"},
+		Extensions: []string{".js", ".jsx", ".mjs", ".cjs", ".ts", ".tsx"},
+		Stdin:      true,
+		Output:     TOOL_OUTPUT_ESLINT,
+	}},
+	LanguageServer: []string{"typescript-language-server", "--stdio"},
+}
+
+// Tools per language, TOOLS_CONFIG points at a JSON file of the same shape
+// whose languages replace these
+var TOOL_LANGUAGE_DEFAULTS = map[string]LanguageTools{
+	"react":        nodeTools,
+	"node":         nodeTools,
+	"node-express": nodeTools,
+	"next":         nodeTools,
+	"go": {
+		Format: []ToolCommand{{
+			Name:       "gofmt",
+			Command:    []string{"gofmt"},
+			Extensions: []string{".go"},
+			Stdin:      true,
+		}},
+		Lint: []ToolCommand{{
+			Name:       "go vet",
+			Command:    []string{"go", "vet", "./{dir}"},
+			Extensions: []string{".go"},
+			Severity:   SEVERITY_WARNING,
+		}},
+		LanguageServer: []string{"gopls"},
+	},
+	"python": {
+		LanguageServer: []string{"pyright-langserver", "--stdio"},
+	},
+}
+
+var (
+	toolsOnce   sync.Once
+	toolsConfig map[string]LanguageTools
+)
+
+// getLanguageTools loads the tools of a language, TOOLS_CONFIG is read once
+func getLanguageTools(language string) LanguageTools {
+	toolsOnce.Do(func() {
+		toolsConfig = make(map[string]LanguageTools, len(TOOL_LANGUAGE_DEFAULTS))
+		for name, tools := range TOOL_LANGUAGE_DEFAULTS {
+			toolsConfig[name] = tools
+		}
+		configPath := os.Getenv("TOOLS_CONFIG")
+		if configPath == "" {
+			return
+		}
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			log.Printf("Failed to read tools config %s, using defaults: %v", configPath, err)
+			return
+		}
+		var overrides map[string]LanguageTools
+		if err := json.Unmarshal(data, &overrides); err != nil {
+			log.Printf("Failed to parse tools config %s, using defaults: %v", configPath, err)
+			return
+		}
+		for name, tools := range overrides {
+			toolsConfig[name] = tools
+		}
+	})
+	return toolsConfig[language]
+}
+
+func (t ToolCommand) handles(relPath string) bool {
+	if len(t.Extensions) == 0 {
+		return true
+	}
+	ext := strings.ToLower(path.Ext(relPath))
+	for _, handled := range t.Extensions {
+		if strings.ToLower(handled) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// limitedBuffer keeps the first limit bytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+type toolResult struct {
+	stdout   []byte
+	stderr   string
+	exitCode int
+}
+
+// run executes the tool on relPath. Exit codes are left to the caller,
+// linters exit non-zero when they found something.
+func (t ToolCommand) run(ctx context.Context, relPath string, content []byte) (*toolResult, error) {
+	if len(t.Command) == 0 {
+		return nil, newFSError(FS_ERR_TOOL_UNAVAILABLE, relPath, t.Name+" has no command")
+	}
+	dir := path.Dir(relPath)
+	args := make([]string, len(t.Command))
+	for i, arg := range t.Command {
+		arg = strings.ReplaceAll(arg, "{file}", relPath)
+		args[i] = strings.ReplaceAll(arg, "{dir}", dir)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, TOOL_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = WorkspaceFS.Root()
+	cmd.Env = append(os.Environ(), "NO_COLOR=1", "FORCE_COLOR=0", "CI=1")
+	if t.Stdin {
+		cmd.Stdin = bytes.NewReader(content)
+	}
+	stdout := &limitedBuffer{limit: int(TOOL_OUTPUT_LIMIT)}
+	stderr := &limitedBuffer{limit: 64 * 1024}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	result := &toolResult{stdout: stdout.Bytes(), stderr: strings.TrimSpace(stderr.String())}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr) && ctx.Err() == nil:
+		result.exitCode = exitErr.ExitCode()
+	case ctx.Err() != nil:
+		return nil, newFSError(FS_ERR_TOOL_FAILED, relPath, fmt.Sprintf("%s timed out after %s", t.Name, TOOL_TIMEOUT))
+	case errors.Is(err, exec.ErrNotFound):
+		return nil, newFSError(FS_ERR_TOOL_UNAVAILABLE, relPath, t.Name+" is not installed in this lab")
+	default:
+		return nil, &FSError{Code: FS_ERR_TOOL_FAILED, Path: relPath, Message: t.Name + " could not be started", Err: err}
+	}
+	if stdout.truncated {
+		return nil, newFSError(FS_ERR_TOOL_FAILED, relPath, fmt.Sprintf("%s printed more than %d bytes", t.Name, TOOL_OUTPUT_LIMIT))
+	}
+	return result, nil
+}
+
+// toolInput is what a format or lint request works on, the client's buffer
+// when it sent one and the file on disk otherwise
+func toolInput(req ToolFilePayload) (string, []byte, error) {
+	relPath, err := WorkspaceFS.Clean(req.Path)
+	if err != nil {
+		return "", nil, err
+	}
+	relPath = filepath.ToSlash(relPath)
+	if req.Content != nil {
+		content, err := decodeContent(req.Path, *req.Content, req.Encoding)
+		return relPath, content, err
+	}
+
+	file, err := WorkspaceFS.Open(relPath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", nil, wrapFSError(req.Path, "failed to stat file", err)
+	}
+	if info.Size() > INLINE_CONTENT_LIMIT {
+		return "", nil, newFSError(FS_ERR_TOO_LARGE, req.Path, "file is too large to format or lint")
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return "", nil, wrapFSError(req.Path, "failed to read file", err)
+	}
+	return relPath, content, nil
+}
+
+// Format a file with the language's formatter. Nothing is written, the client
+// applies the result like any other edit.
+func FormatFileHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req ToolFilePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal format file payload: %w", err)
+	}
+	relPath, content, err := toolInput(req)
+	if err != nil {
+		return err
+	}
+
+	language := client.Session().Language
+	var formatter ToolCommand
+	for _, tool := range getLanguageTools(language).Format {
+		if tool.handles(relPath) {
+			formatter = tool
+			break
+		}
+	}
+	if formatter.Name == "" {
+		return newFSError(FS_ERR_TOOL_UNAVAILABLE, req.Path, fmt.Sprintf("no formatter is configured for %s files in %s labs", path.Ext(relPath), language))
+	}
+
+	// Formatters always read stdin, the file on disk may not be what the client sees
+	formatter.Stdin = true
+	result, err := formatter.run(ctx, relPath, content)
+	if err != nil {
+		return err
+	}
+	if result.exitCode != 0 {
+		message := result.stderr
+		if message == "" {
+			message = fmt.Sprintf("%s exited with code %d", formatter.Name, result.exitCode)
+		}
+		return newFSError(FS_ERR_TOOL_FAILED, req.Path, message)
+	}
+
+	response := FormatFileResponse{
+		Path:      req.Path,
+		Content:   string(result.stdout),
+		Encoding:  ENCODING_UTF8,
+		Changed:   !bytes.Equal(result.stdout, content),
+		Formatter: formatter.Name,
+	}
+	if req.Content == nil {
+		// Lets the client write the result back with a baseVersion
+		response.BaseVersion = contentVersion(content)
+	}
+	return client.Reply(ctx, RESPONSE_FILE_FORMATTED, response)
+}
+
+// Lint a file with every linter the language configures for it
+func LintFileHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req ToolFilePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal lint file payload: %w", err)
+	}
+	relPath, content, err := toolInput(req)
+	if err != nil {
+		return err
+	}
+
+	language := client.Session().Language
+	response := LintFileResponse{Path: req.Path, Diagnostics: []Diagnostic{}}
+	for _, linter := range getLanguageTools(language).Lint {
+		if !linter.handles(relPath) {
+			continue
+		}
+		result, err := linter.run(ctx, relPath, content)
+		if err != nil {
+			return err
+		}
+		diagnostics, err := parseDiagnostics(linter, relPath, result)
+		if err != nil {
+			return err
+		}
+		response.Linters = append(response.Linters, linter.Name)
+		response.Diagnostics = append(response.Diagnostics, diagnostics...)
+	}
+	if len(response.Linters) == 0 {
+		return newFSError(FS_ERR_TOOL_UNAVAILABLE, req.Path, fmt.Sprintf("no linter is configured for %s files in %s labs", path.Ext(relPath), language))
+	}
+	return client.Reply(ctx, RESPONSE_FILE_LINTED, response)
+}
+
+func parseDiagnostics(linter ToolCommand, relPath string, result *toolResult) ([]Diagnostic, error) {
+	var diagnostics []Diagnostic
+	var err error
+	switch linter.Output {
+	case TOOL_OUTPUT_ESLINT:
+		diagnostics, err = parseESLintOutput(result.stdout, linter.Name)
+	case "", TOOL_OUTPUT_LINES:
+		// Compilers tend to print their findings on stderr
+		output := string(result.stdout) + "\n" + result.stderr
+		diagnostics = parseLineOutput(output, relPath, linter)
+	default:
+		err = fmt.Errorf("unknown output %q", linter.Output)
+	}
+	// A failing linter that reported nothing did not run, rather than find no problems
+	if (err != nil || len(diagnostics) == 0) && result.exitCode != 0 {
+		message := result.stderr
+		if message == "" {
+			message = fmt.Sprintf("%s exited with code %d", linter.Name, result.exitCode)
+		}
+		return nil, newFSError(FS_ERR_TOOL_FAILED, relPath, message)
+	}
+	if err != nil {
+		return nil, &FSError{Code: FS_ERR_TOOL_FAILED, Path: relPath, Message: linter.Name + " output could not be read", Err: err}
+	}
+	return diagnostics, nil
+}
+
+type eslintResult struct {
+	Messages []struct {
+		RuleID    string `json:"ruleId"`
+		Severity  int    `json:"severity"`
+		Message   string `json:"message"`
+		Line      int    `json:"line"`
+		Column    int    `json:"column"`
+		EndLine   int    `json:"endLine"`
+		EndColumn int    `json:"endColumn"`
+	} `json:"messages"`
+}
+
+func parseESLintOutput(output []byte, source string) ([]Diagnostic, error) {
+	var results []eslintResult
+	if err := json.Unmarshal(output, &results); err != nil {
+		return nil, err
+	}
+	diagnostics := []Diagnostic{}
+	for _, result := range results {
+		for _, msg := range result.Messages {
+			severity := SEVERITY_WARNING
+			if msg.Severity == 2 {
+				severity = SEVERITY_ERROR
+			}
+			diagnostics = append(diagnostics, Diagnostic{
+				Line:      msg.Line,
+				Column:    msg.Column,
+				EndLine:   msg.EndLine,
+				EndColumn: msg.EndColumn,
+				Severity:  severity,
+				Message:   msg.Message,
+				Rule:      msg.RuleID,
+				Source:    source,
+			})
+		}
+	}
+	return diagnostics, nil
+}
+
+var (
+	diagnosticLinePattern = regexp.MustCompile(`^(.+?):(\d+)(?::(\d+))?:\s*(.*)$`)
+	severityPrefixPattern = regexp.MustCompile(`^(?i)(error|warning|note|info)\s*:\s*`)
+)
+
+// parseLineOutput reads file:line[:column]: message lines that point into relPath
+func parseLineOutput(output, relPath string, linter ToolCommand) []Diagnostic {
+	diagnostics := []Diagnostic{}
+	for _, line := range strings.Split(output, "\n") {
+		match := diagnosticLinePattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil || path.Clean(filepath.ToSlash(match[1])) != relPath {
+			continue
+		}
+		lineNumber, _ := strconv.Atoi(match[2])
+		column, _ := strconv.Atoi(match[3])
+		message := match[4]
+
+		severity := linter.Severity
+		if prefix := severityPrefixPattern.FindStringSubmatch(message); prefix != nil {
+			severity = strings.ToLower(prefix[1])
+			if severity == "note" {
+				severity = SEVERITY_INFO
+			}
+			message = message[len(prefix[0]):]
+		}
+		if severity == "" {
+			severity = SEVERITY_ERROR
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			Line:     lineNumber,
+			Column:   column,
+			Severity: severity,
+			Message:  message,
+			Source:   linter.Name,
+		})
+	}
+	return diagnostics
+}
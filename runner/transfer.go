@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// Chunked uploads a single connection may have in flight
+	UPLOAD_MAX_PENDING = 4
+	// Uploads without a chunk for this long are discarded
+	UPLOAD_IDLE_TIMEOUT = 10 * time.Minute
+)
+
+// pendingUpload is a chunked upload staged outside the workspace until it completes
+type pendingUpload struct {
+	id       string
+	path     string
+	size     int64
+	received int64
+	file     *os.File
+	// staged is what the upload holds of the workspace quota
+	staged     int64
+	lastActive time.Time
+}
+
+func (u *pendingUpload) discard() {
+	Quota.Unstage(u.staged)
+	u.staged = 0
+	u.file.Close()
+	os.Remove(u.file.Name())
+}
+
+// addUpload registers a new upload, discarding idle ones first
+func (c *Client) addUpload(upload *pendingUpload) error {
+	c.expireUploads()
+	c.uploadMu.Lock()
+	defer c.uploadMu.Unlock()
+	if len(c.uploads) >= UPLOAD_MAX_PENDING {
+		return newFSError(FS_ERR_TOO_MANY_UPLOADS, upload.path, fmt.Sprintf("at most %d uploads can run at once, finish or abort one first", UPLOAD_MAX_PENDING))
+	}
+	upload.lastActive = time.Now()
+	c.uploads[upload.id] = upload
+	return nil
+}
+
+// getUpload looks up an upload in flight and marks it active
+func (c *Client) getUpload(uploadID string) (*pendingUpload, error) {
+	c.uploadMu.Lock()
+	defer c.uploadMu.Unlock()
+	upload, ok := c.uploads[uploadID]
+	if !ok {
+		return nil, newFSError(FS_ERR_INVALID_UPLOAD, uploadID, "unknown upload")
+	}
+	upload.lastActive = time.Now()
+	return upload, nil
+}
+
+// takeUpload removes an upload from the connection, the caller discards it
+func (c *Client) takeUpload(uploadID string) (*pendingUpload, error) {
+	c.uploadMu.Lock()
+	defer c.uploadMu.Unlock()
+	upload, ok := c.uploads[uploadID]
+	if !ok {
+		return nil, newFSError(FS_ERR_INVALID_UPLOAD, uploadID, "unknown upload")
+	}
+	delete(c.uploads, uploadID)
+	return upload, nil
+}
+
+// expireUploads discards uploads that have not seen a chunk for UPLOAD_IDLE_TIMEOUT
+func (c *Client) expireUploads() {
+	c.uploadMu.Lock()
+	var expired []*pendingUpload
+	for id, upload := range c.uploads {
+		if time.Since(upload.lastActive) > UPLOAD_IDLE_TIMEOUT {
+			expired = append(expired, upload)
+			delete(c.uploads, id)
+		}
+	}
+	c.uploadMu.Unlock()
+
+	for _, upload := range expired {
+		log.Printf("Discarding upload %s for %s, idle for %s", upload.id, upload.path, UPLOAD_IDLE_TIMEOUT)
+		upload.discard()
+	}
+}
+
+// Get the staging directory for chunked uploads from environment or default
+func getUploadStagingDir() string {
+	if dir := os.Getenv("UPLOAD_STAGING_DIR"); dir != "" {
+		return dir
+	}
+	return os.TempDir()
+}
+
+// detectMimeType prefers the file extension and falls back to sniffing the content
+func detectMimeType(path string, head []byte) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(path)); mimeType != "" {
+		return mimeType
+	}
+	return http.DetectContentType(head)
+}
+
+// encodeContent returns the content as plain text when it is valid UTF-8, base64 otherwise
+func encodeContent(content []byte) (string, string) {
+	if utf8.Valid(content) && !bytes.Contains(content, []byte{0}) {
+		return string(content), ENCODING_UTF8
+	}
+	return base64.StdEncoding.EncodeToString(content), ENCODING_BASE64
+}
+
+// decodeContent turns a client payload back into raw bytes according to its encoding
+func decodeContent(path, content, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", ENCODING_UTF8:
+		return []byte(content), nil
+	case ENCODING_BASE64:
+		data, err := base64.StdEncoding.DecodeString(content)
+		if err != nil {
+			return nil, &FSError{Code: FS_ERR_INVALID_ENCODING, Path: path, Message: "content is not valid base64", Err: err}
+		}
+		return data, nil
+	default:
+		return nil, newFSError(FS_ERR_INVALID_ENCODING, path, "unsupported encoding "+encoding)
+	}
+}
+
+func newRandomID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func fileChecksum(f *os.File) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Download a file in chunks, the last chunk carries the checksum of the whole file
+func DownloadChunkHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req DownloadChunkPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal download chunk payload: %w", err)
+	}
+
+	file, err := WorkspaceFS.Open(req.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return wrapFSError(req.Path, "failed to stat file", err)
+	}
+	if req.Offset < 0 || req.Offset > info.Size() {
+		return newFSError(FS_ERR_INVALID_RANGE, req.Path, "offset is outside of the file")
+	}
+
+	length := req.Length
+	if length <= 0 || length > CHUNK_SIZE {
+		length = CHUNK_SIZE
+	}
+	buf := make([]byte, length)
+	n, err := file.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return wrapFSError(req.Path, "failed to read file", err)
+	}
+	buf = buf[:n]
+
+	head := buf
+	if req.Offset != 0 {
+		head = make([]byte, 512)
+		m, _ := file.ReadAt(head, 0)
+		head = head[:m]
+	}
+
+	response := FileChunkResponse{
+		Path:     req.Path,
+		Offset:   req.Offset,
+		Data:     base64.StdEncoding.EncodeToString(buf),
+		Size:     info.Size(),
+		MimeType: detectMimeType(req.Path, head),
+		EOF:      req.Offset+int64(n) >= info.Size(),
+	}
+	if response.EOF {
+		checksum, err := fileChecksum(file)
+		if err != nil {
+			return wrapFSError(req.Path, "failed to checksum file", err)
+		}
+		response.Checksum = checksum
+	}
+
+	return client.Reply(ctx, RESPONSE_FILE_CHUNK, response)
+}
+
+// Start a chunked upload, chunks are staged outside the workspace until the upload completes
+func UploadStartHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req UploadStartPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal upload start payload: %w", err)
+	}
+
+	relPath, err := WorkspaceFS.Clean(req.Path)
+	if err != nil {
+		return err
+	}
+	if err := Protected.CheckWrite(relPath); err != nil {
+		return err
+	}
+	if req.Size < 0 || req.Size > MAX_UPLOAD_SIZE {
+		return newFSError(FS_ERR_TOO_LARGE, req.Path, fmt.Sprintf("uploads are limited to %d bytes", MAX_UPLOAD_SIZE))
+	}
+	// Fail early if the destination can never be written
+	if _, err := WorkspaceFS.Resolve(relPath); err != nil {
+		return err
+	}
+
+	uploadID, err := newRandomID()
+	if err != nil {
+		return fmt.Errorf("failed to generate upload id: %w", err)
+	}
+	// The staged copy takes up disk until the upload completes, count it from the start
+	if err := Quota.Stage(relPath, req.Size); err != nil {
+		return err
+	}
+	staging, err := os.CreateTemp(getUploadStagingDir(), "upload-"+uploadID+"-*")
+	if err != nil {
+		Quota.Unstage(req.Size)
+		return fmt.Errorf("failed to create staging file: %w", err)
+	}
+
+	upload := &pendingUpload{
+		id:     uploadID,
+		path:   relPath,
+		size:   req.Size,
+		file:   staging,
+		staged: req.Size,
+	}
+	if err := client.addUpload(upload); err != nil {
+		upload.discard()
+		return err
+	}
+	log.Printf("Started upload %s for %s (%d bytes)", uploadID, relPath, req.Size)
+
+	return client.Reply(ctx, RESPONSE_UPLOAD, UploadStatusResponse{
+		UploadID: uploadID,
+		Path:     relPath,
+		Size:     req.Size,
+	})
+}
+
+// Receive a single chunk of an upload. Chunks can be retried but must not leave gaps.
+func UploadChunkHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req UploadChunkPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal upload chunk payload: %w", err)
+	}
+
+	upload, err := client.getUpload(req.UploadID)
+	if err != nil {
+		return err
+	}
+	data, err := decodeContent(upload.path, req.Data, ENCODING_BASE64)
+	if err != nil {
+		return err
+	}
+	if req.Offset < 0 || req.Offset > upload.received {
+		return newFSError(FS_ERR_INVALID_RANGE, upload.path, fmt.Sprintf("expected chunk at offset %d", upload.received))
+	}
+	end := req.Offset + int64(len(data))
+	if end > upload.size {
+		return newFSError(FS_ERR_INVALID_RANGE, upload.path, "chunk exceeds the declared upload size")
+	}
+
+	if _, err := upload.file.WriteAt(data, req.Offset); err != nil {
+		return fmt.Errorf("failed to stage chunk for %s: %w", upload.path, err)
+	}
+	if end > upload.received {
+		upload.received = end
+	}
+
+	return client.Reply(ctx, RESPONSE_UPLOAD, UploadStatusResponse{
+		UploadID: upload.id,
+		Path:     upload.path,
+		Received: upload.received,
+		Size:     upload.size,
+	})
+}
+
+// Verify the checksum of a finished upload and move it into the workspace
+func UploadCompleteHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req UploadCompletePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal upload complete payload: %w", err)
+	}
+
+	upload, err := client.getUpload(req.UploadID)
+	if err != nil {
+		return err
+	}
+	if upload.received != upload.size {
+		return newFSError(FS_ERR_INVALID_UPLOAD, upload.path, fmt.Sprintf("received %d of %d bytes", upload.received, upload.size))
+	}
+
+	checksum, err := fileChecksum(upload.file)
+	if err != nil {
+		return fmt.Errorf("failed to checksum upload %s: %w", upload.id, err)
+	}
+	if !strings.EqualFold(checksum, req.Checksum) {
+		client.takeUpload(upload.id)
+		upload.discard()
+		return newFSError(FS_ERR_CHECKSUM_MISMATCH, upload.path, "uploaded content does not match the checksum, upload discarded")
+	}
+
+	if err := commitUpload(upload, req.BaseVersion); err != nil {
+		return err
+	}
+
+	client.takeUpload(upload.id)
+	upload.discard()
+
+	client.Session().MarkDirty(upload.path, "edit")
+	log.Printf("Completed upload %s for %s", upload.id, upload.path)
+
+	return client.Reply(ctx, RESPONSE_UPLOAD_DONE, map[string]interface{}{
+		"uploadId": upload.id,
+		"path":     upload.path,
+		"size":     upload.size,
+		"checksum": checksum,
+		"version":  checksum,
+		"success":  true,
+	})
+}
+
+// commitUpload copies a verified upload into the workspace unless the destination changed underneath it
+func commitUpload(upload *pendingUpload, baseVersion string) error {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	if err := WorkspaceFS.checkVersion(upload.path, baseVersion); err != nil {
+		return err
+	}
+	if err := Quota.CheckStaged(upload.path, upload.size, upload.staged); err != nil {
+		return err
+	}
+	upload.staged = 0
+
+	if _, err := upload.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind upload %s: %w", upload.id, err)
+	}
+	destination, err := WorkspaceFS.Create(upload.path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destination, upload.file); err != nil {
+		destination.Close()
+		return wrapFSError(upload.path, "failed to write uploaded file", err)
+	}
+	if err := destination.Close(); err != nil {
+		return wrapFSError(upload.path, "failed to write uploaded file", err)
+	}
+	return nil
+}
+
+func UploadAbortHandler(ctx context.Context, payload json.RawMessage, client *Client) error {
+	var req UploadAbortPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal upload abort payload: %w", err)
+	}
+
+	upload, err := client.takeUpload(req.UploadID)
+	if err != nil {
+		return err
+	}
+	upload.discard()
+
+	return client.Reply(ctx, RESPONSE_UPLOAD_DONE, map[string]interface{}{
+		"uploadId": upload.id,
+		"path":     upload.path,
+		"success":  false,
+		"aborted":  true,
+	})
+}
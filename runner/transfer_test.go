@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// newTestUploadClient returns a client with a quota of maxBytes over the workspace
+func newTestUploadClient(t *testing.T, maxBytes string) *Client {
+	t.Helper()
+	newTestWorkspace(t, nil)
+	t.Setenv("UPLOAD_STAGING_DIR", t.TempDir())
+	t.Setenv("WORKSPACE_QUOTA_BYTES", maxBytes)
+	t.Setenv("WORKSPACE_QUOTA_FILE_SIZE", maxBytes)
+	manager := NewFSManager(context.Background())
+	previous := Quota
+	Quota = NewWorkspaceQuota(manager)
+	t.Cleanup(func() { Quota = previous })
+	client := NewClient(nil, manager, nil)
+	t.Cleanup(client.Close)
+	return client
+}
+
+func startTestUpload(client *Client, path string, size int64) (*pendingUpload, error) {
+	payload, _ := json.Marshal(UploadStartPayload{Path: path, Size: size})
+	if err := UploadStartHandler(context.Background(), payload, client); err != nil {
+		return nil, err
+	}
+	response := <-client.send
+	return client.getUpload(response.Data.(UploadStatusResponse).UploadID)
+}
+
+func TestUploadLimitPerClient(t *testing.T) {
+	client := newTestUploadClient(t, "1000000")
+
+	for i := 0; i < UPLOAD_MAX_PENDING; i++ {
+		if _, err := startTestUpload(client, "file.txt", 10); err != nil {
+			t.Fatalf("expected upload %d to start; got %v", i, err)
+		}
+	}
+	if _, err := startTestUpload(client, "file.txt", 10); !isFSErrorCode(err, FS_ERR_TOO_MANY_UPLOADS) {
+		t.Fatalf("expected %s; got %v", FS_ERR_TOO_MANY_UPLOADS, err)
+	}
+	if Quota.staged != int64(UPLOAD_MAX_PENDING*10) {
+		t.Errorf("expected a refused upload to release its quota; %d bytes staged", Quota.staged)
+	}
+}
+
+func TestUploadIdleExpiry(t *testing.T) {
+	client := newTestUploadClient(t, "1000000")
+
+	idle, err := startTestUpload(client, "idle.txt", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := startTestUpload(client, "active.txt", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle.lastActive = time.Now().Add(-UPLOAD_IDLE_TIMEOUT - time.Second)
+
+	client.expireUploads()
+	if _, err := client.getUpload(idle.id); err == nil {
+		t.Error("expected the idle upload to be discarded")
+	}
+	if _, err := client.getUpload(active.id); err != nil {
+		t.Errorf("expected the active upload to remain; got %v", err)
+	}
+	if Quota.staged != 10 {
+		t.Errorf("expected only the active upload to hold quota; %d bytes staged", Quota.staged)
+	}
+}
+
+func TestUploadStagedQuota(t *testing.T) {
+	client := newTestUploadClient(t, "100")
+
+	first, err := startTestUpload(client, "first.bin", 60)
+	if err != nil {
+		t.Fatalf("expected the first upload to start; got %v", err)
+	}
+	// Both would fit on their own, not together
+	if _, err := startTestUpload(client, "second.bin", 60); !isFSErrorCode(err, FS_ERR_QUOTA_EXCEEDED) {
+		t.Fatalf("expected %s; got %v", FS_ERR_QUOTA_EXCEEDED, err)
+	}
+
+	// Committing moves the staged bytes into the workspace instead of counting them twice
+	first.received = first.size
+	if err := commitUpload(first, ""); err != nil {
+		t.Fatalf("expected the upload to commit; got %v", err)
+	}
+	if Quota.staged != 0 || Quota.bytes != 60 {
+		t.Errorf("expected 60 bytes in use and none staged; got %d and %d", Quota.bytes, Quota.staged)
+	}
+
+	aborted, err := startTestUpload(client, "third.bin", 40)
+	if err != nil {
+		t.Fatalf("expected an upload into the remaining space to start; got %v", err)
+	}
+	payload, _ := json.Marshal(UploadAbortPayload{UploadID: aborted.id})
+	if err := UploadAbortHandler(context.Background(), payload, client); err != nil {
+		t.Fatal(err)
+	}
+	if Quota.staged != 0 {
+		t.Errorf("expected an aborted upload to release its quota; %d bytes staged", Quota.staged)
+	}
+}
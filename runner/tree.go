@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	TREE_DEFAULT_PAGE_SIZE = 500
+	TREE_MAX_PAGE_SIZE     = 5000
+)
+
+type treeListing struct {
+	entries []FileInfo
+	hash    string
+}
+
+// treeDepth is how many levels below root relPath is, root itself is 0
+func treeDepth(root, relPath string) int {
+	if relPath == root {
+		return 0
+	}
+	if root != "." {
+		relPath = strings.TrimPrefix(relPath, root+"/")
+	}
+	return strings.Count(relPath, "/") + 1
+}
+
+// walkTree lists root and everything below it in a stable order, up to
+// maxDepth levels deep (0 means no limit). The hash changes whenever an
+// entry is added, removed or modified.
+func walkTree(root string, maxDepth int) (*treeListing, error) {
+	rootRel, err := WorkspaceFS.Clean(root)
+	if err != nil {
+		return nil, err
+	}
+	rootRel = filepath.ToSlash(rootRel)
+
+	listing := &treeListing{}
+	sum := sha256.New()
+	err = WorkspaceFS.WalkDir(rootRel, func(relPath string, d fs.DirEntry) error {
+		info, err := d.Info()
+		if err != nil {
+			log.Printf("Error getting file info for %s: %v", relPath, err)
+			return nil
+		}
+
+		entry := FileInfo{
+			Name:       d.Name(),
+			Path:       relPath,
+			IsDir:      d.IsDir(),
+			Size:       info.Size(),
+			ModTime:    info.ModTime().Format(time.RFC3339),
+			Ignored:    Ignore.IgnoredEntry(relPath, d.IsDir()),
+			Protection: Protected.Level(relPath),
+		}
+		// Directories past the depth limit and ignored ones are listed but
+		// not walked into, the client expands them with fs_load_dir
+		if d.IsDir() && relPath != rootRel && (entry.Ignored || maxDepth > 0 && treeDepth(rootRel, relPath) >= maxDepth) {
+			entry.Lazy = true
+		}
+
+		contentHash := ""
+		if !entry.IsDir {
+			contentHash = treeFileHash(relPath, info)
+		}
+		fmt.Fprintf(sum, "%s\x00%t\x00%s\x00%t\n", relPath, entry.IsDir, contentHash, entry.Lazy)
+		listing.entries = append(listing.entries, entry)
+		if entry.Lazy {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	listing.hash = hex.EncodeToString(sum.Sum(nil))
+	return listing, nil
+}
+
+// A cursor carries the tree hash it was issued for, so paging through a
+// tree that changed in between is caught instead of skipping entries
+func encodeTreeCursor(hash string, offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(hash + ":" + strconv.Itoa(offset)))
+}
+
+func decodeTreeCursor(cursor string) (string, int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, err
+	}
+	hash, offset, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return "", 0, fmt.Errorf("malformed cursor")
+	}
+	n, err := strconv.Atoi(offset)
+	if err != nil || n < 0 {
+		return "", 0, fmt.Errorf("malformed cursor")
+	}
+	return hash, n, nil
+}
+
+var TREE_SNAPSHOT_LIMIT = 4
+
+const TREE_LAZY_DIR_HASH = "lazy"
+
+type treeDir struct {
+	hash  string
+	files []FileInfo
+}
+
+// treeSnapshot holds a Merkle hash for every directory: the hash of a
+// directory covers the names and hashes of its children, so two snapshots
+// only differ along the paths that lead to a change
+type treeSnapshot struct {
+	root      string
+	rootEntry FileInfo
+	dirs      map[string]*treeDir
+}
+
+// treeStatKey identifies one version of a file on disk without reading it
+type treeStatKey struct {
+	size  int64
+	mtime int64
+	inode uint64
+}
+
+func newTreeStatKey(info fs.FileInfo) treeStatKey {
+	key := treeStatKey{size: info.Size(), mtime: info.ModTime().UnixNano()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		key.inode = stat.Ino
+	}
+	return key
+}
+
+type treeCachedHash struct {
+	key  treeStatKey
+	hash string
+}
+
+// treeHashCache remembers content hashes, a file is only read again once
+// its size, mtime or inode moved
+type treeHashCache struct {
+	mu      sync.Mutex
+	entries map[string]treeCachedHash
+}
+
+var TreeFileHashes = &treeHashCache{entries: make(map[string]treeCachedHash)}
+
+func (c *treeHashCache) get(relPath string, key treeStatKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.entries[relPath]
+	if !ok || cached.key != key {
+		return "", false
+	}
+	return cached.hash, true
+}
+
+func (c *treeHashCache) put(relPath string, key treeStatKey, hash string) {
+	c.mu.Lock()
+	c.entries[relPath] = treeCachedHash{key: key, hash: hash}
+	c.mu.Unlock()
+}
+
+// retain drops the hashes of every path keep does not report, so deleted
+// files do not pile up
+func (c *treeHashCache) retain(keep func(relPath string) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for relPath := range c.entries {
+		if !keep(relPath) {
+			delete(c.entries, relPath)
+		}
+	}
+}
+
+func treeStatHash(info fs.FileInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%d\x00%s", info.Size(), info.ModTime().UnixNano(), info.Mode())))
+	return hex.EncodeToString(sum[:16])
+}
+
+// treeFileHash is the hash of a file's content, the same as its version
+// token. Symlinks and special files are not read, their metadata stands in.
+func treeFileHash(relPath string, info fs.FileInfo) string {
+	if !info.Mode().IsRegular() {
+		return treeStatHash(info)
+	}
+	key := newTreeStatKey(info)
+	if hash, ok := TreeFileHashes.get(relPath, key); ok {
+		return hash
+	}
+
+	file, err := WorkspaceFS.Open(relPath)
+	if err != nil {
+		// Removed or replaced while hashing, the next change event catches up
+		return treeStatHash(info)
+	}
+	defer file.Close()
+	hash, err := fileChecksum(file)
+	if err != nil {
+		log.Printf("Failed to hash %s: %v", relPath, err)
+		return treeStatHash(info)
+	}
+	TreeFileHashes.put(relPath, key, hash)
+	return hash
+}
+
+func (s *treeSnapshot) hashDir(relPath string) (string, error) {
+	entries, err := WorkspaceFS.ReadDir(relPath)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.New()
+	var files []FileInfo
+	for _, d := range entries {
+		childPath := path.Join(relPath, d.Name())
+		info, err := d.Info()
+		if err != nil {
+			// Removed while hashing, the next change event invalidates the snapshot anyway
+			continue
+		}
+
+		entry := FileInfo{
+			Name:       d.Name(),
+			Path:       childPath,
+			IsDir:      d.IsDir(),
+			Size:       info.Size(),
+			ModTime:    info.ModTime().Format(time.RFC3339),
+			Ignored:    Ignore.IgnoredEntry(childPath, d.IsDir()),
+			Protection: Protected.Level(childPath),
+		}
+		switch {
+		case d.IsDir() && !entry.Ignored:
+			if entry.Hash, err = s.hashDir(childPath); err != nil {
+				continue
+			}
+		case d.IsDir():
+			// Nothing inside is watched, so only the directory being there counts
+			entry.Lazy = true
+			entry.Hash = TREE_LAZY_DIR_HASH
+		default:
+			entry.Hash = treeFileHash(childPath, info)
+		}
+		fmt.Fprintf(sum, "%s\x00%s\n", entry.Name, entry.Hash)
+		files = append(files, entry)
+	}
+
+	hash := hex.EncodeToString(sum.Sum(nil)[:16])
+	s.dirs[relPath] = &treeDir{hash: hash, files: files}
+	return hash, nil
+}
+
+func buildTreeSnapshot() (*treeSnapshot, error) {
+	snapshot := &treeSnapshot{dirs: make(map[string]*treeDir)}
+	root, err := snapshot.hashDir(".")
+	if err != nil {
+		return nil, err
+	}
+	snapshot.root = root
+	if info, err := os.Stat(WorkspaceFS.Root()); err == nil {
+		snapshot.rootEntry = FileInfo{
+			Name:       info.Name(),
+			Path:       ".",
+			IsDir:      true,
+			Size:       info.Size(),
+			ModTime:    info.ModTime().Format(time.RFC3339),
+			Ignored:    Ignore.IgnoredEntry(".", true),
+			Protection: Protected.Level("."),
+		}
+	}
+	files := make(map[string]bool)
+	for _, dir := range snapshot.dirs {
+		for _, file := range dir.files {
+			files[file.Path] = !file.IsDir
+		}
+	}
+	TreeFileHashes.retain(func(relPath string) bool { return files[relPath] })
+	return snapshot, nil
+}
+
+// listing flattens the directory at root the same way walkTree does, from
+// memory. ok is false when root is not a directory the snapshot descended
+// into, e.g. one inside an ignored directory.
+func (s *treeSnapshot) listing(root string, maxDepth int) (listing *treeListing, ok bool) {
+	dir, ok := s.dirs[root]
+	if !ok {
+		return nil, false
+	}
+	rootEntry := s.rootEntry
+	if root != "." {
+		parent, ok := s.dirs[path.Dir(root)]
+		if !ok {
+			return nil, false
+		}
+		i := slices.IndexFunc(parent.files, func(file FileInfo) bool { return file.Path == root })
+		if i < 0 {
+			return nil, false
+		}
+		rootEntry = parent.files[i]
+	}
+
+	listing = &treeListing{}
+	var walk func(entry FileInfo)
+	walk = func(entry FileInfo) {
+		// Content hashes are only handed out by fs_tree_sync
+		entry.Hash = ""
+		if entry.IsDir && entry.Path != root && maxDepth > 0 && treeDepth(root, entry.Path) >= maxDepth {
+			entry.Lazy = true
+		}
+		listing.entries = append(listing.entries, entry)
+		if !entry.IsDir || entry.Lazy {
+			return
+		}
+		if dir, ok := s.dirs[entry.Path]; ok {
+			for _, child := range dir.files {
+				walk(child)
+			}
+		}
+	}
+	walk(rootEntry)
+
+	// The directory hash covers everything below it, the depth limit changes
+	// which entries are listed
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", root, dir.hash, maxDepth)))
+	listing.hash = hex.EncodeToString(sum[:])
+	return listing, true
+}
+
+// TreeHashes keeps the current snapshot until the watcher reports a change,
+// plus the last few ones so a reconnecting client can diff against the tree
+// it saw before
+type TreeHashes struct {
+	mu        sync.Mutex
+	watched   bool // without a watcher nothing invalidates the cache, so every call rebuilds
+	current   *treeSnapshot
+	snapshots []*treeSnapshot
+}
+
+var Trees = &TreeHashes{}
+
+func (t *TreeHashes) setWatched(watched bool) {
+	t.mu.Lock()
+	t.watched = watched
+	t.current = nil
+	t.mu.Unlock()
+}
+
+func (t *TreeHashes) Invalidate() {
+	t.mu.Lock()
+	t.current = nil
+	t.mu.Unlock()
+}
+
+func (t *TreeHashes) Current() (*treeSnapshot, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != nil && t.watched {
+		return t.current, nil
+	}
+
+	snapshot, err := buildTreeSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	t.current = snapshot
+	for i, previous := range t.snapshots {
+		if previous.root == snapshot.root {
+			t.snapshots = append(t.snapshots[:i], t.snapshots[i+1:]...)
+			break
+		}
+	}
+	t.snapshots = append(t.snapshots, snapshot)
+	if len(t.snapshots) > TREE_SNAPSHOT_LIMIT {
+		t.snapshots = t.snapshots[len(t.snapshots)-TREE_SNAPSHOT_LIMIT:]
+	}
+	return snapshot, nil
+}
+
+func (t *TreeHashes) Lookup(rootHash string) *treeSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, snapshot := range t.snapshots {
+		if snapshot.root == rootHash {
+			return snapshot
+		}
+	}
+	return nil
+}
+
+// diffTrees walks the current snapshot from the root and returns the
+// directories whose hash moved, skipping every subtree that did not change.
+// Removed lists directories that are gone, the client drops them wholesale.
+func diffTrees(previous, current *treeSnapshot) (changed []TreeDirListing, removed []string) {
+	var walk func(relPath string)
+	walk = func(relPath string) {
+		dir := current.dirs[relPath]
+		old, existed := previous.dirs[relPath]
+		if existed && old.hash == dir.hash {
+			return
+		}
+		changed = append(changed, TreeDirListing{Path: relPath, Hash: dir.hash, Files: dir.files})
+
+		if existed {
+			for _, file := range old.files {
+				if _, ok := current.dirs[file.Path]; file.IsDir && !file.Lazy && !ok {
+					removed = append(removed, file.Path)
+				}
+			}
+		}
+		for _, file := range dir.files {
+			if file.IsDir && !file.Lazy {
+				walk(file.Path)
+			}
+		}
+	}
+	walk(".")
+	return changed, removed
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTreeSnapshotHashesContent(t *testing.T) {
+	root := newTestWorkspace(t, map[string]string{
+		"src/main.js": "console.log(1)",
+		"README.md":   "hello",
+	})
+
+	before, err := buildTreeSnapshot()
+	if err != nil {
+		t.Fatalf("failed to build snapshot: %v", err)
+	}
+
+	// Same size and mtime, only the content moved
+	target := filepath.Join(root, "src", "main.js")
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(target, []byte("console.log(2)"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(target, time.Now(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	// Drop the cached hash the way a new inode would
+	TreeFileHashes.retain(func(relPath string) bool { return relPath != "src/main.js" })
+
+	after, err := buildTreeSnapshot()
+	if err != nil {
+		t.Fatalf("failed to build snapshot: %v", err)
+	}
+	if before.root == after.root {
+		t.Errorf("expected the root hash to change with the content")
+	}
+	if before.dirs["."].files[0].Hash != after.dirs["."].files[0].Hash {
+		t.Errorf("expected README.md to keep its hash")
+	}
+
+	changed, _ := diffTrees(before, after)
+	var paths []string
+	for _, dir := range changed {
+		paths = append(paths, dir.Path)
+	}
+	if !equalStrings(paths, []string{".", "src"}) {
+		t.Errorf("expected [. src] to change; got %v", paths)
+	}
+}
+
+func TestTreeFileHashUsesCache(t *testing.T) {
+	root := newTestWorkspace(t, map[string]string{"a.txt": "one"})
+
+	info, err := os.Lstat(filepath.Join(root, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := treeFileHash("a.txt", info)
+	if first != contentVersion([]byte("one")) {
+		t.Errorf("expected the content version; got %s", first)
+	}
+
+	// Unchanged stat, the cached hash is served without reading the file again
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("two"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(root, "a.txt"), time.Now(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if got := treeFileHash("a.txt", info); got != first {
+		t.Errorf("expected the cached hash %s; got %s", first, got)
+	}
+
+	updated, err := os.Lstat(filepath.Join(root, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated = &movedInfo{FileInfo: updated, modTime: info.ModTime().Add(time.Second)}
+	if got := treeFileHash("a.txt", updated); got != contentVersion([]byte("two")) {
+		t.Errorf("expected the new content version; got %s", got)
+	}
+}
+
+// movedInfo reports a different mtime than the file on disk
+type movedInfo struct {
+	os.FileInfo
+	modTime time.Time
+}
+
+func (i *movedInfo) ModTime() time.Time { return i.modTime }
+
+func TestTreeSnapshotListingMatchesWalk(t *testing.T) {
+	newTestWorkspace(t, map[string]string{
+		"README.md":         "hello",
+		"src/main.js":       "console.log(1)",
+		"src/lib/util.js":   "export {}",
+		"src/lib/deep/x.js": "x",
+		"tests/spec.js":     "it()",
+	})
+	snapshot, err := buildTreeSnapshot()
+	if err != nil {
+		t.Fatalf("failed to build snapshot: %v", err)
+	}
+
+	tests := []struct {
+		root     string
+		maxDepth int
+	}{
+		{".", 0},
+		{".", 1},
+		{".", 2},
+		{"src", 0},
+		{"src/lib", 1},
+	}
+	for _, tt := range tests {
+		walked, err := walkTree(tt.root, tt.maxDepth)
+		if err != nil {
+			t.Fatalf("failed to walk %s: %v", tt.root, err)
+		}
+		listed, ok := snapshot.listing(tt.root, tt.maxDepth)
+		if !ok {
+			t.Fatalf("expected %s to be in the snapshot", tt.root)
+		}
+		if len(listed.entries) != len(walked.entries) {
+			t.Fatalf("%s depth %d: expected %d entries; got %d", tt.root, tt.maxDepth, len(walked.entries), len(listed.entries))
+		}
+		for i := range walked.entries {
+			want, got := walked.entries[i], listed.entries[i]
+			if want.Path != got.Path || want.IsDir != got.IsDir || want.Lazy != got.Lazy || got.Hash != "" {
+				t.Errorf("%s depth %d entry %d: expected %+v; got %+v", tt.root, tt.maxDepth, i, want, got)
+			}
+		}
+	}
+
+	if _, ok := snapshot.listing("README.md", 0); ok {
+		t.Errorf("expected a file to be walked instead")
+	}
+	if _, ok := snapshot.listing("missing", 0); ok {
+		t.Errorf("expected a missing directory to be walked instead")
+	}
+}
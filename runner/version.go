@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+)
+
+// contentVersion is the version token handed out for a file's content
+func contentVersion(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// ConflictError is returned when a write was based on a version of the
+// file that is no longer current. It carries the current content so the
+// client can offer a merge.
+type ConflictError struct {
+	Path           string `json:"path"`
+	BaseVersion    string `json:"baseVersion"`
+	CurrentVersion string `json:"currentVersion"`
+	Deleted        bool   `json:"deleted"`
+	Content        string `json:"content,omitempty"`
+	Encoding       string `json:"encoding,omitempty"`
+	// ContentOmitted is set when the current content is too large to send inline
+	ContentOmitted bool `json:"contentOmitted,omitempty"`
+}
+
+func (e *ConflictError) Error() string {
+	if e.Deleted {
+		return fmt.Sprintf("%s: version conflict, expected %s but file was deleted", e.Path, e.BaseVersion)
+	}
+	return fmt.Sprintf("%s: version conflict, expected %s but file is at %s", e.Path, e.BaseVersion, e.CurrentVersion)
+}
+
+func newConflictError(path, baseVersion string, current []byte, exists bool) *ConflictError {
+	conflict := &ConflictError{Path: path, BaseVersion: baseVersion, Deleted: !exists}
+	if !exists {
+		return conflict
+	}
+
+	conflict.CurrentVersion = contentVersion(current)
+	if int64(len(current)) > INLINE_CONTENT_LIMIT {
+		conflict.ContentOmitted = true
+	} else {
+		conflict.Content, conflict.Encoding = encodeContent(current)
+	}
+	return conflict
+}
+
+// writeLock serializes version checked writes coming from different connections
+var writeLock sync.Mutex
+
+// UpdateFile reads the current content of userPath, verifies it against
+// baseVersion when one is given and writes whatever update returns. The
+// new version token is returned.
+func (w *Workspace) UpdateFile(userPath, baseVersion string, update func(current []byte, exists bool) ([]byte, error)) (string, error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	exists := true
+	current, err := w.ReadFile(userPath)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		exists = false
+	}
+
+	if baseVersion != "" && (!exists || contentVersion(current) != baseVersion) {
+		return "", newConflictError(userPath, baseVersion, current, exists)
+	}
+
+	content, err := update(current, exists)
+	if err != nil {
+		return "", err
+	}
+	if err := w.WriteFile(userPath, content); err != nil {
+		return "", err
+	}
+	return contentVersion(content), nil
+}
+
+// checkVersion compares the current version of userPath against baseVersion
+// without loading the whole file. Callers must hold writeLock.
+func (w *Workspace) checkVersion(userPath, baseVersion string) error {
+	if baseVersion == "" {
+		return nil
+	}
+
+	file, err := w.Open(userPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return newConflictError(userPath, baseVersion, nil, false)
+		}
+		return err
+	}
+	defer file.Close()
+
+	version, err := fileChecksum(file)
+	if err != nil {
+		return wrapFSError(userPath, "failed to checksum file", err)
+	}
+	if version == baseVersion {
+		return nil
+	}
+
+	conflict := &ConflictError{Path: userPath, BaseVersion: baseVersion, CurrentVersion: version, ContentOmitted: true}
+	if info, err := file.Stat(); err == nil && info.Size() <= INLINE_CONTENT_LIMIT {
+		if current, err := w.ReadFile(userPath); err == nil {
+			conflict = newConflictError(userPath, baseVersion, current, true)
+		}
+	}
+	return conflict
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Change operations pushed to the client in fs_changed events
+const (
+	FS_CHANGE_CREATED  = "created"
+	FS_CHANGE_MODIFIED = "modified"
+	FS_CHANGE_DELETED  = "deleted"
+	FS_CHANGE_RENAMED  = "renamed"
+)
+
+type FSChange struct {
+	Op      string `json:"op"`
+	Path    string `json:"path"`
+	OldPath string `json:"oldPath,omitempty"`
+	IsDir   bool   `json:"isDir"`
+}
+
+type FSChangedResponse struct {
+	Changes []FSChange `json:"changes"`
+	// Overflow is set when too many changes happened at once, the client should reload the tree
+	Overflow bool `json:"overflow,omitempty"`
+}
+
+// FSWatcher watches the workspace with inotify and pushes debounced,
+// coalesced fs_changed events to every connected client
+type FSWatcher struct {
+	watcher *fsnotify.Watcher
+	manager *WSManager
+
+	mu       sync.Mutex
+	pending  map[string]*FSChange
+	order    []string
+	overflow bool
+	// renamedFrom is the source of the last rename event, waiting for its create
+	renamedFrom string
+	renamedAt   time.Time
+	// movedDir is the old path of the last directory moved in the workspace
+	movedDir string
+	// reloadIgnore is set when an ignore file changed in the batch
+	reloadIgnore bool
+	timer        *time.Timer
+	// batchStart bounds how long a steady stream of events can postpone a flush
+	batchStart time.Time
+}
+
+func NewFSWatcher(manager *WSManager) (*FSWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &FSWatcher{
+		watcher: watcher,
+		manager: manager,
+		pending: make(map[string]*FSChange),
+	}
+	if err := w.addRecursive(WorkspaceFS.Root()); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// isIgnored reports whether the path is inside an ignored directory. Ignored
+// entries themselves are still reported, the tree lists them.
+func (w *FSWatcher) isIgnored(relPath string) bool {
+	return Ignore.IsIgnored(path.Dir(relPath), true)
+}
+
+// addRecursive adds a watch for dir and all of its non-ignored subdirectories
+func (w *FSWatcher) addRecursive(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The directory may have disappeared while walking
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		relPath, err := WorkspaceFS.Rel(path)
+		if err != nil {
+			return err
+		}
+		if relPath != "." && Ignore.IgnoredEntry(relPath, true) {
+			return filepath.SkipDir
+		}
+		if err := w.watcher.Add(path); err != nil {
+			log.Printf("Failed to watch %s: %v", relPath, err)
+		}
+		return nil
+	})
+}
+
+// Run consumes inotify events until ctx is cancelled
+func (w *FSWatcher) Run(ctx context.Context) {
+	defer w.watcher.Close()
+	log.Printf("Watching workspace %s for changes", WorkspaceFS.Root())
+	// Tree hashes are only cached while something invalidates them
+	Trees.setWatched(true)
+	defer Trees.setWatched(false)
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handleEvent(event)
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("File watcher error: %v", err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				Trees.Invalidate()
+				Quota.Invalidate()
+				w.mu.Lock()
+				w.overflow = true
+				w.scheduleFlush()
+				w.mu.Unlock()
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *FSWatcher) handleEvent(event fsnotify.Event) {
+	relPath, err := WorkspaceFS.Rel(event.Name)
+	if err != nil || relPath == "." || w.isIgnored(relPath) {
+		// A move into an ignored directory still ends the pending rename
+		w.mu.Lock()
+		w.renamedFrom = ""
+		w.mu.Unlock()
+		return
+	}
+
+	isDir := false
+	if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) {
+		if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+			isDir = true
+			if event.Has(fsnotify.Create) && !Ignore.IgnoredEntry(relPath, true) {
+				if err := w.addRecursive(event.Name); err != nil {
+					log.Printf("Failed to watch new directory %s: %v", relPath, err)
+				}
+			}
+		}
+	}
+	Trees.Invalidate()
+	Quota.Invalidate()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if isIgnoreFile(relPath) {
+		w.reloadIgnore = true
+	}
+
+	// inotify queues both halves of a move back to back, so a rename only
+	// pairs with the event right after it. A source moved out of the
+	// workspace has no create and stays a delete.
+	renamedFrom := w.renamedFrom
+	if time.Since(w.renamedAt) > FS_WATCH_DEBOUNCE {
+		renamedFrom = ""
+	}
+	w.renamedFrom = ""
+
+	switch {
+	case event.Has(fsnotify.Create):
+		if renamedFrom != "" {
+			w.record(relPath, FS_CHANGE_RENAMED, renamedFrom, isDir)
+			if isDir {
+				w.movedDir = renamedFrom
+			}
+			break
+		}
+		w.record(relPath, FS_CHANGE_CREATED, "", isDir)
+	case event.Has(fsnotify.Write):
+		w.record(relPath, FS_CHANGE_MODIFIED, "", isDir)
+	case event.Has(fsnotify.Remove):
+		w.record(relPath, FS_CHANGE_DELETED, "", false)
+	case event.Has(fsnotify.Rename):
+		// A moved directory reports itself once more after the create
+		if relPath == w.movedDir {
+			w.movedDir = ""
+			return
+		}
+		// The new name arrives as a separate create event, until then treat it as a delete
+		w.renamedFrom = relPath
+		w.renamedAt = time.Now()
+		w.record(relPath, FS_CHANGE_DELETED, "", false)
+	default:
+		return
+	}
+	w.scheduleFlush()
+}
+
+// record coalesces a change with whatever is already pending for the path.
+// Must be called with w.mu held.
+func (w *FSWatcher) record(relPath, op, oldPath string, isDir bool) {
+	if len(w.pending) >= FS_WATCH_MAX_BATCH {
+		w.overflow = true
+		return
+	}
+
+	if op == FS_CHANGE_RENAMED {
+		// The rename source was recorded as a delete, the move replaces it
+		if source, ok := w.pending[oldPath]; ok && source.Op == FS_CHANGE_DELETED {
+			delete(w.pending, oldPath)
+		}
+	}
+
+	existing, ok := w.pending[relPath]
+	if !ok {
+		w.pending[relPath] = &FSChange{Op: op, Path: relPath, OldPath: oldPath, IsDir: isDir}
+		w.order = append(w.order, relPath)
+		return
+	}
+
+	switch {
+	case existing.Op == FS_CHANGE_CREATED && op == FS_CHANGE_MODIFIED:
+		// Still a creation from the client's point of view
+	case existing.Op == FS_CHANGE_CREATED && op == FS_CHANGE_DELETED:
+		delete(w.pending, relPath)
+	case existing.Op == FS_CHANGE_DELETED && (op == FS_CHANGE_CREATED || op == FS_CHANGE_RENAMED):
+		existing.Op = FS_CHANGE_MODIFIED
+		existing.IsDir = isDir
+	case existing.Op == FS_CHANGE_RENAMED && op == FS_CHANGE_MODIFIED:
+		// Keep the rename, the content change is implied
+	default:
+		existing.Op = op
+		existing.OldPath = oldPath
+		existing.IsDir = existing.IsDir || isDir
+	}
+}
+
+// scheduleFlush (re)starts the debounce timer. Must be called with w.mu held.
+func (w *FSWatcher) scheduleFlush() {
+	if w.timer == nil {
+		w.batchStart = time.Now()
+	} else if time.Since(w.batchStart) >= FS_WATCH_MAX_WAIT {
+		// Let the pending timer fire instead of pushing it back again
+		return
+	} else {
+		w.timer.Stop()
+	}
+	w.timer = time.AfterFunc(FS_WATCH_DEBOUNCE, w.flush)
+}
+
+func (w *FSWatcher) flush() {
+	w.mu.Lock()
+	response := FSChangedResponse{Overflow: w.overflow}
+	for _, relPath := range w.order {
+		if change, ok := w.pending[relPath]; ok {
+			response.Changes = append(response.Changes, *change)
+			delete(w.pending, relPath)
+		}
+	}
+	w.pending = make(map[string]*FSChange)
+	w.order = nil
+	w.renamedFrom = ""
+	w.movedDir = ""
+	w.overflow = false
+	w.timer = nil
+	reloadIgnore := w.reloadIgnore
+	w.reloadIgnore = false
+	w.mu.Unlock()
+
+	if reloadIgnore {
+		if err := Ignore.Reload(); err != nil {
+			log.Printf("Failed to reload ignore rules: %v", err)
+		}
+	}
+
+	if len(response.Changes) == 0 && !response.Overflow {
+		return
+	}
+	if response.Overflow {
+		response.Changes = nil
+	}
+	w.manager.Broadcast(RESPONSE_FS_CHANGED, response)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func newTestWatcher(t *testing.T) *FSWatcher {
+	t.Helper()
+	previousIgnore := Ignore
+	Ignore = &IgnoreRules{rules: parseIgnoreLines("", []string{"node_modules/"})}
+	t.Cleanup(func() { Ignore = previousIgnore })
+	w, err := NewFSWatcher(nil)
+	if err != nil {
+		t.Fatalf("failed to start watcher: %v", err)
+	}
+	t.Cleanup(func() { w.watcher.Close() })
+	return w
+}
+
+// pendingChanges stops the debounce timer and returns the batch in order
+func (w *FSWatcher) pendingChanges() []FSChange {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	var changes []FSChange
+	for _, relPath := range w.order {
+		if change, ok := w.pending[relPath]; ok {
+			changes = append(changes, *change)
+		}
+	}
+	return changes
+}
+
+func TestWatcherRenamePairing(t *testing.T) {
+	type event struct {
+		op   fsnotify.Op
+		name string
+	}
+	tests := []struct {
+		name   string
+		dirs   []string
+		events []event
+		// age makes the last rename older than the debounce window
+		age  bool
+		want []FSChange
+	}{
+		{
+			name:   "file rename",
+			events: []event{{fsnotify.Rename, "a.txt"}, {fsnotify.Create, "b.txt"}},
+			want:   []FSChange{{Op: FS_CHANGE_RENAMED, Path: "b.txt", OldPath: "a.txt"}},
+		},
+		{
+			name:   "directory move reports the source twice",
+			dirs:   []string{"dst"},
+			events: []event{{fsnotify.Rename, "src"}, {fsnotify.Create, "dst"}, {fsnotify.Rename, "src"}},
+			want:   []FSChange{{Op: FS_CHANGE_RENAMED, Path: "dst", OldPath: "src", IsDir: true}},
+		},
+		{
+			name:   "moved out then unrelated create",
+			events: []event{{fsnotify.Rename, "gone.txt"}, {fsnotify.Write, "other.txt"}, {fsnotify.Create, "new.txt"}},
+			want: []FSChange{
+				{Op: FS_CHANGE_DELETED, Path: "gone.txt"},
+				{Op: FS_CHANGE_MODIFIED, Path: "other.txt"},
+				{Op: FS_CHANGE_CREATED, Path: "new.txt"},
+			},
+		},
+		{
+			name:   "moved into an ignored directory",
+			events: []event{{fsnotify.Rename, "a.txt"}, {fsnotify.Create, "node_modules/a.txt"}, {fsnotify.Create, "new.txt"}},
+			want: []FSChange{
+				{Op: FS_CHANGE_DELETED, Path: "a.txt"},
+				{Op: FS_CHANGE_CREATED, Path: "new.txt"},
+			},
+		},
+		{
+			name:   "create after the debounce window",
+			events: []event{{fsnotify.Rename, "a.txt"}, {fsnotify.Create, "b.txt"}},
+			age:    true,
+			want: []FSChange{
+				{Op: FS_CHANGE_DELETED, Path: "a.txt"},
+				{Op: FS_CHANGE_CREATED, Path: "b.txt"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := newTestWorkspace(t, nil)
+			for _, dir := range tt.dirs {
+				if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w := newTestWatcher(t)
+			for i, e := range tt.events {
+				if tt.age && i == len(tt.events)-1 {
+					w.mu.Lock()
+					w.renamedAt = time.Now().Add(-2 * FS_WATCH_DEBOUNCE)
+					w.mu.Unlock()
+				}
+				w.handleEvent(fsnotify.Event{Op: e.op, Name: filepath.Join(root, e.name)})
+			}
+			got := w.pendingChanges()
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %+v; got %+v", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("change %d: expected %+v; got %+v", i, tt.want[i], got[i])
+				}
+			}
+		})
+	}
+}
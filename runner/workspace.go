@@ -0,0 +1,411 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Error codes surfaced to the client when a file system operation is rejected
+const (
+	FS_ERR_INVALID_PATH      = "invalid_path"
+	FS_ERR_OUTSIDE_WORKSPACE = "outside_workspace"
+	FS_ERR_WORKSPACE_ROOT    = "workspace_root"
+	FS_ERR_NOT_FOUND         = "not_found"
+	FS_ERR_ALREADY_EXISTS    = "already_exists"
+	FS_ERR_NOT_A_DIRECTORY   = "not_a_directory"
+	FS_ERR_IS_DIRECTORY      = "is_directory"
+	FS_ERR_SPECIAL_FILE      = "special_file"
+	FS_ERR_PERMISSION        = "permission_denied"
+	FS_ERR_TOO_LARGE         = "file_too_large"
+	FS_ERR_INVALID_ENCODING  = "invalid_encoding"
+	FS_ERR_INVALID_UPLOAD    = "invalid_upload"
+	FS_ERR_TOO_MANY_UPLOADS  = "too_many_uploads"
+	FS_ERR_INVALID_RANGE     = "invalid_range"
+	FS_ERR_CHECKSUM_MISMATCH = "checksum_mismatch"
+	FS_ERR_INVALID_PATCH     = "invalid_patch"
+	FS_ERR_INVALID_ARCHIVE   = "invalid_archive"
+	FS_ERR_STALE_CURSOR      = "stale_cursor"
+	FS_ERR_NOT_INITIALIZED   = "not_initialized"
+	FS_ERR_QUOTA_EXCEEDED    = "quota_exceeded"
+	FS_ERR_PROTECTED         = "protected_path"
+	FS_ERR_TOOL_UNAVAILABLE  = "tool_unavailable"
+	FS_ERR_TOOL_FAILED       = "tool_failed"
+	FS_ERR_IO                = "io_error"
+)
+
+// FSError is a typed file system error that the client can show to the user
+type FSError struct {
+	Code    string `json:"code"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+	Err     error  `json:"-"`
+}
+
+func (e *FSError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Path, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+func (e *FSError) Unwrap() error {
+	return e.Err
+}
+
+func newFSError(code, path, message string) *FSError {
+	return &FSError{Code: code, Path: path, Message: message}
+}
+
+func isFSErrorCode(err error, code string) bool {
+	var fsErr *FSError
+	return errors.As(err, &fsErr) && fsErr.Code == code
+}
+
+// wrapFSError maps an os level error onto a typed FSError
+func wrapFSError(path, message string, err error) error {
+	var fsErr *FSError
+	if errors.As(err, &fsErr) {
+		return fsErr
+	}
+
+	code := FS_ERR_IO
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		code = FS_ERR_NOT_FOUND
+	case errors.Is(err, fs.ErrExist):
+		code = FS_ERR_ALREADY_EXISTS
+	case errors.Is(err, fs.ErrPermission):
+		code = FS_ERR_PERMISSION
+	}
+	return &FSError{Code: code, Path: path, Message: message, Err: err}
+}
+
+// Workspace is the file system layer every fs_* handler goes through.
+// All paths given to it are relative to the workspace root, and every
+// resolved path is guaranteed to stay inside that root after symlinks
+// have been followed.
+type Workspace struct {
+	root string
+}
+
+var WorkspaceFS *Workspace
+
+func NewWorkspace(dir string) (*Workspace, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	root, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+	return &Workspace{root: root}, nil
+}
+
+func (w *Workspace) Root() string {
+	return w.root
+}
+
+// Clean normalizes a client supplied path into a workspace relative path.
+// Leading slashes are treated as the workspace root, any attempt to climb
+// above the root is rejected.
+func (w *Workspace) Clean(userPath string) (string, error) {
+	if strings.ContainsRune(userPath, 0) {
+		return "", newFSError(FS_ERR_INVALID_PATH, userPath, "path contains a NUL byte")
+	}
+
+	p := strings.TrimLeft(filepath.ToSlash(userPath), "/")
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return "", newFSError(FS_ERR_OUTSIDE_WORKSPACE, userPath, "path traversal is not allowed")
+		}
+	}
+
+	return filepath.Clean(filepath.FromSlash(p)), nil
+}
+
+// Rel converts an absolute path inside the workspace back to a slash
+// separated workspace relative path
+func (w *Workspace) Rel(fullPath string) (string, error) {
+	rel, err := filepath.Rel(w.root, fullPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (w *Workspace) contains(fullPath string) bool {
+	return fullPath == w.root || strings.HasPrefix(fullPath, w.root+string(filepath.Separator))
+}
+
+// Resolve returns the real absolute path for userPath with all symlinks
+// followed. The path does not need to exist, in which case the deepest
+// existing ancestor is resolved and the remainder appended to it.
+func (w *Workspace) Resolve(userPath string) (string, error) {
+	rel, err := w.Clean(userPath)
+	if err != nil {
+		return "", err
+	}
+
+	existing := filepath.Join(w.root, rel)
+	var rest []string
+	for existing != w.root {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", wrapFSError(userPath, "failed to stat path", err)
+		}
+		rest = append([]string{filepath.Base(existing)}, rest...)
+		existing = filepath.Dir(existing)
+	}
+
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", newFSError(FS_ERR_NOT_FOUND, userPath, "path points to a dangling symbolic link")
+		}
+		return "", wrapFSError(userPath, "failed to resolve path", err)
+	}
+
+	resolved := filepath.Join(append([]string{real}, rest...)...)
+	if !w.contains(resolved) {
+		return "", newFSError(FS_ERR_OUTSIDE_WORKSPACE, userPath, "path resolves outside of the workspace")
+	}
+	return resolved, nil
+}
+
+// ResolveNoFollow resolves the parent directory of userPath but keeps the
+// final element untouched, so symlinks themselves can be removed or renamed
+// without touching what they point to
+func (w *Workspace) ResolveNoFollow(userPath string) (string, error) {
+	rel, err := w.Clean(userPath)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return w.root, nil
+	}
+
+	parent, err := w.Resolve(filepath.Dir(rel))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(rel)), nil
+}
+
+// checkRegular rejects devices, pipes, sockets and other special files
+func checkRegular(userPath string, info fs.FileInfo) error {
+	if info.Mode().IsRegular() || info.IsDir() || info.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	return newFSError(FS_ERR_SPECIAL_FILE, userPath, "special files cannot be accessed")
+}
+
+func (w *Workspace) isRoot(fullPath string) bool {
+	return fullPath == w.root
+}
+
+func (w *Workspace) ReadDir(userPath string) ([]fs.DirEntry, error) {
+	target, err := w.Resolve(userPath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, wrapFSError(userPath, "failed to read directory", err)
+	}
+	if !info.IsDir() {
+		return nil, newFSError(FS_ERR_NOT_A_DIRECTORY, userPath, "path is not a directory")
+	}
+
+	entries, err := os.ReadDir(target)
+	if err != nil {
+		return nil, wrapFSError(userPath, "failed to read directory", err)
+	}
+	return entries, nil
+}
+
+// Open opens a regular file for reading
+func (w *Workspace) Open(userPath string) (*os.File, error) {
+	target, err := w.Resolve(userPath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, wrapFSError(userPath, "failed to open file", err)
+	}
+	if info.IsDir() {
+		return nil, newFSError(FS_ERR_IS_DIRECTORY, userPath, "path is a directory")
+	}
+	if err := checkRegular(userPath, info); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(target)
+	if err != nil {
+		return nil, wrapFSError(userPath, "failed to open file", err)
+	}
+	return f, nil
+}
+
+func (w *Workspace) ReadFile(userPath string) ([]byte, error) {
+	f, err := w.Open(userPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil, wrapFSError(userPath, "failed to read file", err)
+	}
+	return content, nil
+}
+
+// Create creates or truncates a regular file for writing, creating parent
+// directories as needed
+func (w *Workspace) Create(userPath string) (*os.File, error) {
+	target, err := w.Resolve(userPath)
+	if err != nil {
+		return nil, err
+	}
+	if w.isRoot(target) {
+		return nil, newFSError(FS_ERR_WORKSPACE_ROOT, userPath, "cannot write to the workspace root")
+	}
+
+	if info, err := os.Stat(target); err == nil {
+		if info.IsDir() {
+			return nil, newFSError(FS_ERR_IS_DIRECTORY, userPath, "path is a directory")
+		}
+		if err := checkRegular(userPath, info); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, wrapFSError(userPath, "failed to create parent directories", err)
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, wrapFSError(userPath, "failed to create file", err)
+	}
+	return f, nil
+}
+
+func (w *Workspace) WriteFile(userPath string, content []byte) error {
+	f, err := w.Create(userPath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return wrapFSError(userPath, "failed to write file", err)
+	}
+	if err := f.Close(); err != nil {
+		return wrapFSError(userPath, "failed to write file", err)
+	}
+	return nil
+}
+
+func (w *Workspace) MkdirAll(userPath string) error {
+	target, err := w.Resolve(userPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return wrapFSError(userPath, "failed to create directory", err)
+	}
+	return nil
+}
+
+// RemoveAll deletes a file or directory. Symlinks are removed, never followed.
+func (w *Workspace) RemoveAll(userPath string) error {
+	target, err := w.ResolveNoFollow(userPath)
+	if err != nil {
+		return err
+	}
+	if w.isRoot(target) {
+		return newFSError(FS_ERR_WORKSPACE_ROOT, userPath, "cannot delete the workspace root")
+	}
+
+	info, err := os.Lstat(target)
+	if err != nil {
+		return wrapFSError(userPath, "failed to stat path", err)
+	}
+	if err := checkRegular(userPath, info); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(target); err != nil {
+		return wrapFSError(userPath, "failed to delete path", err)
+	}
+	return nil
+}
+
+// Rename moves oldPath to newPath inside the workspace. Symlinks are moved
+// as links, never followed.
+func (w *Workspace) Rename(oldPath, newPath string) error {
+	source, err := w.ResolveNoFollow(oldPath)
+	if err != nil {
+		return err
+	}
+	destination, err := w.ResolveNoFollow(newPath)
+	if err != nil {
+		return err
+	}
+	if w.isRoot(source) || w.isRoot(destination) {
+		return newFSError(FS_ERR_WORKSPACE_ROOT, oldPath, "cannot rename the workspace root")
+	}
+
+	info, err := os.Lstat(source)
+	if err != nil {
+		return wrapFSError(oldPath, "failed to stat path", err)
+	}
+	if err := checkRegular(oldPath, info); err != nil {
+		return err
+	}
+	if existing, err := os.Lstat(destination); err == nil {
+		if err := checkRegular(newPath, existing); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return wrapFSError(newPath, "failed to create parent directories", err)
+	}
+	if err := os.Rename(source, destination); err != nil {
+		return wrapFSError(oldPath, "failed to rename path", err)
+	}
+	return nil
+}
+
+// WalkDir walks the tree rooted at userPath. Paths handed to fn are
+// workspace relative and slash separated. Symlinked directories are
+// not descended into.
+func (w *Workspace) WalkDir(userPath string, fn func(relPath string, d fs.DirEntry) error) error {
+	target, err := w.Resolve(userPath)
+	if err != nil {
+		return err
+	}
+
+	err = filepath.WalkDir(target, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := w.Rel(path)
+		if err != nil {
+			return err
+		}
+		return fn(relPath, d)
+	})
+	if err != nil {
+		return wrapFSError(userPath, "failed to walk directory", err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkspaceClean(t *testing.T) {
+	w := &Workspace{root: "/workspace"}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr string
+	}{
+		{"relative", "src/app.js", "src/app.js", ""},
+		{"absolute is rooted at the workspace", "/src/app.js", "src/app.js", ""},
+		{"root", "/", ".", ""},
+		{"empty", "", ".", ""},
+		{"dot segments", "./src/./app.js", "src/app.js", ""},
+		{"repeated slashes", "src//app.js", "src/app.js", ""},
+		{"parent", "..", "", FS_ERR_OUTSIDE_WORKSPACE},
+		{"parent prefix", "../etc/passwd", "", FS_ERR_OUTSIDE_WORKSPACE},
+		{"parent in the middle", "src/../../etc/passwd", "", FS_ERR_OUTSIDE_WORKSPACE},
+		{"parent that stays inside", "src/../app.js", "", FS_ERR_OUTSIDE_WORKSPACE},
+		{"absolute parent", "/../etc/passwd", "", FS_ERR_OUTSIDE_WORKSPACE},
+		{"dots in a name", "src/..app.js", "src/..app.js", ""},
+		{"NUL byte", "src/app.js\x00.txt", "", FS_ERR_INVALID_PATH},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := w.Clean(tt.path)
+			if tt.wantErr != "" {
+				if !isFSErrorCode(err, tt.wantErr) {
+					t.Fatalf("expected %s; got %q, %v", tt.wantErr, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected %q; got %v", tt.want, err)
+			}
+			if got != filepath.FromSlash(tt.want) {
+				t.Errorf("expected %q; got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// newSymlinkWorkspace sets up a workspace with links pointing in and out of it
+func newSymlinkWorkspace(t *testing.T) string {
+	t.Helper()
+	newTestWorkspace(t, map[string]string{"src/app.js": "app"})
+	root := WorkspaceFS.Root()
+	outside, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"link-in":       filepath.Join(root, "src"),
+		"link-relative": "src/app.js",
+		"link-out":      outside,
+		"secret-link":   filepath.Join(outside, "secret.txt"),
+		"climb":         "../",
+		"dangling":      filepath.Join(root, "missing"),
+		"src/up":        "..",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestWorkspaceResolve(t *testing.T) {
+	root := newSymlinkWorkspace(t)
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr string
+	}{
+		{"file", "src/app.js", "src/app.js", ""},
+		{"missing file", "src/new.js", "src/new.js", ""},
+		{"missing directories", "a/b/c.js", "a/b/c.js", ""},
+		{"symlink inside", "link-in/app.js", "src/app.js", ""},
+		{"relative symlink", "link-relative", "src/app.js", ""},
+		{"symlink back to the root", "src/up/src/app.js", "src/app.js", ""},
+		{"symlink escaping the root", "link-out", "", FS_ERR_OUTSIDE_WORKSPACE},
+		{"file symlink escaping the root", "secret-link", "", FS_ERR_OUTSIDE_WORKSPACE},
+		{"file below an escaping parent", "link-out/secret.txt", "", FS_ERR_OUTSIDE_WORKSPACE},
+		{"new file below an escaping parent", "link-out/new.txt", "", FS_ERR_OUTSIDE_WORKSPACE},
+		{"relative symlink climbing out", "climb/other", "", FS_ERR_OUTSIDE_WORKSPACE},
+		{"dangling symlink", "dangling", "", FS_ERR_NOT_FOUND},
+		{"traversal", "../secret.txt", "", FS_ERR_OUTSIDE_WORKSPACE},
+		{"NUL byte", "src/app.js\x00", "", FS_ERR_INVALID_PATH},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := WorkspaceFS.Resolve(tt.path)
+			if tt.wantErr != "" {
+				if !isFSErrorCode(err, tt.wantErr) {
+					t.Fatalf("expected %s; got %q, %v", tt.wantErr, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected the path to resolve; got %v", err)
+			}
+			if want := filepath.Join(root, filepath.FromSlash(tt.want)); got != want {
+				t.Errorf("expected %s; got %s", want, got)
+			}
+		})
+	}
+
+	// Reads go through Resolve, an escaping link never reaches the file
+	if _, err := WorkspaceFS.ReadFile("link-out/secret.txt"); !isFSErrorCode(err, FS_ERR_OUTSIDE_WORKSPACE) {
+		t.Errorf("expected reading through an escaping link to fail; got %v", err)
+	}
+}
+
+func TestWorkspaceResolveNoFollow(t *testing.T) {
+	root := newSymlinkWorkspace(t)
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr string
+	}{
+		{"root", "/", ".", ""},
+		{"file", "src/app.js", "src/app.js", ""},
+		// The link itself is inside, only what it points to is not
+		{"symlink escaping the root", "link-out", "link-out", ""},
+		{"dangling symlink", "dangling", "dangling", ""},
+		{"symlinked parent inside", "link-in/app.js", "src/app.js", ""},
+		{"symlinked parent escaping the root", "link-out/secret.txt", "", FS_ERR_OUTSIDE_WORKSPACE},
+		{"relative parent climbing out", "climb/other", "", FS_ERR_OUTSIDE_WORKSPACE},
+		{"traversal", "src/../../secret.txt", "", FS_ERR_OUTSIDE_WORKSPACE},
+		{"NUL byte", "link-out\x00", "", FS_ERR_INVALID_PATH},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := WorkspaceFS.ResolveNoFollow(tt.path)
+			if tt.wantErr != "" {
+				if !isFSErrorCode(err, tt.wantErr) {
+					t.Fatalf("expected %s; got %q, %v", tt.wantErr, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected the path to resolve; got %v", err)
+			}
+			if want := filepath.Join(root, filepath.FromSlash(tt.want)); got != want {
+				t.Errorf("expected %s; got %s", want, got)
+			}
+		})
+	}
+}
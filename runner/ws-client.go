@@ -1,32 +1,64 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gorilla/websocket"
 )
 
 type Client struct {
-	conn     *websocket.Conn
-	handler  *WSManager
-	s3Client *s3.Client
-	send     chan WSResponse
-	done     chan struct{}
+	conn    *websocket.Conn
+	handler *WSManager
+	session atomic.Pointer[Session]
+	// claims of the token the connection was opened with, nil when auth is disabled
+	claims *LabClaims
+	send   chan WSResponse
+	done   chan struct{}
+	// uploads holds the chunked uploads in flight on this connection, the
+	// write loop expires idle ones
+	uploadMu sync.Mutex
+	uploads  map[string]*pendingUpload
+
+	// tasks holds the cancel functions of running searches and background
+	// requests, they must all have stopped before the send channel is closed
+	taskMu  sync.Mutex
+	tasks   map[string]context.CancelFunc
+	taskWG  sync.WaitGroup
+	closing bool
+	// nextTask numbers background requests, lastTask is closed once the
+	// latest one finished. Both are only used by the read loop.
+	nextTask uint64
+	lastTask chan struct{}
 }
 
-func NewClient(conn *websocket.Conn, handler *WSManager, s3Client *s3.Client) *Client {
+func NewClient(conn *websocket.Conn, handler *WSManager, claims *LabClaims) *Client {
 	return &Client{
-		conn:     conn,
-		s3Client: s3Client,
-		handler:  handler,
-		send:     make(chan WSResponse, 256),
-		done:     make(chan struct{}),
+		conn:    conn,
+		handler: handler,
+		claims:  claims,
+		send:    make(chan WSResponse, 256),
+		done:    make(chan struct{}),
+		uploads: make(map[string]*pendingUpload),
+		tasks:   make(map[string]context.CancelFunc),
 	}
 }
 
+// Session is nil until the connection is initialized
+func (c *Client) Session() *Session {
+	return c.session.Load()
+}
+
+func (c *Client) SetSession(session *Session) {
+	c.session.Store(session)
+}
+
 func (c *Client) readMessages() {
 	defer close(c.done)
 
@@ -53,9 +85,16 @@ func (c *Client) readMessages() {
 			c.SendError("Invalid JSON format", err.Error())
 			continue
 		}
+		if request.RequestID == "" {
+			request.RequestID = request.LegacyRequestID
+		}
 		if err := c.handler.routeEvent(request, c); err != nil {
 			log.Println("Error handling Message: ", err)
-			c.SendError("Handler error", err.Error())
+			// A dropped response breaks the request/response contract, the
+			// client reconnects and resyncs instead of waiting forever
+			if errors.Is(err, errSendBufferFull) {
+				break
+			}
 		}
 	}
 }
@@ -87,6 +126,7 @@ func (c *Client) writeMessages() {
 			}
 
 		case <-ticker.C:
+			c.expireUploads()
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				log.Printf("Error sending ping: %v", err)
@@ -99,61 +139,266 @@ func (c *Client) writeMessages() {
 	}
 }
 
-// SendResponse sends a standardized success response
+// errSendBufferFull is returned when a response had to be dropped because the
+// client does not read fast enough
+var errSendBufferFull = errors.New("send buffer is full")
+
+// enqueue queues a response for the write loop without blocking the caller
+func (c *Client) enqueue(response WSResponse) error {
+	response.Timestamp = time.Now().Format(time.RFC3339)
+
+	select {
+	case c.send <- response:
+		return nil
+	default:
+		log.Printf("Dropping %s response for request %q: %v", response.Type, response.RequestID, errSendBufferFull)
+		return errSendBufferFull
+	}
+}
+
+// SendResponse sends a standardized success response that is not tied to a request
 func (c *Client) SendResponse(responseType string, data interface{}) error {
+	return c.enqueue(WSResponse{
+		Type:   responseType,
+		Status: STATUS_SUCCESS,
+		Data:   data,
+	})
+}
+
+// Reply sends a standardized success response for the request carried by ctx
+func (c *Client) Reply(ctx context.Context, responseType string, data interface{}) error {
+	return c.enqueue(WSResponse{
+		Type:      responseType,
+		Status:    STATUS_SUCCESS,
+		Data:      data,
+		RequestID: requestIDFromContext(ctx),
+	})
+}
+
+// ReplyWait is like Reply but waits for room in the send buffer instead of
+// dropping the response, used by handlers that stream results
+func (c *Client) ReplyWait(ctx context.Context, responseType string, data interface{}) error {
 	response := WSResponse{
 		Type:      responseType,
 		Status:    STATUS_SUCCESS,
 		Data:      data,
+		RequestID: requestIDFromContext(ctx),
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
 
 	select {
 	case c.send <- response:
 		return nil
-	default:
-		return log.Output(1, "Send channel is full")
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return context.Canceled
 	}
 }
 
 // SendError sends a standardized error response
 func (c *Client) SendError(message, details string) error {
-	response := WSResponse{
+	return c.sendError("", message, details)
+}
+
+func (c *Client) sendError(requestID, message, details string) error {
+	return c.enqueue(WSResponse{
 		Type:      RESPONSE_ERROR,
 		Status:    STATUS_ERROR,
 		Message:   message,
 		Data:      map[string]string{"details": details},
-		Timestamp: time.Now().Format(time.RFC3339),
+		RequestID: requestID,
+	})
+}
+
+// ReplyError reports a failed handler for the request carried by ctx. File
+// system errors and conflicts keep their structure so the client can react
+// to them.
+func (c *Client) ReplyError(ctx context.Context, err error) error {
+	requestID := requestIDFromContext(ctx)
+
+	var fsErr *FSError
+	if errors.As(err, &fsErr) {
+		return c.sendFSError(requestID, fsErr)
+	}
+	var conflictErr *ConflictError
+	if errors.As(err, &conflictErr) {
+		return c.sendConflict(requestID, conflictErr)
+	}
+	var gitErr *GitError
+	if errors.As(err, &gitErr) {
+		return c.sendGitError(requestID, gitErr)
 	}
+	return c.sendError(requestID, "Handler execution failed", err.Error())
+}
 
-	select {
-	case c.send <- response:
-		return nil
-	default:
-		return log.Output(1, "Send channel is full")
+// sendFSError sends a typed file system error so the client can react to the error code
+func (c *Client) sendFSError(requestID string, fsErr *FSError) error {
+	details := fsErr.Message
+	if fsErr.Err != nil {
+		details = fsErr.Err.Error()
 	}
+	return c.enqueue(WSResponse{
+		Type:    RESPONSE_ERROR,
+		Status:  STATUS_ERROR,
+		Message: fsErr.Message,
+		Data: map[string]string{
+			"code":    fsErr.Code,
+			"path":    fsErr.Path,
+			"details": details,
+		},
+		RequestID: requestID,
+	})
+}
+
+// sendGitError keeps what git printed so the UI can show it next to the error code
+func (c *Client) sendGitError(requestID string, gitErr *GitError) error {
+	return c.enqueue(WSResponse{
+		Type:    RESPONSE_ERROR,
+		Status:  STATUS_ERROR,
+		Message: gitErr.Message,
+		Data: map[string]interface{}{
+			"code":     gitErr.Code,
+			"command":  gitErr.Command,
+			"exitCode": gitErr.ExitCode,
+			"details":  gitErr.Stderr,
+		},
+		RequestID: requestID,
+	})
+}
+
+// sendConflict tells the client its write was based on a stale version of the file
+func (c *Client) sendConflict(requestID string, conflictErr *ConflictError) error {
+	return c.enqueue(WSResponse{
+		Type:      RESPONSE_CONFLICT,
+		Status:    STATUS_ERROR,
+		Message:   "File was changed since it was loaded",
+		Data:      conflictErr,
+		RequestID: requestID,
+	})
+}
+
+// SendAck confirms that a request was received and accepted for processing
+func (c *Client) SendAck(requestID, eventType string) error {
+	return c.enqueue(WSResponse{
+		Type:      RESPONSE_ACK,
+		Status:    STATUS_INFO,
+		Data:      map[string]string{"event": eventType},
+		RequestID: requestID,
+	})
+}
+
+// SendNack tells the client a request was rejected and whether retrying it can help
+func (c *Client) SendNack(requestID, eventType, reason string, retryable bool) error {
+	return c.enqueue(WSResponse{
+		Type:    RESPONSE_NACK,
+		Status:  STATUS_ERROR,
+		Message: reason,
+		Data: map[string]interface{}{
+			"event":     eventType,
+			"retryable": retryable,
+		},
+		RequestID: requestID,
+	})
 }
 
 // SendInfo sends a standardized info response
 func (c *Client) SendInfo(message string, data interface{}) error {
-	response := WSResponse{
-		Type:      RESPONSE_INFO,
-		Status:    STATUS_INFO,
-		Message:   message,
-		Data:      data,
-		Timestamp: time.Now().Format(time.RFC3339),
+	return c.enqueue(WSResponse{
+		Type:    RESPONSE_INFO,
+		Status:  STATUS_INFO,
+		Message: message,
+		Data:    data,
+	})
+}
+
+// startTask registers a background search or request and returns its context
+func (c *Client) startTask(ctx context.Context, taskID string) (context.Context, bool) {
+	c.taskMu.Lock()
+	defer c.taskMu.Unlock()
+	if c.closing {
+		return nil, false
 	}
 
-	select {
-	case c.send <- response:
-		return nil
-	default:
-		return log.Output(1, "Send channel is full")
+	taskCtx, cancel := context.WithCancel(ctx)
+	c.tasks[taskID] = cancel
+	c.taskWG.Add(1)
+	return taskCtx, true
+}
+
+func (c *Client) finishTask(taskID string) {
+	c.taskMu.Lock()
+	if cancel, ok := c.tasks[taskID]; ok {
+		cancel()
+		delete(c.tasks, taskID)
+	}
+	c.taskMu.Unlock()
+	c.taskWG.Done()
+}
+
+func (c *Client) cancelTask(taskID string) bool {
+	c.taskMu.Lock()
+	defer c.taskMu.Unlock()
+	cancel, ok := c.tasks[taskID]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// runInBackground runs a slow request off the read loop, so pongs and other
+// requests keep flowing while git or a formatter works. Background requests
+// of one connection still run one after the other, in the order they came in.
+func (c *Client) runInBackground(ctx context.Context, run func(ctx context.Context)) bool {
+	c.nextTask++
+	taskID := "request-" + strconv.FormatUint(c.nextTask, 10)
+	taskCtx, ok := c.startTask(ctx, taskID)
+	if !ok {
+		return false
+	}
+
+	previous := c.lastTask
+	done := make(chan struct{})
+	c.lastTask = done
+	go func() {
+		defer close(done)
+		defer c.finishTask(taskID)
+		if previous != nil {
+			select {
+			case <-previous:
+			case <-taskCtx.Done():
+				return
+			}
+		}
+		run(taskCtx)
+	}()
+	return true
+}
+
+// dropConnection makes the read loop stop, for failures outside of it
+func (c *Client) dropConnection() {
+	if c.conn != nil {
+		c.conn.Close()
 	}
 }
 
 // Close gracefully closes the client connection
 func (c *Client) Close() {
+	c.taskMu.Lock()
+	c.closing = true
+	for _, cancel := range c.tasks {
+		cancel()
+	}
+	c.taskMu.Unlock()
+	c.taskWG.Wait()
+
+	c.uploadMu.Lock()
+	for id, upload := range c.uploads {
+		log.Printf("Discarding unfinished upload %s for %s", id, upload.path)
+		upload.discard()
+	}
+	c.uploads = make(map[string]*pendingUpload)
+	c.uploadMu.Unlock()
 	close(c.send)
 }
 
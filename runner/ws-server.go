@@ -2,9 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
-	"net/url"
 	"sync"
 
 	"github.com/gorilla/websocket"
@@ -21,23 +21,49 @@ var (
 
 type WSManager struct {
 	fsHandlers map[string]fsHandler
+	clients    map[*Client]struct{}
 	sync.RWMutex
 }
 
+// NewFSManager registers every handler up front, the map is only read afterwards
 func NewFSManager(ctx context.Context) *WSManager {
-	return &WSManager{
+	m := &WSManager{
 		fsHandlers: make(map[string]fsHandler),
+		clients:    make(map[*Client]struct{}),
 	}
+	m.setupHandlers()
+	return m
+}
+
+func (m *WSManager) addClient(client *Client) {
+	m.Lock()
+	defer m.Unlock()
+	m.clients[client] = struct{}{}
+}
+
+func (m *WSManager) removeClient(client *Client) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.clients, client)
 }
 
-func startFSServer(ctx context.Context) {
-	manager := NewFSManager(ctx)
-	manager.setupHandlers()
-	http.HandleFunc("/fs", manager.serveFS)
-	log.Println("File system WebSocket server listening on :8081")
+// Broadcast pushes a response to every connected client
+func (m *WSManager) Broadcast(responseType string, data interface{}) {
+	m.RLock()
+	defer m.RUnlock()
+	for client := range m.clients {
+		if err := client.SendResponse(responseType, data); err != nil {
+			log.Printf("Failed to broadcast %s: %v", responseType, err)
+		}
+	}
 }
 
 func (m *WSManager) serveFS(w http.ResponseWriter, r *http.Request) {
+	// Tokens are checked before the upgrade so a rejected client gets a plain 401
+	claims, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
 
 	conn, err := websocketUpgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -45,23 +71,22 @@ func (m *WSManager) serveFS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s3Client, err := InitS3Client()
-	if err != nil {
-		log.Println("Failed to initialize S3 client:", err)
-		return
+	client := NewClient(conn, m, claims)
+	// A pod deployed for a lab already knows who it serves, others wait for fs_initialize_client
+	if session := podSession(claims); session != nil {
+		client.SetSession(session)
 	}
-	client := NewClient(conn, m, s3Client)
 
 	// Send connection established message using standardized format
 	if err := client.SendInfo("Connection established", map[string]string{
 		"server":  "runner-service",
-		"version": "1.7.0",
+		"version": "1.8.0",
 	}); err != nil {
 		log.Println("Failed to send connection message:", err)
 		return
 	}
 
-	m.setupHandlers()
+	m.addClient(client)
 
 	// Start client message handling
 	go client.readMessages()
@@ -72,6 +97,7 @@ func (m *WSManager) serveFS(w http.ResponseWriter, r *http.Request) {
 	log.Println("Client disconnected")
 
 	// Cleanup
+	m.removeClient(client)
 	client.Close()
 	conn.Close()
 }
@@ -84,8 +110,68 @@ func (m *WSManager) setupHandlers() {
 	m.fsHandlers[FS_DELETE_FILE] = DeleteFileHandler
 	m.fsHandlers[FS_EDIT_FILE_META] = EditFileMetaHandler
 	m.fsHandlers[FS_FETCH_QUEST_META] = FetchQuestMetaHandler
+	m.fsHandlers[FS_TREE_SYNC] = TreeSyncHandler
 	m.fsHandlers[FS_INITIALIZE_CLIENT] = InitializeClientHandler
 	m.fsHandlers[SYNC_FILES_TO_S3] = SyncFilesToS3Handler
+	m.fsHandlers[FS_DOWNLOAD_CHUNK] = DownloadChunkHandler
+	m.fsHandlers[FS_UPLOAD_START] = UploadStartHandler
+	m.fsHandlers[FS_UPLOAD_CHUNK] = UploadChunkHandler
+	m.fsHandlers[FS_UPLOAD_COMPLETE] = UploadCompleteHandler
+	m.fsHandlers[FS_UPLOAD_ABORT] = UploadAbortHandler
+	m.fsHandlers[FS_FILE_PATCH] = FilePatchHandler
+	m.fsHandlers[FS_SEARCH] = SearchHandler
+	m.fsHandlers[FS_SEARCH_CANCEL] = SearchCancelHandler
+	m.fsHandlers[FS_IMPORT_ARCHIVE] = ImportArchiveHandler
+	m.fsHandlers[GIT_STATUS] = GitStatusHandler
+	m.fsHandlers[GIT_DIFF] = GitDiffHandler
+	m.fsHandlers[GIT_LOG] = GitLogHandler
+	m.fsHandlers[GIT_STAGE] = GitStageHandler
+	m.fsHandlers[GIT_COMMIT] = GitCommitHandler
+	m.fsHandlers[GIT_CHECKOUT] = GitCheckoutHandler
+	m.fsHandlers[FS_HISTORY_LIST] = HistoryListHandler
+	m.fsHandlers[FS_HISTORY_DIFF] = HistoryDiffHandler
+	m.fsHandlers[FS_HISTORY_RESTORE] = HistoryRestoreHandler
+	m.fsHandlers[FS_SYNC_STATUS] = SyncStatusHandler
+	m.fsHandlers[FS_QUOTA_STATUS] = QuotaStatusHandler
+	m.fsHandlers[FS_FORMAT_FILE] = FormatFileHandler
+	m.fsHandlers[FS_LINT_FILE] = LintFileHandler
+}
+
+// Events whose handlers run git, formatters and linters or unpack archives.
+// They can take seconds, so they run off the read loop.
+var BACKGROUND_EVENTS = map[string]bool{
+	FS_IMPORT_ARCHIVE: true,
+	FS_FORMAT_FILE:    true,
+	FS_LINT_FILE:      true,
+	GIT_STATUS:        true,
+	GIT_DIFF:          true,
+	GIT_LOG:           true,
+	GIT_STAGE:         true,
+	GIT_COMMIT:        true,
+	GIT_CHECKOUT:      true,
+}
+
+type requestIDKey struct{}
+
+func requestIDFromContext(ctx context.Context) string {
+	if requestID, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return requestID
+	}
+	return ""
+}
+
+// isRetryable reports whether a failed request may succeed when sent again
+func isRetryable(err error) bool {
+	var fsErr *FSError
+	if errors.As(err, &fsErr) {
+		return fsErr.Code == FS_ERR_IO
+	}
+	var gitErr *GitError
+	if errors.As(err, &gitErr) {
+		return false
+	}
+	var conflictErr *ConflictError
+	return !errors.As(err, &conflictErr)
 }
 
 func (m *WSManager) routeEvent(event Event, client *Client) error {
@@ -93,42 +179,78 @@ func (m *WSManager) routeEvent(event Event, client *Client) error {
 	handler, exists := m.fsHandlers[event.Type]
 	m.RUnlock()
 
+	// Only clients speaking the requestId protocol get ack/nack messages, older
+	// clients resolve their pending request on the first message carrying the id
+	wantsAck := event.RequestID != "" && event.LegacyRequestID == ""
+
 	if !exists {
 		log.Printf("No handler found for event type: %s", event.Type)
-		return client.SendError("Unknown event type", "Handler not found for event type: "+event.Type)
+		if wantsAck {
+			client.SendNack(event.RequestID, event.Type, "Unknown event type", false)
+		}
+		return client.sendError(event.RequestID, "Unknown event type", "Handler not found for event type: "+event.Type)
 	}
 
-	// Update lab monitor queue with user interaction
-	if LAB_ID != "" {
-		UpdateLabMonitorQueue(LAB_ID)
-	}
+	// Create a context for the handler, carrying the request id so every reply can echo it
+	ctx := context.WithValue(context.Background(), requestIDKey{}, event.RequestID)
 
-	// Create a context for the handler
-	ctx := context.Background()
+	// Nothing runs without knowing which lab the connection works on
+	session := client.Session()
+	if session == nil && event.Type != FS_INITIALIZE_CLIENT {
+		err := newFSError(FS_ERR_NOT_INITIALIZED, "", "send "+FS_INITIALIZE_CLIENT+" before any other event")
+		if wantsAck {
+			client.SendNack(event.RequestID, event.Type, err.Error(), false)
+		}
+		return client.ReplyError(ctx, err)
+	}
 
-	// Call the handler
-	if err := handler(ctx, event.Payload, client); err != nil {
-		log.Printf("Handler error for event type %s: %v", event.Type, err)
-		return client.SendError("Handler execution failed", err.Error())
+	// Read only tokens can look but not touch
+	if session != nil && !session.CanWrite() && isWriteEvent(event.Type) {
+		err := newFSError(FS_ERR_PERMISSION, "", "this connection is read only")
+		if wantsAck {
+			client.SendNack(event.RequestID, event.Type, err.Error(), false)
+		}
+		return client.ReplyError(ctx, err)
 	}
 
-	return nil
-}
+	// Refused events only get a nack, the ack promises the handler runs
+	if wantsAck {
+		if err := client.SendAck(event.RequestID, event.Type); err != nil {
+			return err
+		}
+	}
 
-func checkOrigin(r *http.Request) bool {
-	origin := r.Header.Get("Origin")
-	log.Printf(" RECEIVED REQUEST FROM %v REMOTE ADDRR %v ORIGIN,", r.RemoteAddr, origin)
-	if origin == "" {
-		return true
+	// Update lab monitor queue with user interaction
+	if session != nil {
+		UpdateLabMonitorQueue(session.LabID)
 	}
-	u, err := url.Parse(origin)
-	if err != nil {
-		return true
+
+	if BACKGROUND_EVENTS[event.Type] {
+		started := client.runInBackground(ctx, func(ctx context.Context) {
+			err := callHandler(ctx, handler, event, client, wantsAck)
+			if err != nil {
+				log.Println("Error handling Message: ", err)
+			}
+			if errors.Is(err, errSendBufferFull) {
+				client.dropConnection()
+			}
+		})
+		if !started {
+			return errors.New("client is closing")
+		}
+		return nil
 	}
+	return callHandler(ctx, handler, event, client, wantsAck)
+}
 
-	host := u.Host
-	if host == "devsarena.in" || host == "staging.devsarena.in" {
-		return true
+// callHandler runs a handler and reports its failure to the client
+func callHandler(ctx context.Context, handler fsHandler, event Event, client *Client, wantsAck bool) error {
+	if err := handler(ctx, event.Payload, client); err != nil {
+		log.Printf("Handler error for event type %s: %v", event.Type, err)
+		if wantsAck {
+			client.SendNack(event.RequestID, event.Type, err.Error(), isRetryable(err))
+		}
+		return client.ReplyError(ctx, err)
 	}
-	return true
+	return nil
 }
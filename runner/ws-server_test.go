@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// drainResponses returns the types of everything queued for the client
+func drainResponses(client *Client) []string {
+	var types []string
+	for {
+		select {
+		case response := <-client.send:
+			types = append(types, response.Type)
+		default:
+			return types
+		}
+	}
+}
+
+func TestRouteEventRefusesBeforeAck(t *testing.T) {
+	newTestWorkspace(t, map[string]string{"app.js": "app"})
+	manager := NewFSManager(context.Background())
+	payload, _ := json.Marshal(FileContentUpdatePayload{Path: "app.js", Content: "changed"})
+
+	tests := []struct {
+		name    string
+		session *Session
+		want    []string
+	}{
+		{"not initialized", nil, []string{RESPONSE_NACK, RESPONSE_ERROR}},
+		{"read only", &Session{LabID: "lab-1", Scope: TOKEN_SCOPE_READ_ONLY}, []string{RESPONSE_NACK, RESPONSE_ERROR}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewClient(nil, manager, nil)
+			if tt.session != nil {
+				client.SetSession(tt.session)
+			}
+			manager.routeEvent(Event{Type: FS_FILE_CONTENT_UPDATE, Payload: payload, RequestID: "req-1"}, client)
+			if got := drainResponses(client); !equalStrings(got, tt.want) {
+				t.Errorf("expected %v; got %v", tt.want, got)
+			}
+		})
+	}
+
+	if content, _ := WorkspaceFS.ReadFile("app.js"); string(content) != "app" {
+		t.Errorf("expected the refused update not to be written; got %q", content)
+	}
+}
+
+func TestReplyReportsFullSendBuffer(t *testing.T) {
+	client := NewClient(nil, NewFSManager(context.Background()), nil)
+	for i := 0; i < cap(client.send); i++ {
+		if err := client.SendResponse(RESPONSE_ACK, nil); err != nil {
+			t.Fatalf("expected response %d to be queued; got %v", i, err)
+		}
+	}
+	if err := client.Reply(context.Background(), RESPONSE_ACK, nil); !errors.Is(err, errSendBufferFull) {
+		t.Fatalf("expected %v; got %v", errSendBufferFull, err)
+	}
+}
+
+func TestRouteEventRunsSlowHandlersInBackground(t *testing.T) {
+	manager := NewFSManager(context.Background())
+	release := make(chan struct{})
+	var order []string
+	manager.fsHandlers[GIT_STAGE] = func(ctx context.Context, payload json.RawMessage, client *Client) error {
+		<-release
+		order = append(order, GIT_STAGE)
+		return client.Reply(ctx, RESPONSE_ACK, nil)
+	}
+	manager.fsHandlers[GIT_COMMIT] = func(ctx context.Context, payload json.RawMessage, client *Client) error {
+		order = append(order, GIT_COMMIT)
+		return client.Reply(ctx, RESPONSE_ACK, nil)
+	}
+	manager.fsHandlers[FS_SYNC_STATUS] = func(ctx context.Context, payload json.RawMessage, client *Client) error {
+		return client.Reply(ctx, RESPONSE_SYNC_STATUS, nil)
+	}
+
+	client := NewClient(nil, manager, nil)
+	client.SetSession(&Session{LabID: "lab-1", Scope: TOKEN_SCOPE_READ_WRITE})
+
+	// The blocked stage must neither hold up the read loop nor let the commit overtake it
+	manager.routeEvent(Event{Type: GIT_STAGE}, client)
+	manager.routeEvent(Event{Type: GIT_COMMIT}, client)
+	manager.routeEvent(Event{Type: FS_SYNC_STATUS}, client)
+	if got := drainResponses(client); !equalStrings(got, []string{RESPONSE_SYNC_STATUS}) {
+		t.Errorf("expected only the sync status while git is busy; got %v", got)
+	}
+
+	close(release)
+	<-client.lastTask
+	if !equalStrings(order, []string{GIT_STAGE, GIT_COMMIT}) {
+		t.Errorf("expected the background requests in order; got %v", order)
+	}
+}
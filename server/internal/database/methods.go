@@ -295,18 +295,21 @@ func (s *service) AddQuest(req AddQuestRequest) (string, error) {
 	// Create quest
 	questID := uuid.New()
 	quest := Quest{
-		ID:              questID,
-		Name:            req.Title,
-		Slug:            slug,
-		Description:     req.Description,
-		BoilerPlateCode: req.BoilerplateUrl,
-		Requirements:    pq.StringArray(req.Requirements),
-		Image:           "", // Empty for now, can be added later
-		CategoryID:      category.ID,
-		DifficultyID:    difficulty.ID,
-		FinalTestCode:   "", // Empty for now, can be added later
-		CreatedAt:       time.Now(),
-		UpdatedAt:       time.Now(),
+		ID:               questID,
+		Name:             req.Title,
+		Slug:             slug,
+		Description:      req.Description,
+		BoilerPlateCode:  req.BoilerplateUrl,
+		Requirements:     pq.StringArray(req.Requirements),
+		ReadOnlyPaths:    pq.StringArray(req.ReadOnlyPaths),
+		UndeletablePaths: pq.StringArray(req.UndeletablePaths),
+		IgnoreDefaults:   pq.StringArray(req.IgnoreDefaults),
+		Image:            "", // Empty for now, can be added later
+		CategoryID:       category.ID,
+		DifficultyID:     difficulty.ID,
+		FinalTestCode:    "", // Empty for now, can be added later
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
 	}
 
 	// Create quest in database
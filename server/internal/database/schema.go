@@ -20,6 +20,11 @@ type AddQuestRequest struct {
 	Requirements   []string            `json:"requirements"`
 	BoilerplateUrl string              `json:"boilerplateUrl"`
 	Checkpoints    []CheckpointRequest `json:"checkpoints"`
+	// Globs of workspace files the checkpoints rely on, see Quest
+	ReadOnlyPaths    []string `json:"readOnlyPaths,omitempty"`
+	UndeletablePaths []string `json:"undeletablePaths,omitempty"`
+	// Ignore rules for the quest's labs, see Quest
+	IgnoreDefaults []string `json:"ignoreDefaults,omitempty"`
 }
 
 type SyncUserRequest struct {
@@ -66,8 +71,15 @@ type Quest struct {
 	FinalTestCode   string         `json:"final_test_code,omitempty"`
 	FinalTestCases  []Testcase     `json:"final_test_cases,omitempty" gorm:"foreignKey:QuestID"`
 	Checkpoints     []Checkpoint   `json:"checkpoints,omitempty" gorm:"foreignKey:QuestID"`
-	CreatedAt       time.Time      `json:"created_at"`
-	UpdatedAt       time.Time      `json:"updated_at"`
+	// Workspace globs the runner protects in quest labs, read only paths can
+	// neither be edited nor deleted, undeletable ones can still be edited
+	ReadOnlyPaths    pq.StringArray `json:"read_only_paths,omitempty" gorm:"type:text[]"`
+	UndeletablePaths pq.StringArray `json:"undeletable_paths,omitempty" gorm:"type:text[]"`
+	// .gitignore style rules the runner uses in place of its defaults for the
+	// quest's language, empty keeps the defaults
+	IgnoreDefaults pq.StringArray `json:"ignore_defaults,omitempty" gorm:"type:text[]"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
 }
 
 // QuestMeta represents quest metadata for listing (without heavy data)
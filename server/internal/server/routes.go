@@ -2,8 +2,10 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -57,6 +59,7 @@ func (s *Server) RegisterRoutes() http.Handler {
 	r.HandlerFunc(http.MethodPost, "/v1/start/quest", s.StartQuestHandler)
 	r.HandlerFunc(http.MethodPost, "/v1/end/quest", s.EndLabHandler)
 	r.HandlerFunc(http.MethodDelete, "/v1/delete/quest", s.DeleteLabHandler)
+	r.HandlerFunc(http.MethodPost, "/v1/labs/:labId/token", s.LabTokenHandler)
 	r.HandlerFunc(http.MethodPost, "/auth/github/sync", s.SyncUserHandler)
 
 	return corsWrapper
@@ -196,15 +199,14 @@ func (s *Server) StartLabHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Copying content from %s to %s", sourceKey, destinationKey)
 
 	labInstance := utils.LabInstanceEntry{
-		Language:       language,
-		LabID:          labId,
-		UserId:         userId,
-		CodeLink:       codeLink,
-		CreatedAt:      time.Now().Unix(),
-		Status:         utils.Created,
-		LastUpdatedAt:  time.Now().Unix(),
-		ProgressLogs:   []utils.LabProgressEntry{},
-		DirtyReadPaths: []utils.DirtyFileEntry{},
+		Language:      language,
+		LabID:         labId,
+		UserId:        userId,
+		CodeLink:      codeLink,
+		CreatedAt:     time.Now().Unix(),
+		Status:        utils.Created,
+		LastUpdatedAt: time.Now().Unix(),
+		ProgressLogs:  []utils.LabProgressEntry{},
 	}
 	utils.RedisUtilsInstance.CreateLabInstance(labInstance)
 	if !labExists {
@@ -240,9 +242,15 @@ func (s *Server) StartLabHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Failed to spin up pod: %v", err), http.StatusInternalServerError)
 		return
 	}
+	accessToken, expiresAt, err := utils.MintLabToken(labId, userId, utils.LabTokenScopeReadWrite)
+	if err != nil {
+		log.Printf("Failed to mint access token for lab %s: %v", labId, err)
+	}
 	response := map[string]interface{}{
-		"success": true,
-		"labId":   labId,
+		"success":     true,
+		"labId":       labId,
+		"accessToken": accessToken,
+		"expiresAt":   expiresAt,
 	}
 
 	jsonResp, err := json.Marshal(response)
@@ -265,10 +273,12 @@ type StartQuestRequest struct {
 
 // StartQuestResponse represents the response payload for starting a quest
 type StartQuestResponse struct {
-	Success bool   `json:"success"`
-	LabID   string `json:"labId"`
-	Message string `json:"message,omitempty"`
-	Error   string `json:"error,omitempty"`
+	Success     bool   `json:"success"`
+	LabID       string `json:"labId"`
+	AccessToken string `json:"accessToken,omitempty"`
+	ExpiresAt   int64  `json:"expiresAt,omitempty"`
+	Message     string `json:"message,omitempty"`
+	Error       string `json:"error,omitempty"`
 }
 
 func (s *Server) StartQuestHandler(w http.ResponseWriter, r *http.Request) {
@@ -418,6 +428,9 @@ func (s *Server) StartQuestHandler(w http.ResponseWriter, r *http.Request) {
 		TestFilesKey:          "",
 		Namespace:             "devsarena",
 		ShouldCreateNamespace: true,
+		ReadOnlyPaths:         quest.ReadOnlyPaths,
+		UndeletablePaths:      quest.UndeletablePaths,
+		IgnoreDefaults:        quest.IgnoreDefaults,
 	}
 
 	testResults :=
@@ -439,12 +452,12 @@ func (s *Server) StartQuestHandler(w http.ResponseWriter, r *http.Request) {
 		Language:         req.Language,
 		LabID:            req.LabID,
 		CodeLink:         codeLink,
+		UserId:           userId,
 		CreatedAt:        time.Now().Unix(),
 		Status:           utils.Created,
 		ActiveCheckpoint: activeCheckpoint,
 		LastUpdatedAt:    time.Now().Unix(),
 		ProgressLogs:     []utils.LabProgressEntry{},
-		DirtyReadPaths:   []utils.DirtyFileEntry{},
 		TestResults:      testResults,
 	}
 	utils.RedisUtilsInstance.CreateLabInstance(labInstance)
@@ -464,11 +477,18 @@ func (s *Server) StartQuestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	accessToken, expiresAt, err := utils.MintLabToken(req.LabID, userId, utils.LabTokenScopeReadWrite)
+	if err != nil {
+		log.Printf("Failed to mint access token for lab %s: %v", req.LabID, err)
+	}
+
 	// Success response
 	response := StartQuestResponse{
-		Success: true,
-		LabID:   req.LabID,
-		Message: "Quest environment started successfully",
+		Success:     true,
+		LabID:       req.LabID,
+		AccessToken: accessToken,
+		ExpiresAt:   expiresAt,
+		Message:     "Quest environment started successfully",
 	}
 
 	log.Printf("Quest pod started successfully for LabID: %s", req.LabID)
@@ -553,11 +573,17 @@ func (s *Server) TriggerS3SyncFromRunner(labId string) error {
 		Path:   "/fs",
 	}
 
+	// The runner only accepts signed tokens, the server signs one for itself
+	token, _, err := utils.MintLabToken(labId, "server", utils.LabTokenScopeReadWrite)
+	if err != nil {
+		return fmt.Errorf("failed to mint runner token: %w", err)
+	}
+
 	log.Printf("Triggering S3 Sync: Connecting to %s", u.String())
 	dialer := websocket.Dialer{
 		HandshakeTimeout: 5 * time.Second,
 	}
-	conn, _, err := dialer.Dial(u.String(), nil)
+	conn, _, err := dialer.Dial(u.String(), http.Header{"Authorization": {"Bearer " + token}})
 	if err != nil {
 		return fmt.Errorf("failed to dial runner websocket: %w", err)
 	}
@@ -909,6 +935,71 @@ func (s *Server) GetQuestCheckpoints(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// LabTokenHandler mints a new token for a running lab, tokens are short
+// lived so clients call this before every (re)connect. Only the frontend
+// calls it, with the internal secret and the id of the signed in user.
+func (s *Server) LabTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	labID := httprouter.ParamsFromContext(r.Context()).ByName("labId")
+
+	if !isInternalRequest(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// The user comes from the session the frontend checked, never from the body
+	userID := r.Header.Get("X-User-Id")
+	if userID == "" {
+		http.Error(w, "Sign in to access this lab", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = utils.LabTokenScopeReadWrite
+	}
+
+	instance, err := utils.RedisUtilsInstance.GetLabInstance(labID)
+	if err != nil {
+		http.Error(w, "Lab not found", http.StatusNotFound)
+		return
+	}
+	// Labs started without a user only get the token handed out when they start
+	if instance.UserId == "" || instance.UserId != userID {
+		http.Error(w, "Lab belongs to another user", http.StatusForbidden)
+		return
+	}
+
+	token, expiresAt, err := utils.MintLabToken(labID, userID, req.Scope)
+	if err != nil {
+		log.Printf("Failed to mint access token for lab %s: %v", labID, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"labId":       labID,
+		"accessToken": token,
+		"expiresAt":   expiresAt,
+		"scope":       req.Scope,
+	})
+}
+
+// isInternalRequest checks the secret shared with the frontend, an unset
+// secret lets nothing through
+func isInternalRequest(r *http.Request) bool {
+	secret := os.Getenv("INTERNAL_API_SECRET")
+	if secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Internal-Secret")), []byte(secret)) == 1
+}
+
 // GetTestResults returns test results for a lab
 func (s *Server) GetTestResults(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,157 @@
+// Package labauth verifies the lab tokens the API server mints for the
+// terminal socket. It mirrors runner/auth.go, the two images are built from
+// separate contexts so they cannot share the code, keep them in step.
+package labauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Scopes a lab token can grant, same tokens the runner accepts
+const (
+	TOKEN_SCOPE_READ_WRITE = "rw"
+	TOKEN_SCOPE_READ_ONLY  = "ro"
+)
+
+// Origins browsers may connect from when ALLOWED_ORIGINS is not set
+var DEFAULT_ALLOWED_ORIGINS = []string{"https://devsarena.in", "https://www.devsarena.in", "https://staging.devsarena.in", "https://staging2.devsarena.in"}
+
+// LabClaims are the claims of a token minted by the API server
+type LabClaims struct {
+	LabID     string `json:"lab"`
+	UserID    string `json:"sub"`
+	Scope     string `json:"scope"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var errMissingToken = errors.New("missing access token")
+
+// Get the lab's token signing key from environment, set by the deployment
+func getLabTokenKey() string {
+	return os.Getenv("LAB_TOKEN_KEY")
+}
+
+// Local development only, lets any connection in without a token
+func isAuthDisabled() bool {
+	return os.Getenv("LAB_AUTH_DISABLED") == "true"
+}
+
+// Get the allowed origins from environment, comma separated. A pattern like
+// https://*.devsarena.in matches every subdomain.
+func getAllowedOrigins() []string {
+	if origins := os.Getenv("ALLOWED_ORIGINS"); origins != "" {
+		return strings.Split(origins, ",")
+	}
+	return DEFAULT_ALLOWED_ORIGINS
+}
+
+// VerifyLabToken checks an HS256 token against the lab's key and returns
+// its claims. Tokens for another lab are refused unless labID is empty.
+func VerifyLabToken(token, labID string) (*LabClaims, error) {
+	key := getLabTokenKey()
+	if key == "" {
+		return nil, fmt.Errorf("access tokens are not configured")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed access token")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed access token")
+	}
+	var alg struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &alg); err != nil || alg.Alg != "HS256" {
+		return nil, fmt.Errorf("unsupported access token")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed access token")
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid access token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed access token")
+	}
+	var claims LabClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed access token")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("access token expired")
+	}
+	if labID != "" && claims.LabID != labID {
+		return nil, fmt.Errorf("access token is for another lab")
+	}
+	if claims.Scope != TOKEN_SCOPE_READ_WRITE && claims.Scope != TOKEN_SCOPE_READ_ONLY {
+		return nil, fmt.Errorf("unknown access token scope")
+	}
+	return &claims, nil
+}
+
+// AuthorizeRequest verifies the bearer token, or ?token= since browsers
+// cannot set headers on a WebSocket. Claims are nil when auth is disabled.
+func AuthorizeRequest(r *http.Request, labID string) (*LabClaims, error) {
+	if isAuthDisabled() {
+		return nil, nil
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return nil, errMissingToken
+	}
+	return VerifyLabToken(token, labID)
+}
+
+// CheckOrigin only lets browsers in from the allowed origins. Requests
+// without an Origin do not come from a browser, the token still guards them.
+func CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || isAuthDisabled() {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range getAllowedOrigins() {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		pattern, err := url.Parse(allowed)
+		if err != nil || pattern.Scheme != u.Scheme {
+			continue
+		}
+		if ok, _ := path.Match(pattern.Host, u.Host); ok {
+			return true
+		}
+	}
+	log.Printf("Rejected connection from origin %s", origin)
+	return false
+}
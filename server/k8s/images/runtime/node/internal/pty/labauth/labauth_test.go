@@ -0,0 +1,147 @@
+package labauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testTokenKey = "test-lab-token-key"
+
+// signTestToken mints a token the way the API server does
+func signTestToken(t *testing.T, key string, claims LabClaims) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to encode claims: %v", err)
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func testClaims(labID, scope string, expiresIn time.Duration) LabClaims {
+	now := time.Now()
+	return LabClaims{LabID: labID, UserID: "user-1", Scope: scope, IssuedAt: now.Unix(), ExpiresAt: now.Add(expiresIn).Unix()}
+}
+
+func TestVerifyLabToken(t *testing.T) {
+	t.Setenv("LAB_TOKEN_KEY", testTokenKey)
+
+	valid := signTestToken(t, testTokenKey, testClaims("lab-1", TOKEN_SCOPE_READ_WRITE, time.Minute))
+	tampered := valid[:len(valid)-2] + "xx"
+
+	tests := []struct {
+		name    string
+		token   string
+		scope   string
+		wantErr string
+	}{
+		{"read write", valid, TOKEN_SCOPE_READ_WRITE, ""},
+		{"read only", signTestToken(t, testTokenKey, testClaims("lab-1", TOKEN_SCOPE_READ_ONLY, time.Minute)), TOKEN_SCOPE_READ_ONLY, ""},
+		{"bad signature", signTestToken(t, "another-key", testClaims("lab-1", TOKEN_SCOPE_READ_WRITE, time.Minute)), "", "invalid access token"},
+		{"tampered signature", tampered, "", "invalid access token"},
+		{"expired", signTestToken(t, testTokenKey, testClaims("lab-1", TOKEN_SCOPE_READ_WRITE, -time.Second)), "", "access token expired"},
+		{"wrong lab", signTestToken(t, testTokenKey, testClaims("lab-2", TOKEN_SCOPE_READ_WRITE, time.Minute)), "", "access token is for another lab"},
+		{"unknown scope", signTestToken(t, testTokenKey, testClaims("lab-1", "admin", time.Minute)), "", "unknown access token scope"},
+		{"malformed", "not-a-token", "", "malformed access token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := VerifyLabToken(tt.token, "lab-1")
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("expected error %q; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected token to verify; got %v", err)
+			}
+			if claims.Scope != tt.scope {
+				t.Errorf("expected scope %q; got %q", tt.scope, claims.Scope)
+			}
+		})
+	}
+}
+
+func TestVerifyLabTokenWithoutKey(t *testing.T) {
+	t.Setenv("LAB_TOKEN_KEY", "")
+	token := signTestToken(t, "", testClaims("lab-1", TOKEN_SCOPE_READ_WRITE, time.Minute))
+	if _, err := VerifyLabToken(token, "lab-1"); err == nil {
+		t.Fatal("expected tokens to be refused when no key is configured")
+	}
+}
+
+func TestAuthorizeRequest(t *testing.T) {
+	t.Setenv("LAB_TOKEN_KEY", testTokenKey)
+	t.Setenv("LAB_AUTH_DISABLED", "")
+	token := signTestToken(t, testTokenKey, testClaims("lab-1", TOKEN_SCOPE_READ_ONLY, time.Minute))
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+		wantOK bool
+	}{
+		{"bearer header", "/pty", "Bearer " + token, true},
+		{"query parameter", "/pty?token=" + token, "", true},
+		{"missing token", "/pty", "", false},
+		{"garbage header", "/pty", "Bearer nope", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			claims, err := AuthorizeRequest(r, "lab-1")
+			if tt.wantOK != (err == nil) {
+				t.Fatalf("expected ok=%v; got %v", tt.wantOK, err)
+			}
+			if tt.wantOK && claims.Scope != TOKEN_SCOPE_READ_ONLY {
+				t.Errorf("expected read only claims; got %q", claims.Scope)
+			}
+		})
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	t.Setenv("LAB_AUTH_DISABLED", "")
+
+	tests := []struct {
+		name    string
+		allowed string
+		origin  string
+		wantOK  bool
+	}{
+		{"default origin", "", "https://devsarena.in", true},
+		{"default www origin", "", "https://www.devsarena.in", true},
+		{"not on the default list", "", "https://evil.example.com", false},
+		{"lookalike domain", "", "https://devsarena.in.evil.com", false},
+		{"no origin", "", "", true},
+		{"exact match", "http://localhost:3000", "http://localhost:3000", true},
+		{"other port", "http://localhost:3000", "http://localhost:4000", false},
+		{"subdomain pattern", "https://*.devsarena.in", "https://lab-1.devsarena.in", true},
+		{"pattern needs a subdomain", "https://*.devsarena.in", "https://devsarena.in", false},
+		{"pattern keeps the scheme", "https://*.devsarena.in", "http://lab-1.devsarena.in", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ALLOWED_ORIGINS", tt.allowed)
+			r := httptest.NewRequest("GET", "/pty", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := CheckOrigin(r); got != tt.wantOK {
+				t.Errorf("expected CheckOrigin(%q)=%v; got %v", tt.origin, tt.wantOK, got)
+			}
+		})
+	}
+}
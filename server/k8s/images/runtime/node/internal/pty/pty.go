@@ -13,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"devsarena/pty-service/labauth"
 	"github.com/gorilla/websocket"
 )
 
@@ -25,6 +26,8 @@ const (
 type PtyHandler struct {
 	conn *websocket.Conn
 	mu   sync.Mutex
+	// readOnly connections see the terminal but cannot type into it or run anything
+	readOnly bool
 }
 
 type inboundMessage struct {
@@ -49,13 +52,22 @@ type runRequestEnvelope struct {
 }
 
 func servePty(w http.ResponseWriter, r *http.Request) {
+	// Tokens are checked before the upgrade so a rejected client gets a plain 401
+	claims, err := labauth.AuthorizeRequest(r, LabID)
+	if err != nil {
+		log.Printf("Rejected terminal connection from %s: %v", r.RemoteAddr, err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
 	conn, err := websocketUpgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade failed: %v", err)
 		return
 	}
 
-	handler := &PtyHandler{conn: conn}
+	handler := &PtyHandler{conn: conn, readOnly: claims != nil && claims.Scope == labauth.TOKEN_SCOPE_READ_ONLY}
 	go handler.start()
 }
 
@@ -193,6 +205,9 @@ func (h *PtyHandler) handleWebSocketMessages(backend io.Writer) {
 		var wsMsg inboundMessage
 		if err := json.Unmarshal(msg, &wsMsg); err != nil {
 			log.Printf("Failed to unmarshal WebSocket message: %v", err)
+			if h.readOnly {
+				continue
+			}
 			log.Printf("Treating as raw input, writing to PTY")
 			backend.Write(msg)
 			continue
@@ -203,6 +218,11 @@ func (h *PtyHandler) handleWebSocketMessages(backend io.Writer) {
 			log.Printf("Received WebSocket message: %+v", wsMsg)
 		}
 
+		if h.readOnly && isPtyWriteMessage(wsMsg.Type) {
+			h.sendMessage(outboundMessage{Type: "error", Data: map[string]any{"message": "this terminal is read only"}})
+			continue
+		}
+
 		switch wsMsg.Type {
 		case "input":
 			var data string
@@ -233,6 +253,15 @@ func (h *PtyHandler) handleWebSocketMessages(backend io.Writer) {
 	}
 }
 
+// Messages that type into the terminal or start processes
+func isPtyWriteMessage(messageType string) bool {
+	switch messageType {
+	case "input", "kill_user_processes", "run", "test":
+		return true
+	}
+	return false
+}
+
 func (h *PtyHandler) handleTestMessage(raw json.RawMessage) {
 	// client sends: { type: "test", data: JSON.stringify({...}) }
 	// so `data` is a JSON string containing a JSON object.
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestReadOnlyMessages(t *testing.T) {
+	tests := []struct {
+		messageType string
+		wantWrite   bool
+	}{
+		{"input", true},
+		{"run", true},
+		{"test", true},
+		{"kill_user_processes", true},
+		{"heartbeat", false},
+		{"heartbeat_response", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.messageType, func(t *testing.T) {
+			if got := isPtyWriteMessage(tt.messageType); got != tt.wantWrite {
+				t.Errorf("expected isPtyWriteMessage(%q)=%v; got %v", tt.messageType, tt.wantWrite, got)
+			}
+		})
+	}
+}
@@ -43,16 +43,15 @@ const (
 	K8S_SERVICE         LabLogServices = "k8s"
 )
 
-type DirtyFileEntry struct {
-	Path   string `json:"path"`
-	Action string `json:"action"` // "edit" or "delete"
-}
+// Dirty paths are not part of the lab instance, the runner keeps them in a
+// hash of their own. Rewriting the instance here can never drop them.
 type LabInstanceEntry struct {
 	LabID            string                  `json:"labId"`
 	CreatedAt        int64                   `json:"createdAt"`
 	Language         string                  `json:"language"`
+	CodeLink         string                  `json:"codeLink"`
+	UserId           string                  `json:"userId"`
 	ActiveCheckpoint int                     `json:"activeCheckpoint"`
-	DirtyReadPaths   []DirtyFileEntry        `json:"dirtyReadPaths"`
 	Status           LabStatus               `json:"status"`
 	LastUpdatedAt    int64                   `json:"lastUpdatedAt"`
 	ProgressLogs     []LabProgressEntry      `json:"progressLogs"`
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"lms_v0/utils"
 	"log"
+	"strings"
 	"text/template"
 	"time"
 
@@ -43,6 +44,11 @@ type SpinUpQuestParams struct {
 	TestFilesKey          string
 	Namespace             string
 	ShouldCreateNamespace bool
+	// Globs from the quest that the runner keeps read only or undeletable
+	ReadOnlyPaths    []string
+	UndeletablePaths []string
+	// Ignore rules the runner starts from instead of its per language defaults
+	IgnoreDefaults []string
 }
 
 type SpinUpWithInit struct {
@@ -55,6 +61,7 @@ type SpinUpWithInit struct {
 	Namespace             string
 	ShouldCreateNamespace bool
 	RequiresInitCommand   *string
+	TokenKey              string
 }
 
 type SpinDownParams struct {
@@ -204,6 +211,7 @@ func SpinUpPodWithLanguage(params SpinUpParams) error {
 		Namespace:             params.Namespace,
 		ShouldCreateNamespace: params.ShouldCreateNamespace,
 		RequiresInitCommand:   requiresInitCmdPtr,
+		TokenKey:              utils.LabTokenKey(params.LabID),
 	}
 
 	if params.ShouldCreateNamespace {
@@ -427,6 +435,12 @@ func CreateDeploymentFromYamlIfDoesNotExists(params SpinUpWithInit) error {
 	return nil
 }
 
+// joinEnvList joins globs into a comma separated env value, quoted for the
+// single quoted YAML strings of the templates
+func joinEnvList(values []string) string {
+	return strings.ReplaceAll(strings.Join(values, ","), "'", "''")
+}
+
 // CreateQuestDeploymentFromYamlIfDoesNotExists creates a quest-specific deployment with test runner support
 func CreateQuestDeploymentFromYamlIfDoesNotExists(params SpinUpQuestParams, requiresInitCommand *string) error {
 	yamlFilePath := "k8s/templates/deployment.quest.template.yaml"
@@ -448,11 +462,19 @@ func CreateQuestDeploymentFromYamlIfDoesNotExists(params SpinUpQuestParams, requ
 		RequiresInitCommand *string
 		AppName             string
 		S3Key               string
+		TokenKey            string
+		ReadOnlyGlobs       string
+		UndeletableGlobs    string
+		IgnoreGlobs         string
 	}{
 		SpinUpQuestParams:   params,
 		RequiresInitCommand: requiresInitCommand,
 		AppName:             fmt.Sprintf("%s-%s", params.Language, params.LabID),
 		S3Key:               fmt.Sprintf("quests/%s/%s", params.ProjectSlug, params.LabID),
+		TokenKey:            utils.LabTokenKey(params.LabID),
+		ReadOnlyGlobs:       joinEnvList(params.ReadOnlyPaths),
+		UndeletableGlobs:    joinEnvList(params.UndeletablePaths),
+		IgnoreGlobs:         joinEnvList(params.IgnoreDefaults),
 	}
 
 	var processedYaml bytes.Buffer
@@ -231,18 +231,21 @@ func (s *service) AddQuest(req database.AddQuestRequest) (string, error) {
 	questID := uuid.New()
 	log.Printf("Creating quest with ID %s", questID)
 	quest := database.Quest{
-		ID:              questID,
-		Name:            req.Title,
-		Slug:            slug,
-		Description:     req.Description,
-		BoilerPlateCode: req.BoilerplateUrl,
-		Requirements:    pq.StringArray(req.Requirements), // Empty for now, can be added later
-		Image:           "",                               // Empty for now, can be added later
-		CategoryID:      category.ID,
-		DifficultyID:    difficulty.ID,
-		FinalTestCode:   "", // Empty for now, can be added later
-		CreatedAt:       time.Now(),
-		UpdatedAt:       time.Now(),
+		ID:               questID,
+		Name:             req.Title,
+		Slug:             slug,
+		Description:      req.Description,
+		BoilerPlateCode:  req.BoilerplateUrl,
+		Requirements:     pq.StringArray(req.Requirements), // Empty for now, can be added later
+		ReadOnlyPaths:    pq.StringArray(req.ReadOnlyPaths),
+		UndeletablePaths: pq.StringArray(req.UndeletablePaths),
+		IgnoreDefaults:   pq.StringArray(req.IgnoreDefaults),
+		Image:            "", // Empty for now, can be added later
+		CategoryID:       category.ID,
+		DifficultyID:     difficulty.ID,
+		FinalTestCode:    "", // Empty for now, can be added later
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
 	}
 
 	// Create quest in database
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"strconv"
@@ -247,11 +248,17 @@ func TriggerS3SyncFromRunner(labId string) error {
 		Path:   "/fs",
 	}
 
+	// The runner only accepts signed tokens, the handler signs one for itself
+	token, _, err := utils.MintLabToken(labId, "server", utils.LabTokenScopeReadWrite)
+	if err != nil {
+		return fmt.Errorf("failed to mint runner token: %w", err)
+	}
+
 	log.Printf("Triggering S3 Sync: Connecting to %s", u.String())
 	dialer := websocket.Dialer{
 		HandshakeTimeout: 5 * time.Second,
 	}
-	conn, _, err := dialer.Dial(u.String(), nil)
+	conn, _, err := dialer.Dial(u.String(), http.Header{"Authorization": {"Bearer " + token}})
 	if err != nil {
 		return fmt.Errorf("failed to dial runner websocket: %w", err)
 	}
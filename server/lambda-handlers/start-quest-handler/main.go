@@ -385,6 +385,9 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 		TestFilesKey:          "",
 		Namespace:             os.Getenv("K8S_NAMESPACE"),
 		ShouldCreateNamespace: false,
+		ReadOnlyPaths:         quest.ReadOnlyPaths,
+		UndeletablePaths:      quest.UndeletablePaths,
+		IgnoreDefaults:        quest.IgnoreDefaults,
 	}
 	testResults :=
 		[]utils.TestResult{}
@@ -410,7 +413,6 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 		ActiveCheckpoint: activeCheckpoint,
 		LastUpdatedAt:    time.Now().Unix(),
 		ProgressLogs:     []utils.LabProgressEntry{},
-		DirtyReadPaths:   []utils.DirtyFileEntry{},
 		TestResults:      testResults,
 	}
 	utils.RedisUtilsInstance.CreateLabInstance(labInstance)
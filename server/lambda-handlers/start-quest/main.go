@@ -335,15 +335,14 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 	}
 
 	labInstance := utils.LabInstanceEntry{
-		Language:       language,
-		LabID:          labId,
-		UserId:         userId,
-		CodeLink:       codeLink,
-		CreatedAt:      time.Now().Unix(),
-		Status:         utils.Created,
-		LastUpdatedAt:  time.Now().Unix(),
-		ProgressLogs:   []utils.LabProgressEntry{},
-		DirtyReadPaths: []utils.DirtyFileEntry{},
+		Language:      language,
+		LabID:         labId,
+		UserId:        userId,
+		CodeLink:      codeLink,
+		CreatedAt:     time.Now().Unix(),
+		Status:        utils.Created,
+		LastUpdatedAt: time.Now().Unix(),
+		ProgressLogs:  []utils.LabProgressEntry{},
 	}
 	utils.RedisUtilsInstance.CreateLabInstance(labInstance)
 	if !labExists {
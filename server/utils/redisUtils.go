@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -57,17 +58,11 @@ type TestResult struct {
 	DurationMs int64      `json:"durationMs"`
 	Error      *TestError `json:"error,omitempty"`
 }
-type DirtyFileEntry struct {
-	Path   string `json:"path"`
-	Action string `json:"action"` // "edit" or "delete"
-}
-
 type LabInstanceEntry struct {
 	LabID            string
 	CreatedAt        int64
 	Language         string
 	CodeLink         string
-	DirtyReadPaths   []DirtyFileEntry
 	Status           LabStatus
 	LastUpdatedAt    int64
 	UserId           string
@@ -162,6 +157,10 @@ func (r *RedisUtils) CreateLabInstance(instance LabInstanceEntry) {
 	if err != nil {
 		log.Fatalf("Failed to create lab instance: %v", err)
 	}
+
+	// A restarted lab starts on a fresh workspace, dirty paths left from the
+	// previous pod would have the runner delete files it never downloaded
+	r.RemoveLabDirtyPaths(instance.LabID)
 	log.Printf("Lab instance %s created", instance.LabID)
 }
 
@@ -298,6 +297,49 @@ func (r *RedisUtils) RemoveLabInstance(labID string) {
 	} else {
 		log.Printf("Lab %s removed from monitoring queue", labID)
 	}
+
+	// The runner flushes dirty paths on SIGTERM, after the teardown was
+	// requested, so they are only left to expire here
+	r.ExpireLabDirtyPaths(labID)
+}
+
+// Dirty paths are kept by the runner outside of the lab instance, in a hash
+// per lab updated with Lua scripts so concurrent writers never overwrite each other
+func LabDirtyPathsKey(labID string) string {
+	return "lab_dirty_paths:" + labID
+}
+
+func LabDirtyVersionKey(labID string) string {
+	return "lab_dirty_version:" + labID
+}
+
+// RemoveLabDirtyPaths drops the dirty paths the runner tracked for a lab
+func (r *RedisUtils) RemoveLabDirtyPaths(labID string) {
+	if r.Client == nil {
+		log.Fatalf("Redis client is not initialized")
+	}
+
+	err := r.Client.Del(r.Ctx, LabDirtyPathsKey(labID), LabDirtyVersionKey(labID)).Err()
+	if err != nil {
+		log.Printf("Failed to remove dirty paths of lab %s: %v", labID, err)
+	}
+}
+
+// How long dirty paths outlive a removed lab, long past the runner's shutdown flush
+const LabDirtyPathsTTL = 24 * time.Hour
+
+// ExpireLabDirtyPaths lets the dirty paths of a removed lab expire without
+// pulling them from under a runner that is still flushing
+func (r *RedisUtils) ExpireLabDirtyPaths(labID string) {
+	if r.Client == nil {
+		log.Fatalf("Redis client is not initialized")
+	}
+
+	for _, key := range []string{LabDirtyPathsKey(labID), LabDirtyVersionKey(labID)} {
+		if err := r.Client.Expire(r.Ctx, key, LabDirtyPathsTTL).Err(); err != nil {
+			log.Printf("Failed to expire %s: %v", key, err)
+		}
+	}
 }
 
 // Global RedisUtils instance
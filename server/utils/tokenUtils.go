@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Scopes a lab token can grant
+const (
+	LabTokenScopeReadWrite = "rw"
+	LabTokenScopeReadOnly  = "ro"
+)
+
+// LabTokenTTL is how long a minted token is accepted, clients ask for a new
+// one before reconnecting
+var LabTokenTTL = 15 * time.Minute
+
+// LabTokenClaims is what the runner and PTY services check when a WebSocket
+// connects. Tokens are HS256 JWTs.
+type LabTokenClaims struct {
+	LabID     string `json:"lab"`
+	UserID    string `json:"sub"`
+	Scope     string `json:"scope"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Header of every lab token, encoded once
+var labTokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// LabTokenKey derives the key lab tokens are signed with. Each lab has its
+// own, so the key handed to a pod through its env cannot sign tokens for any
+// other lab. Returns an empty string when LAB_TOKEN_SECRET is not configured.
+func LabTokenKey(labID string) string {
+	secret := os.Getenv("LAB_TOKEN_SECRET")
+	if secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(labID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Get the token lifetime from environment, e.g. LAB_TOKEN_TTL=30m
+func getLabTokenTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("LAB_TOKEN_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return LabTokenTTL
+}
+
+// MintLabToken signs a short lived token that lets userID connect to the
+// lab's runner and terminal with the given scope
+func MintLabToken(labID, userID, scope string) (string, int64, error) {
+	key := LabTokenKey(labID)
+	if key == "" {
+		return "", 0, fmt.Errorf("LAB_TOKEN_SECRET is not configured")
+	}
+	if scope != LabTokenScopeReadWrite && scope != LabTokenScopeReadOnly {
+		return "", 0, fmt.Errorf("unknown token scope %q", scope)
+	}
+
+	now := time.Now()
+	claims := LabTokenClaims{
+		LabID:     labID,
+		UserID:    userID,
+		Scope:     scope,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(getLabTokenTTL()).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", 0, err
+	}
+
+	signingInput := labTokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(signingInput))
+	token := strings.Join([]string{signingInput, base64.RawURLEncoding.EncodeToString(mac.Sum(nil))}, ".")
+	return token, claims.ExpiresAt, nil
+}